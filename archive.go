@@ -1,7 +1,6 @@
 package schema
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -24,24 +23,26 @@ func NewArchive(method Method, span uint32) Archive {
 	return Archive(uint16(method) | code<<8)
 }
 
+// ArchiveFromString parses an archive such as "sum_600". Errors are a *ParseError, so compare them
+// with ErrInvalidFormat, ErrUnknownMethod etc. using errors.Is, not ==.
 func ArchiveFromString(s string) (Archive, error) {
 	pos := strings.Index(s, "_")
 	if pos == -1 {
-		return 0, ErrInvalidFormat
+		return 0, &ParseError{Input: s, Field: "archive", Err: ErrInvalidFormat}
 	}
 
 	method, err := MethodFromString(s[:pos])
 	if err != nil {
-		return 0, err
+		return 0, within(err, s, 0)
 	}
-	span, err := strconv.ParseInt(s[pos+1:], 10, 32)
+	span, err := parseDecimal(s[pos+1:])
 	if err != nil {
-		return 0, err
+		return 0, &ParseError{Input: s, Field: "span", Offset: pos + 1, Err: err}
 	}
-	if !IsSpanValid(uint32(span)) {
-		return 0, fmt.Errorf("invalid span %d", span)
+	if !IsSpanValid(span) {
+		return 0, &ParseError{Input: s, Field: "span", Offset: pos + 1, Err: fmt.Errorf("%w %d", ErrInvalidSpan, span)}
 	}
-	return NewArchive(method, uint32(span)), nil
+	return NewArchive(method, span), nil
 }
 
 // String returns the traditional key suffix like sum_600 etc
@@ -92,7 +93,7 @@ func MethodFromString(input string) (Method, error) {
 	case "cnt":
 		return Cnt, nil
 	}
-	return 0, errors.New("no such method")
+	return 0, &ParseError{Input: input, Field: "method", Err: ErrUnknownMethod}
 }
 
 // maps human friendly span numbers (in seconds) to optimized code form
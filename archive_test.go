@@ -82,3 +82,18 @@ func TestArchiveFromString(t *testing.T) {
 		}
 	}
 }
+
+func FuzzArchiveFromString(f *testing.F) {
+	f.Add("sum_1800")
+	f.Add("min_600")
+	f.Add("_SUM_1800")
+	f.Fuzz(func(t *testing.T, s string) {
+		archive, err := ArchiveFromString(s)
+		if err != nil {
+			return
+		}
+		if archive.String() != s {
+			t.Fatalf("%q parsed to an archive with string %q", s, archive.String())
+		}
+	})
+}
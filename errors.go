@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnknownMethod = errors.New("no such method")
+var ErrInvalidSpan = errors.New("invalid span")
+
+// ValidationError is returned by Validate for an invalid MetricData or MetricDefinition.
+// Err is one of ErrInvalidOrgIdzero, ErrInvalidIntervalzero, ErrInvalidEmptyName, ErrInvalidMtype
+// or ErrInvalidTagFormat, and can be matched using errors.Is.
+type ValidationError struct {
+	Field string // the invalid field, e.g. "Mtype"
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when a key, archive, method or tagged series can't be parsed from a string.
+type ParseError struct {
+	Input  string // the string being parsed
+	Field  string // the part of Input that is invalid: "org", "key", "archive", "method", "span", "name" or "tags"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: ErrStringTooShort, ErrInvalidFormat, ErrUnknownMethod, ErrInvalidSpan,
+	// ErrInvalidEmptyName, ErrInvalidTagFormat, ErrDuplicateTag, or an error of strconv or encoding/hex
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse %s of %q at offset %d: %s", e.Field, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// within returns err, if it is a ParseError, as relative to input, of which the parsed string started at offset
+func within(err error, input string, offset int) error {
+	if pe, ok := err.(*ParseError); ok {
+		return &ParseError{
+			Input:  input,
+			Field:  pe.Field,
+			Offset: pe.Offset + offset,
+			Err:    pe.Err,
+		}
+	}
+	return err
+}
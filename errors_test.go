@@ -0,0 +1,97 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidationError(t *testing.T) {
+	md := MetricData{
+		OrgId:    1,
+		Name:     "a.b.c",
+		Interval: 10,
+		Mtype:    "gauge",
+		Tags:     []string{"foo=bar"},
+	}
+	if err := md.Validate(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cases := []struct {
+		modify func(md *MetricData)
+		field  string
+		cause  error
+	}{
+		{func(md *MetricData) { md.OrgId = 0 }, "OrgId", ErrInvalidOrgIdzero},
+		{func(md *MetricData) { md.Interval = 0 }, "Interval", ErrInvalidIntervalzero},
+		{func(md *MetricData) { md.Name = "" }, "Name", ErrInvalidEmptyName},
+		{func(md *MetricData) { md.Mtype = "foo" }, "Mtype", ErrInvalidMtype},
+		{func(md *MetricData) { md.Tags = []string{"foo"} }, "Tags", ErrInvalidTagFormat},
+	}
+	for _, c := range cases {
+		m := md
+		c.modify(&m)
+		def := MetricDefinitionFromMetricData(&m)
+		for _, err := range []error{m.Validate(), def.Validate()} {
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Field != c.field || !errors.Is(err, c.cause) {
+				t.Fatalf("%s: expected ValidationError caused by %q, got %v", c.field, c.cause, err)
+			}
+		}
+	}
+}
+
+// TestValidateErrorsIs checks that every error Validate can return matches its sentinel, and no other, using errors.Is,
+// as callers that used to compare with == must now do
+func TestValidateErrorsIs(t *testing.T) {
+	sentinels := []error{ErrInvalidOrgIdzero, ErrInvalidIntervalzero, ErrInvalidEmptyName, ErrInvalidMtype, ErrInvalidTagFormat}
+	invalid := []MetricData{
+		{Name: "a", Interval: 10, Mtype: "gauge"},
+		{OrgId: 1, Name: "a", Mtype: "gauge"},
+		{OrgId: 1, Interval: 10, Mtype: "gauge"},
+		{OrgId: 1, Name: "a", Interval: 10},
+		{OrgId: 1, Name: "a", Interval: 10, Mtype: "gauge", Tags: []string{"a=b", "c="}},
+	}
+	for i := range invalid {
+		md := invalid[i]
+		for _, err := range []error{md.Validate(), MetricDefinitionFromMetricData(&md).Validate()} {
+			for j, sentinel := range sentinels {
+				if errors.Is(err, sentinel) != (i == j) {
+					t.Fatalf("case %d: errors.Is(%v, %q) is %t", i, err, sentinel, i != j)
+				}
+			}
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		input  string
+		parse  func(s string) error
+		field  string
+		offset int
+		cause  error
+	}{
+		{"1.0123", func(s string) error { _, err := MKeyFromString(s); return err }, "key", 0, ErrStringTooShort},
+		{"1.0123456789abcdef0123456789abcdeX", func(s string) error { _, err := MKeyFromString(s); return err }, "key", 2, nil},
+		{"x.0123456789abcdef0123456789abcdef", func(s string) error { _, err := MKeyFromString(s); return err }, "org", 0, ErrInvalidFormat},
+		{"1.0123456789abcdef0123456789abcdef_sum", func(s string) error { _, err := AMKeyFromString(s); return err }, "archive", 0, ErrInvalidFormat},
+		{"1.0123456789abcdef0123456789abcdef_foo_600", func(s string) error { _, err := AMKeyFromString(s); return err }, "method", 35, ErrUnknownMethod},
+		{"1.0123456789abcdef0123456789abcdef_sum_601", func(s string) error { _, err := AMKeyFromString(s); return err }, "span", 39, ErrInvalidSpan},
+		{"sum_x", func(s string) error { _, err := ArchiveFromString(s); return err }, "span", 4, ErrInvalidFormat},
+		{"~~;a=b", func(s string) error { _, _, err := ParseNameWithTags(s); return err }, "name", 0, ErrInvalidEmptyName},
+		{"a.b;c=d;c=e", func(s string) error { _, _, err := ParseNameWithTags(s); return err }, "tags", 8, ErrDuplicateTag},
+	}
+	for _, c := range cases {
+		err := c.parse(c.input)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected ParseError, got %v", c.input, err)
+		}
+		if perr.Input != c.input || perr.Field != c.field || perr.Offset != c.offset {
+			t.Fatalf("%q: expected field %q at offset %d, got %q at offset %d of %q", c.input, c.field, c.offset, perr.Field, perr.Offset, perr.Input)
+		}
+		if c.cause != nil && !errors.Is(err, c.cause) {
+			t.Fatalf("%q: expected error caused by %q, got %v", c.input, c.cause, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package graphite converts between schema.MetricData and the graphite plaintext protocol:
+// one "path value timestamp" line per point, where path may use the tagged syntax "name;key=value;key2=value2".
+// It also decodes the carbon pickle protocol, see ParsePickle.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/internal/lines"
+)
+
+var (
+	ErrMissingFields    = errors.New("expected \"path value timestamp\"")
+	ErrEmptyName        = errors.New("name is empty")
+	ErrInvalidTag       = errors.New("invalid tag")
+	ErrInvalidValue     = errors.New("invalid value")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+)
+
+// ParseError describes a plaintext line that is not a valid "path value timestamp" line
+type ParseError struct {
+	Line   int    // the line number, starting at 1, or 0 if not known
+	Input  string // the line being parsed
+	Field  string // the part of the line that is invalid: "line", "name", "tags", "value" or "timestamp"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: one of the errors above, or an error of strconv
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("graphite: cannot parse %s of line %d %q at offset %d: %s", e.Field, e.Line, e.Input, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("graphite: cannot parse %s of %q at offset %d: %s", e.Field, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parser turns plaintext lines into MetricData.
+// A line only carries a path, value and timestamp, so every metric gets the org, interval, mtype and unit of the Parser.
+type Parser struct {
+	OrgId    int
+	Interval int
+	Mtype    string
+	Unit     string
+}
+
+// NewParser returns a Parser for metrics of the given org and interval, of mtype gauge
+func NewParser(orgId, interval int) *Parser {
+	return &Parser{
+		OrgId:    orgId,
+		Interval: interval,
+		Mtype:    "gauge",
+	}
+}
+
+// ParseLine parses a single line, with or without the trailing newline.
+// The name has superfluous dots removed (see schema.EatDots), and the Id is set.
+// Tags must be valid according to schema.ValidateTag, and can't be a name tag (see schema.IsNameTag).
+func (p *Parser) ParseLine(line []byte) (*schema.MetricData, error) {
+	return p.parse(string(line))
+}
+
+func (p *Parser) parse(line string) (*schema.MetricData, error) {
+	fail := func(field string, offset int, err error) error {
+		return &ParseError{
+			Input:  line,
+			Field:  field,
+			Offset: offset,
+			Err:    err,
+		}
+	}
+
+	var fields [3]string
+	var offsets [3]int
+	n := 0
+	for i := 0; i < len(line); {
+		if isSpace(line[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && !isSpace(line[j]) {
+			j++
+		}
+		if n == len(fields) {
+			return nil, fail("line", i, ErrMissingFields)
+		}
+		fields[n], offsets[n] = line[i:j], i
+		n++
+		i = j
+	}
+	if n != len(fields) {
+		return nil, fail("line", 0, ErrMissingFields)
+	}
+
+	md := &schema.MetricData{
+		OrgId:    p.OrgId,
+		Interval: p.Interval,
+		Unit:     p.Unit,
+		Mtype:    p.Mtype,
+	}
+
+	if field, offset, err := setPath(md, fields[0]); err != nil {
+		return nil, fail(field, offsets[0]+offset, err)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fail("value", offsets[1], err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fail("value", offsets[1], ErrInvalidValue)
+	}
+	md.Value = value
+
+	md.Time, err = parseTimestamp(fields[2])
+	if err != nil {
+		return nil, fail("timestamp", offsets[2], err)
+	}
+
+	md.SetId()
+	return md, nil
+}
+
+// setPath sets the name and tags of md from a path, which may use the tagged syntax.
+// on error, it returns the invalid field and its offset in path.
+func setPath(md *schema.MetricData, path string) (string, int, error) {
+	md.Tags = nil
+	if i := strings.IndexByte(path, ';'); i >= 0 {
+		offset := i + 1
+		md.Tags = strings.Split(path[i+1:], ";")
+		for _, tag := range md.Tags {
+			if !schema.ValidateTag(tag) || schema.IsNameTag(tag) {
+				return "tags", offset, fmt.Errorf("%w %q", ErrInvalidTag, tag)
+			}
+			offset += len(tag) + 1
+		}
+		path = path[:i]
+	}
+	md.Name = schema.EatDots(path)
+	if md.Name == "" {
+		return "name", 0, ErrEmptyName
+	}
+	return "", 0, nil
+}
+
+// parseTimestamp parses unix timestamps in seconds, truncating any fractional part as carbon does
+func parseTimestamp(s string) (int64, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil {
+			return 0, err
+		}
+		return floatTimestamp(f)
+	}
+	if ts < 0 {
+		return 0, ErrInvalidTimestamp
+	}
+	return ts, nil
+}
+
+// floatTimestamp truncates a unix timestamp in seconds with a fractional part
+func floatTimestamp(f float64) (int64, error) {
+	if !(f >= 0 && f < math.MaxInt64) {
+		return 0, ErrInvalidTimestamp
+	}
+	return int64(f), nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Reader reads MetricData from plaintext lines
+type Reader struct {
+	p *Parser
+	s *lines.Scanner
+}
+
+// NewReader returns a Reader that parses the lines read from r using p
+func (p *Parser) NewReader(r io.Reader) *Reader {
+	return &Reader{
+		p: p,
+		s: lines.NewScanner(r),
+	}
+}
+
+// Read parses the next line that isn't blank. A *ParseError is not fatal: it has the number of the line set,
+// and Read can be called again to continue with the next line. Once r is exhausted, Read returns io.EOF.
+func (r *Reader) Read() (*schema.MetricData, error) {
+	line, num, err := r.s.Next()
+	if err != nil {
+		return nil, err
+	}
+	md, err := r.p.ParseLine(line)
+	if err != nil {
+		err.(*ParseError).Line = num
+	}
+	return md, err
+}
+
+// AppendLine appends the plaintext line for m, including the trailing newline, to b.
+// Tags are written in sorted order, except for any "name" tag, which is left out.
+// m is not modified.
+func AppendLine(b []byte, m *schema.MetricData) []byte {
+	b = append(b, m.Name...)
+	tags := m.Tags
+	if !sort.StringsAreSorted(tags) {
+		tags = append([]string(nil), tags...)
+		sort.Strings(tags)
+	}
+	for _, t := range tags {
+		if schema.IsNameTag(t) {
+			continue
+		}
+		b = append(b, ';')
+		b = append(b, t...)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, m.Time, 10)
+	return append(b, '\n')
+}
+
+// Writer writes MetricData as plaintext lines to an io.Writer.
+// Every metric results in a write, so wrapping the writer in a bufio.Writer is recommended.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: w,
+	}
+}
+
+// Write writes m as a single line
+func (w *Writer) Write(m *schema.MetricData) error {
+	w.buf = AppendLine(w.buf[:0], m)
+	_, err := w.w.Write(w.buf)
+	return err
+}
@@ -0,0 +1,215 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestParseLine(t *testing.T) {
+	p := NewParser(1, 10)
+	cases := []struct {
+		line string
+		exp  schema.MetricData
+	}{
+		{
+			"a.b.c 1.5 1500000000",
+			schema.MetricData{Name: "a.b.c", Value: 1.5, Time: 1500000000},
+		},
+		{
+			"  ..a..b.c.\t-2e3   1500000000.7\r\n",
+			schema.MetricData{Name: "a.b.c", Value: -2000, Time: 1500000000},
+		},
+		{
+			"a.b.c;foo=bar;dc=us-east=1;a=b~ 0 0",
+			schema.MetricData{Name: "a.b.c", Tags: []string{"a=b~", "dc=us-east=1", "foo=bar"}},
+		},
+	}
+	for i, c := range cases {
+		md, err := p.ParseLine([]byte(c.line))
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+		exp := c.exp
+		exp.OrgId = 1
+		exp.Interval = 10
+		exp.Mtype = "gauge"
+		exp.SetId()
+		if !reflect.DeepEqual(&exp, md) {
+			t.Fatalf("case %d: expected %+v, got %+v", i, exp, *md)
+		}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestParseLineDefaults(t *testing.T) {
+	p := &Parser{
+		OrgId:    3,
+		Interval: 60,
+		Mtype:    "rate",
+		Unit:     "req/s",
+	}
+	md, err := p.ParseLine([]byte("foo 1 2"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if md.OrgId != 3 || md.Interval != 60 || md.Mtype != "rate" || md.Unit != "req/s" {
+		t.Fatalf("expected parser defaults to be applied, got %+v", *md)
+	}
+	if !strings.HasPrefix(md.Id, "3.") {
+		t.Fatalf("expected id of org 3, got %q", md.Id)
+	}
+}
+
+func TestParseLineInvalid(t *testing.T) {
+	p := NewParser(1, 10)
+	cases := []struct {
+		line   string
+		field  string
+		offset int
+		err    error
+	}{
+		{"", "line", 0, ErrMissingFields},
+		{"a.b 1", "line", 0, ErrMissingFields},
+		{"a.b 1 2 3", "line", 8, ErrMissingFields},
+		{"... 1 2", "name", 0, ErrEmptyName},
+		{";foo=bar 1 2", "name", 0, ErrEmptyName},
+		{"a.b;foo=bar;baz 1 2", "tags", 12, ErrInvalidTag},
+		{"a.b;foo= 1 2", "tags", 4, ErrInvalidTag},
+		{"a.b;foo=bar; 1 2", "tags", 12, ErrInvalidTag},
+		{"a.b;name=foo 1 2", "tags", 4, ErrInvalidTag},
+		{"a.b; 1 2", "tags", 4, ErrInvalidTag},
+		{"a.b;foo=~bar 1 2", "tags", 4, ErrInvalidTag},
+		{"a.b one 2", "value", 4, strconv.ErrSyntax},
+		{"a.b NaN 2", "value", 4, ErrInvalidValue},
+		{"a.b -Inf 2", "value", 4, ErrInvalidValue},
+		{"a.b 1 two", "timestamp", 6, strconv.ErrSyntax},
+		{"a.b 1 -1", "timestamp", 6, ErrInvalidTimestamp},
+		{"a.b 1 1e30", "timestamp", 6, ErrInvalidTimestamp},
+	}
+	for _, c := range cases {
+		_, err := p.ParseLine([]byte(c.line))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected ParseError, got %v", c.line, err)
+		}
+		if perr.Field != c.field || perr.Offset != c.offset || perr.Input != c.line || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at offset %d caused by %q, got %s at offset %d: %s", c.line, c.field, c.offset, c.err, perr.Field, perr.Offset, err.Error())
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	input := "a.b 1 10\n\n  \nbogus\nc.d;x=y 2 20\r\ne.f 3 30"
+	r := NewParser(1, 10).NewReader(strings.NewReader(input))
+	var names []string
+	var lines []int
+	for {
+		md, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if perr, ok := err.(*ParseError); ok {
+			lines = append(lines, perr.Line)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		names = append(names, md.Name)
+	}
+	if !reflect.DeepEqual([]string{"a.b", "c.d", "e.f"}, names) {
+		t.Fatalf("expected metrics a.b, c.d and e.f, got %v", names)
+	}
+	if !reflect.DeepEqual([]int{4}, lines) {
+		t.Fatalf("expected a parse error for line 4, got errors for lines %v", lines)
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	md := &schema.MetricData{
+		Name:  "a.b",
+		Value: 0.1,
+		Time:  1500000000,
+		Tags:  []string{"foo=bar", "name=ignored", "dc=us"},
+	}
+	out := string(AppendLine([]byte("x\n"), md))
+	if out != "x\na.b;dc=us;foo=bar 0.1 1500000000\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if md.Tags[0] != "foo=bar" {
+		t.Fatalf("expected the tags to not be modified, got %v", md.Tags)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	p := NewParser(1, 10)
+	var metrics []*schema.MetricData
+	for i := 0; i < 10; i++ {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Interval: 10,
+			Name:     "some.id.of.a.metric." + strconv.Itoa(i),
+			Value:    float64(i) / 3,
+			Time:     int64(1500000000 + i*10),
+			Mtype:    "gauge",
+		}
+		if i%2 == 0 {
+			md.Tags = []string{"i=" + strconv.Itoa(i), "foo=bar"}
+		}
+		md.SetId()
+		metrics = append(metrics, md)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, md := range metrics {
+		if err := w.Write(md); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	r := p.NewReader(&buf)
+	for i := range metrics {
+		md, err := r.Read()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !reflect.DeepEqual(metrics[i], md) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *metrics[i], *md)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// FuzzParseLine checks that ParseLine rejects arbitrary input without panicking,
+// and that whatever it accepts survives a round trip.
+func FuzzParseLine(f *testing.F) {
+	f.Add([]byte("a.b.c;foo=bar 1.5 1500000000"))
+	f.Add([]byte("..a 1e3 12.5\n"))
+	p := NewParser(1, 10)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		md, err := p.ParseLine(data)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("expected a *ParseError, got %T: %s", err, err.Error())
+			}
+			return
+		}
+		again, err := p.ParseLine(AppendLine(nil, md))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !reflect.DeepEqual(md, again) {
+			t.Fatalf("expected %+v after round trip, got %+v", *md, *again)
+		}
+	})
+}
@@ -0,0 +1,683 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/raintank/schema"
+)
+
+// the carbon pickle protocol sends messages consisting of a 4 byte big endian length, followed by
+// a pickled list of (path, (timestamp, value)) tuples. a pickle is a program for a stack machine
+// that can construct arbitrary python objects, so only the opcodes needed to construct such lists
+// are supported: those of lists, tuples, strings, numbers and the memo, of pickle protocols 0 to 5.
+
+var (
+	ErrInvalidPickle     = errors.New("invalid pickle")
+	ErrUnsupportedOpcode = errors.New("unsupported pickle opcode")
+	ErrPickleTooLarge    = errors.New("pickle too large")
+)
+
+// DefaultMaxPickleSize is the default maximum size of a pickled message, the same as carbon's
+const DefaultMaxPickleSize = 1 << 20
+
+// PickleError is returned for a datapoint of a pickled message that can't be converted
+type PickleError struct {
+	Index int    // the index of the datapoint in the message, starting at 0
+	Path  string // the path of the datapoint, if known
+	Field string // the part of the datapoint that is invalid: "datapoint", "name", "tags", "value" or "timestamp"
+	// Err is the cause: one of ErrInvalidPickle, ErrEmptyName, ErrInvalidTag, ErrInvalidValue or ErrInvalidTimestamp,
+	// or an error of strconv
+	Err error
+}
+
+func (e *PickleError) Error() string {
+	return fmt.Sprintf("graphite: cannot convert %s of pickled datapoint %d %q: %s", e.Field, e.Index, e.Path, e.Err)
+}
+
+func (e *PickleError) Unwrap() error {
+	return e.Err
+}
+
+// pickle opcodes
+const (
+	opMark            = '('
+	opStop            = '.'
+	opInt             = 'I'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opLong            = 'L'
+	opLong1           = 0x8a
+	opFloat           = 'F'
+	opBinFloat        = 'G'
+	opString          = 'S'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opUnicode         = 'V'
+	opBinUnicode      = 'X'
+	opShortBinUnicode = 0x8c
+	opBinUnicode8     = 0x8d
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opEmptyList       = ']'
+	opList            = 'l'
+	opAppend          = 'a'
+	opAppends         = 'e'
+	opEmptyTuple      = ')'
+	opTuple           = 't'
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opMemoize         = 0x94
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opProto           = 0x80
+	opFrame           = 0x95
+)
+
+// the values that pickles can construct: string, int64, float64, tuple and *list
+type tuple []interface{}
+type list []interface{}
+
+// unpickler runs a pickle
+type unpickler struct {
+	b     []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalidPickle, fmt.Sprintf(format, args...), u.pos)
+}
+
+// read returns the next n bytes
+func (u *unpickler) read(n uint64) ([]byte, error) {
+	if n > uint64(len(u.b)-u.pos) {
+		return nil, u.fail("unexpected end of data")
+	}
+	b := u.b[u.pos : u.pos+int(n)]
+	u.pos += int(n)
+	return b, nil
+}
+
+// readLine returns the argument of a text opcode, up to the newline
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.b[u.pos:], '\n')
+	if i < 0 {
+		return "", u.fail("unterminated line")
+	}
+	line := string(u.b[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+// readUint reads a little endian unsigned integer of n bytes
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// readString reads a string of which the length is a little endian unsigned integer of n bytes
+func (u *unpickler) readString(n int) (string, error) {
+	l, err := u.readUint(n)
+	if err != nil {
+		return "", err
+	}
+	b, err := u.read(l)
+	return string(b), err
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 || (len(u.marks) > 0 && len(u.stack) == u.marks[len(u.marks)-1]) {
+		return nil, u.fail("stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark pops and returns all values up to the last mark
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, u.fail("no mark")
+	}
+	m := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	values := append([]interface{}(nil), u.stack[m:]...)
+	u.stack = u.stack[:m]
+	return values, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 || (len(u.marks) > 0 && len(u.stack) == u.marks[len(u.marks)-1]) {
+		return nil, u.fail("stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) put(i int) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[i] = v
+	return nil
+}
+
+func (u *unpickler) get(i int) error {
+	v, ok := u.memo[i]
+	if !ok {
+		return u.fail("memo key %d not found", i)
+	}
+	u.push(v)
+	return nil
+}
+
+// appendTo appends the values to the list on top of the stack
+func (u *unpickler) appendTo(values ...interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := v.(*list)
+	if !ok {
+		return u.fail("append to %T", v)
+	}
+	*l = append(*l, values...)
+	return nil
+}
+
+// unpickle runs the pickle in b and returns the value it constructs
+func unpickle(b []byte) (interface{}, error) {
+	u := unpickler{
+		b:    b,
+		memo: make(map[int]interface{}),
+	}
+	for u.pos < len(u.b) {
+		op := u.b[u.pos]
+		u.pos++
+		var err error
+		switch op {
+		case opProto:
+			var v uint64
+			if v, err = u.readUint(1); err == nil && v > 5 {
+				err = u.fail("unsupported protocol %d", v)
+			}
+		case opFrame:
+			_, err = u.read(8)
+		case opMark:
+			u.marks = append(u.marks, len(u.stack))
+		case opStop:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+
+		case opInt, opLong:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				err = u.pushInt(strings.TrimSuffix(line, "L"))
+			}
+		case opBinInt:
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(uint32(v))))
+			}
+		case opBinInt1, opBinInt2:
+			n := 1
+			if op == opBinInt2 {
+				n = 2
+			}
+			var v uint64
+			if v, err = u.readUint(n); err == nil {
+				u.push(int64(v))
+			}
+		case opLong1:
+			var n uint64
+			if n, err = u.readUint(1); err == nil {
+				err = u.pushLong(int(n))
+			}
+		case opFloat:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				err = u.pushFloat(line)
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+
+		case opString:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				if s, uerr := unquotePython(line); uerr == nil {
+					u.push(s)
+				} else {
+					err = u.fail("invalid string %q", line)
+				}
+			}
+		case opUnicode:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				if s, uerr := unescapeRawUnicode(line); uerr == nil {
+					u.push(s)
+				} else {
+					err = u.fail("invalid unicode string %q", line)
+				}
+			}
+		case opShortBinString, opShortBinUnicode, opShortBinBytes:
+			err = u.pushString(1, op != opShortBinUnicode)
+		case opBinString, opBinUnicode, opBinBytes:
+			err = u.pushString(4, op != opBinUnicode)
+		case opBinUnicode8:
+			err = u.pushString(8, false)
+
+		case opEmptyList:
+			u.push(&list{})
+		case opList:
+			var values []interface{}
+			if values, err = u.popMark(); err == nil {
+				l := list(values)
+				u.push(&l)
+			}
+		case opAppend:
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+		case opAppends:
+			var values []interface{}
+			if values, err = u.popMark(); err == nil {
+				err = u.appendTo(values...)
+			}
+		case opEmptyTuple:
+			u.push(tuple{})
+		case opTuple:
+			var values []interface{}
+			if values, err = u.popMark(); err == nil {
+				u.push(tuple(values))
+			}
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(u.stack) < n || (len(u.marks) > 0 && len(u.stack)-n < u.marks[len(u.marks)-1]) {
+				return nil, u.fail("stack underflow")
+			}
+			t := append(tuple(nil), u.stack[len(u.stack)-n:]...)
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(t)
+
+		case opPut, opGet:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var i int
+				if i, err = strconv.Atoi(line); err != nil || i < 0 {
+					err = u.fail("invalid memo key %q", line)
+				} else if op == opPut {
+					err = u.put(i)
+				} else {
+					err = u.get(i)
+				}
+			}
+		case opBinPut, opLongBinPut, opBinGet, opLongBinGet:
+			n := 1
+			if op == opLongBinPut || op == opLongBinGet {
+				n = 4
+			}
+			var i uint64
+			if i, err = u.readUint(n); err == nil {
+				if op == opBinPut || op == opLongBinPut {
+					err = u.put(int(i))
+				} else {
+					err = u.get(int(i))
+				}
+			}
+		case opMemoize:
+			err = u.put(len(u.memo))
+
+		default:
+			return nil, fmt.Errorf("%w 0x%02x at offset %d", ErrUnsupportedOpcode, op, u.pos-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, u.fail("missing STOP opcode")
+}
+
+// pushInt pushes a decimal integer. integers that don't fit in an int64 are pushed as a float64.
+func (u *unpickler) pushInt(s string) error {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		f, _ := strconv.ParseFloat(s, 64)
+		u.push(f)
+		return nil
+	}
+	if err != nil {
+		return u.fail("invalid int %q", s)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) pushFloat(s string) error {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return u.fail("invalid float %q", s)
+	}
+	u.push(v)
+	return nil
+}
+
+// pushLong pushes a little endian two's complement integer of n bytes.
+// integers that don't fit in an int64 are pushed as a float64.
+func (u *unpickler) pushLong(n int) error {
+	b, err := u.read(uint64(n))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		u.push(int64(0))
+		return nil
+	}
+	if n <= 8 {
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		// sign extend
+		shift := uint(64 - 8*n)
+		u.push(int64(v<<shift) >> shift)
+		return nil
+	}
+	var f float64
+	for i := n - 1; i >= 0; i-- {
+		f = f*256 + float64(b[i])
+	}
+	if b[n-1]&0x80 != 0 {
+		f -= math.Pow(2, float64(8*n))
+	}
+	u.push(f)
+	return nil
+}
+
+// pushString pushes a string of which the length is a little endian unsigned integer of n bytes.
+// unless binary is set, it must be valid utf-8.
+func (u *unpickler) pushString(n int, binary bool) error {
+	s, err := u.readString(n)
+	if err != nil {
+		return err
+	}
+	if !binary && !utf8.ValidString(s) {
+		return u.fail("invalid utf-8 string")
+	}
+	u.push(s)
+	return nil
+}
+
+// unquotePython unquotes a python 2 string literal, as written by the STRING opcode
+func unquotePython(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", ErrInvalidPickle
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", ErrInvalidPickle
+		}
+		switch s[i] {
+		case '\\', '\'', '"':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", ErrInvalidPickle
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", ErrInvalidPickle
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			return "", ErrInvalidPickle
+		}
+	}
+	return b.String(), nil
+}
+
+// unescapeRawUnicode decodes a string in python's raw-unicode-escape encoding, as written by the UNICODE opcode:
+// latin-1, with \uXXXX and \UXXXXXXXX escapes
+func unescapeRawUnicode(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+			n := 4
+			if s[i+1] == 'U' {
+				n = 8
+			}
+			if i+2+n > len(s) {
+				return "", ErrInvalidPickle
+			}
+			v, err := strconv.ParseUint(s[i+2:i+2+n], 16, 32)
+			if err != nil || v > utf8.MaxRune {
+				return "", ErrInvalidPickle
+			}
+			b.WriteRune(rune(v))
+			i += 1 + n
+			continue
+		}
+		b.WriteRune(rune(s[i]))
+	}
+	return b.String(), nil
+}
+
+// ParsePickle converts the payload of a carbon pickle message, without the length, into MetricData.
+// Paths are handled like the paths of plaintext lines, and timestamps and values may be
+// numbers or numeric strings, as carbon converts them using float().
+// An error is returned if data is not a pickled list of datapoints, or uses opcodes outside of the carbon subset.
+// Otherwise, the metrics of all valid datapoints are returned, along with a *PickleError for the first invalid one, if any.
+func (p *Parser) ParsePickle(data []byte) ([]*schema.MetricData, error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := v.(*list)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a list of datapoints, got %s", ErrInvalidPickle, pythonType(v))
+	}
+	var out []*schema.MetricData
+	var first error
+	for i, dp := range *l {
+		md, err := p.pickledDatapoint(dp)
+		if err != nil {
+			if first == nil {
+				err.(*PickleError).Index = i
+				first = err
+			}
+			continue
+		}
+		out = append(out, md)
+	}
+	return out, first
+}
+
+func (p *Parser) pickledDatapoint(v interface{}) (*schema.MetricData, error) {
+	fail := func(path, field string, err error) error {
+		return &PickleError{
+			Path:  path,
+			Field: field,
+			Err:   err,
+		}
+	}
+	dp, ok := sequence(v)
+	if !ok || len(dp) != 2 {
+		return nil, fail("", "datapoint", fmt.Errorf("%w: expected (path, (timestamp, value)), got %s", ErrInvalidPickle, pythonType(v)))
+	}
+	path, ok := dp[0].(string)
+	if !ok {
+		return nil, fail("", "datapoint", fmt.Errorf("%w: expected a string path, got %s", ErrInvalidPickle, pythonType(dp[0])))
+	}
+	point, ok := sequence(dp[1])
+	if !ok || len(point) != 2 {
+		return nil, fail(path, "datapoint", fmt.Errorf("%w: expected (timestamp, value), got %s", ErrInvalidPickle, pythonType(dp[1])))
+	}
+
+	md := &schema.MetricData{
+		OrgId:    p.OrgId,
+		Interval: p.Interval,
+		Unit:     p.Unit,
+		Mtype:    p.Mtype,
+	}
+	if field, _, err := setPath(md, path); err != nil {
+		return nil, fail(path, field, err)
+	}
+
+	var err error
+	switch ts := point[0].(type) {
+	case int64:
+		md.Time = ts
+		if ts < 0 {
+			err = ErrInvalidTimestamp
+		}
+	case float64:
+		md.Time, err = floatTimestamp(ts)
+	case string:
+		md.Time, err = parseTimestamp(strings.TrimSpace(ts))
+	default:
+		err = fmt.Errorf("%w: expected a number, got %s", ErrInvalidTimestamp, pythonType(ts))
+	}
+	if err != nil {
+		return nil, fail(path, "timestamp", err)
+	}
+
+	switch value := point[1].(type) {
+	case int64:
+		md.Value = float64(value)
+	case float64:
+		md.Value = value
+	case string:
+		md.Value, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+	default:
+		err = fmt.Errorf("%w: expected a number, got %s", ErrInvalidValue, pythonType(value))
+	}
+	if err == nil && (math.IsNaN(md.Value) || math.IsInf(md.Value, 0)) {
+		err = ErrInvalidValue
+	}
+	if err != nil {
+		return nil, fail(path, "value", err)
+	}
+
+	md.SetId()
+	return md, nil
+}
+
+// sequence returns the items of a tuple or list
+func sequence(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case tuple:
+		return s, true
+	case *list:
+		return *s, true
+	}
+	return nil, false
+}
+
+func pythonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "str"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case tuple:
+		return "tuple"
+	case *list:
+		return "list"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// PickleReader reads MetricData from a stream of carbon pickle messages
+type PickleReader struct {
+	p   *Parser
+	r   io.Reader
+	buf []byte
+
+	// MaxSize is the maximum size of a message. Larger messages result in ErrPickleTooLarge.
+	MaxSize int
+}
+
+// NewPickleReader returns a PickleReader that parses the messages read from r using p,
+// with a MaxSize of DefaultMaxPickleSize
+func (p *Parser) NewPickleReader(r io.Reader) *PickleReader {
+	return &PickleReader{
+		p:       p,
+		r:       r,
+		MaxSize: DefaultMaxPickleSize,
+	}
+}
+
+// Read returns the metrics of the next message.
+// It returns io.EOF once r is exhausted, and io.ErrUnexpectedEOF if it ends within a message.
+// If only some datapoints of the message are invalid, it returns the metrics of the others along with a *PickleError,
+// after which Read can be called again. Any other error is fatal.
+func (r *PickleReader) Read() ([]*schema.MetricData, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(r.MaxSize) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPickleTooLarge, size)
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return r.p.ParsePickle(r.buf)
+}
@@ -0,0 +1,229 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+// pickleFixture is the content of the carbon_p*.pickle files in testdata, up to the invalid datapoint 6
+var pickleFixture = []*schema.MetricData{
+	{OrgId: 1, Name: "a.b.c", Interval: 10, Value: 1.5, Time: 1500000000, Mtype: "gauge"},
+	{OrgId: 1, Name: "d", Interval: 10, Value: 3, Time: 1500000010, Mtype: "gauge", Tags: []string{"a=b", "x=y"}},
+	{OrgId: 1, Name: "e.f", Interval: 10, Value: 4.25, Time: 1500000020, Mtype: "gauge"},
+	{OrgId: 1, Name: "uni.é", Interval: 10, Value: -2, Time: 1500000030, Mtype: "gauge"},
+	{OrgId: 1, Name: "a.b.c", Interval: 10, Value: 1 << 40, Time: 1500000050, Mtype: "gauge"},
+	{OrgId: 1, Name: "big", Interval: 10, Value: -(1 << 70), Time: 1 << 31, Mtype: "gauge"},
+}
+
+func init() {
+	for _, md := range pickleFixture {
+		md.SetId()
+	}
+}
+
+func TestParsePickle(t *testing.T) {
+	// generated using pickle.dumps in python 3, with protocols 0, 2 and 4
+	exp := pickleFixture
+	for _, file := range []string{"carbon_p0.pickle", "carbon_p2.pickle", "carbon_p4.pickle"} {
+		data, err := os.ReadFile("testdata/" + file)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		got, err := NewParser(1, 10).ParsePickle(data)
+		var perr *PickleError
+		if !errors.As(err, &perr) || perr.Index != 6 || perr.Path != "nan" || perr.Field != "value" || !errors.Is(err, ErrInvalidValue) {
+			t.Fatalf("%s: expected an invalid value for datapoint 6, got %v", file, err)
+		}
+		if !reflect.DeepEqual(exp, got) {
+			t.Fatalf("%s: expected %v, got %v", file, exp, got)
+		}
+	}
+}
+
+func TestParsePickleLegacy(t *testing.T) {
+	// opcodes used by python 2
+	cases := []string{
+		"(lp0\n(S'a.b'\np1\n(I10\nF2.5\ntp2\ntp3\na(S\"c'd\"\np4\n(L20L\nI01\ntp5\ntp6\na(S'e\\x41\\n'\n(I30\nS'1e2'\nttp7\na.",
+		"\x80\x02]q\x00(U\x03a.bq\x01K\x0aG@\x04\x00\x00\x00\x00\x00\x00\x86\x86T\x03\x00\x00\x00c'dM\x14\x00K\x01\x86\x86(U\x03eA\n(K\x1eU\x031e2tte.",
+	}
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "a.b", Interval: 10, Value: 2.5, Time: 10, Mtype: "gauge"},
+		{OrgId: 1, Name: "c'd", Interval: 10, Value: 1, Time: 20, Mtype: "gauge"},
+		{OrgId: 1, Name: "eA\n", Interval: 10, Value: 100, Time: 30, Mtype: "gauge"},
+	}
+	for _, md := range exp {
+		md.SetId()
+	}
+	for _, c := range cases {
+		got, err := NewParser(1, 10).ParsePickle([]byte(c))
+		if err != nil {
+			t.Fatalf("%q: %s", c, err.Error())
+		}
+		if !reflect.DeepEqual(exp, got) {
+			t.Fatalf("%q: expected %v, got %v", c, exp, got)
+		}
+	}
+}
+
+func TestParsePickleInvalid(t *testing.T) {
+	cases := []struct {
+		data string
+		err  error
+	}{
+		{"cos\nsystem\n(S'echo hi'\ntR.", ErrUnsupportedOpcode},
+		{"N.", ErrUnsupportedOpcode},
+		{"]K\x01K\x01R.", ErrUnsupportedOpcode},
+		{"\x80\x02]q\x00(X\x03\x00\x00\x00a.b", ErrInvalidPickle},
+		{"\x80\x02]q\x00(X\xff\xff\xff\xffa.b", ErrInvalidPickle},
+		{"]", ErrInvalidPickle},
+		{"", ErrInvalidPickle},
+		{"K\x01.", ErrInvalidPickle},
+		{"\x80\x06].", ErrInvalidPickle},
+		{"a.", ErrInvalidPickle},
+		{"K\x01K\x01a.", ErrInvalidPickle},
+		{"]h\x05.", ErrInvalidPickle},
+		{"]g5\n.", ErrInvalidPickle},
+		{"]p-1\n.", ErrInvalidPickle},
+		{"]e.", ErrInvalidPickle},
+		{"(.", ErrInvalidPickle},
+		{"]\x85.", ErrInvalidPickle},
+		{"](\x86.", ErrInvalidPickle},
+		{"X\x02\x00\x00\x00\xff\xfe.", ErrInvalidPickle},
+		{"(S'a\nl.", ErrInvalidPickle},
+		{"(S'a\\q'\nl.", ErrInvalidPickle},
+		{"(Ix\nl.", ErrInvalidPickle},
+		{"(F1.5.x\nl.", ErrInvalidPickle},
+		{"(V\\u12\nl.", ErrInvalidPickle},
+	}
+	for _, c := range cases {
+		got, err := NewParser(1, 10).ParsePickle([]byte(c.data))
+		if !errors.Is(err, c.err) || got != nil {
+			t.Fatalf("%q: expected %q, got %v and %v", c.data, c.err, got, err)
+		}
+		if _, ok := err.(*PickleError); ok {
+			t.Fatalf("%q: expected a structural error, got %v", c.data, err)
+		}
+	}
+}
+
+func TestParsePickleInvalidDatapoint(t *testing.T) {
+	valid := "X\x01\x00\x00\x00vK\x01K\x02\x86\x86"
+	exp := &schema.MetricData{OrgId: 1, Name: "v", Interval: 10, Value: 2, Time: 1, Mtype: "gauge"}
+	exp.SetId()
+	cases := []struct {
+		datapoint string
+		path      string
+		field     string
+		err       error
+	}{
+		{"K\x01", "", "datapoint", ErrInvalidPickle},
+		{"K\x01K\x01K\x01\x86\x86", "", "datapoint", ErrInvalidPickle},
+		{"X\x01\x00\x00\x00aK\x01\x86", "a", "datapoint", ErrInvalidPickle},
+		{"X\x01\x00\x00\x00aK\x01K\x01K\x01\x87\x86", "a", "datapoint", ErrInvalidPickle},
+		{"X\x01\x00\x00\x00.K\x01K\x01\x86\x86", ".", "name", ErrEmptyName},
+		{"X\x03\x00\x00\x00a;bK\x01K\x01\x86\x86", "a;b", "tags", ErrInvalidTag},
+		{"X\x01\x00\x00\x00aJ\xff\xff\xff\xffK\x01\x86\x86", "a", "timestamp", ErrInvalidTimestamp},
+		{"X\x01\x00\x00\x00aG\xbf\xf0\x00\x00\x00\x00\x00\x00K\x01\x86\x86", "a", "timestamp", ErrInvalidTimestamp},
+		{"X\x01\x00\x00\x00aX\x01\x00\x00\x00xK\x01\x86\x86", "a", "timestamp", strconv.ErrSyntax},
+		{"X\x01\x00\x00\x00a]K\x01\x86\x86", "a", "timestamp", ErrInvalidTimestamp},
+		{"X\x01\x00\x00\x00aK\x01X\x01\x00\x00\x00x\x86\x86", "a", "value", strconv.ErrSyntax},
+		{"X\x01\x00\x00\x00aK\x01)\x86\x86", "a", "value", ErrInvalidValue},
+		{"X\x01\x00\x00\x00aK\x01\x8a\xc8" + strings.Repeat("\x00", 199) + "\x7f\x86\x86", "a", "value", ErrInvalidValue},
+	}
+	for _, c := range cases {
+		data := "](" + valid + c.datapoint + valid + "e."
+		got, err := NewParser(1, 10).ParsePickle([]byte(data))
+		var perr *PickleError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected PickleError, got %v", c.datapoint, err)
+		}
+		if perr.Index != 1 || perr.Path != c.path || perr.Field != c.field || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s of datapoint 1 %q caused by %q, got %s of datapoint %d %q: %s", c.datapoint, c.field, c.path, c.err, perr.Field, perr.Index, perr.Path, err.Error())
+		}
+		if len(got) != 2 || !reflect.DeepEqual(exp, got[0]) || !reflect.DeepEqual(exp, got[1]) {
+			t.Fatalf("%q: expected the valid datapoints, got %v", c.datapoint, got)
+		}
+	}
+}
+
+func TestPickleReader(t *testing.T) {
+	// frame prefixes a payload with its length
+	frame := func(payload []byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+	}
+	fixture, err := os.ReadFile("testdata/carbon_p2.pickle")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var buf bytes.Buffer
+	buf.Write(frame(fixture))
+	buf.Write(frame([]byte("].")))
+	buf.Write(frame([]byte("\x80\x02](X\x01\x00\x00\x00vK\x01K\x02\x86\x86e.")))
+
+	r := NewParser(1, 10).NewPickleReader(&buf)
+	// only some datapoints are invalid, reading can continue
+	got, err := r.Read()
+	var perr *PickleError
+	if !errors.As(err, &perr) || perr.Index != 6 || !reflect.DeepEqual(pickleFixture, got) {
+		t.Fatalf("expected the fixture and a PickleError for datapoint 6, got %v and %v", got, err)
+	}
+	if got, err = r.Read(); err != nil || len(got) != 0 {
+		t.Fatalf("expected an empty message, got %v and %v", got, err)
+	}
+	exp := &schema.MetricData{OrgId: 1, Name: "v", Interval: 10, Value: 2, Time: 1, Mtype: "gauge"}
+	exp.SetId()
+	if got, err = r.Read(); err != nil || len(got) != 1 || !reflect.DeepEqual(exp, got[0]) {
+		t.Fatalf("expected %+v, got %v and %v", *exp, got, err)
+	}
+	if _, err = r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	r = NewParser(1, 10).NewPickleReader(bytes.NewReader([]byte("\x00\x00\x01\x00]")))
+	r.MaxSize = 255
+	if _, err = r.Read(); !errors.Is(err, ErrPickleTooLarge) {
+		t.Fatalf("expected ErrPickleTooLarge, got %v", err)
+	}
+	r.MaxSize = 256
+	if _, err = r.Read(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// FuzzParsePickle checks that ParsePickle rejects arbitrary input without panicking,
+// and that whatever it accepts results in valid metrics.
+func FuzzParsePickle(f *testing.F) {
+	for _, file := range []string{"carbon_p0.pickle", "carbon_p2.pickle", "carbon_p4.pickle"} {
+		data, err := os.ReadFile("testdata/" + file)
+		if err != nil {
+			f.Fatalf("%s", err.Error())
+		}
+		f.Add(data)
+	}
+	p := NewParser(1, 10)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := p.ParsePickle(data)
+		if err != nil {
+			if _, ok := err.(*PickleError); !ok && !errors.Is(err, ErrInvalidPickle) && !errors.Is(err, ErrUnsupportedOpcode) {
+				t.Fatalf("unexpected error %T: %s", err, err.Error())
+			}
+		}
+		for _, md := range metrics {
+			if err := md.Validate(); err != nil {
+				t.Fatalf("invalid metric %+v: %s", *md, err.Error())
+			}
+			if md.Time < 0 {
+				t.Fatalf("invalid time %d", md.Time)
+			}
+		}
+	})
+}
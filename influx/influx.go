@@ -0,0 +1,493 @@
+// Package influx converts between schema.MetricData and the InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field2=value2...] [timestamp]
+//
+// every numeric field of a line becomes a MetricData, named after the measurement and the field,
+// and tagged with the tags of the line.
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/internal/lines"
+)
+
+var (
+	ErrMissingMeasurement = errors.New("measurement is empty")
+	ErrMissingFields      = errors.New("no fields")
+	ErrInvalidTag         = errors.New("invalid tag")
+	ErrInvalidField       = errors.New("invalid field")
+	ErrInvalidValue       = errors.New("invalid value")
+	ErrInvalidTimestamp   = errors.New("invalid timestamp")
+	ErrInvalidPrecision   = errors.New("invalid precision")
+)
+
+// ParseError points out the part of a line of line protocol that is malformed
+type ParseError struct {
+	Line   int    // the line number, starting at 1, or 0 if not known
+	Input  string // the line being parsed
+	Field  string // the part of the line that is invalid: "measurement", "tags", "fields" or "timestamp"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: one of the errors above, or an error of strconv
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("influx: cannot parse %s of line %d %q at offset %d: %s", e.Field, e.Line, e.Input, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("influx: cannot parse %s of %q at offset %d: %s", e.Field, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParsePrecision returns the precision for the given name, as used by the precision parameter of the
+// InfluxDB write API: "ns" (or ""), "u" or "us", "ms", "s", "m" and "h"
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "ns", "n":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("%w %q", ErrInvalidPrecision, s)
+}
+
+// JoinName returns the name of the metric for the given field of the given measurement: "measurement.field"
+func JoinName(measurement, field string) string {
+	return measurement + "." + field
+}
+
+// SplitName is the inverse of JoinName: it splits name at its last dot, not counting a trailing one.
+// a name without dots is considered to be a measurement with a single field "value".
+func SplitName(name string) (measurement, field string) {
+	i := -1
+	if len(name) > 1 {
+		i = strings.LastIndexByte(name[:len(name)-1], '.')
+	}
+	if i < 0 {
+		return name, "value"
+	}
+	return name[:i], name[i+1:]
+}
+
+// SanitizeTagKey replaces all characters of key that are not allowed by schema.ValidateTagKey by underscores.
+//
+// Deprecated: use schema.SanitizeTagKey, which this calls.
+func SanitizeTagKey(key string) string {
+	return schema.SanitizeTagKey(key)
+}
+
+// SanitizeTagValue makes value acceptable to schema.ValidateTagValue:
+// leading tildes are removed, and semicolons replaced by underscores.
+//
+// Deprecated: use schema.SanitizeTagValue, which this calls.
+func SanitizeTagValue(value string) string {
+	return schema.SanitizeTagValue(value)
+}
+
+// Parser turns lines of line protocol into MetricData.
+// Line protocol has no metadata: OrgId, Interval, Mtype and Unit are set on every metric as is.
+type Parser struct {
+	OrgId    int
+	Interval int
+	Mtype    string
+	Unit     string
+
+	// Precision is the unit of the timestamps, time.Nanosecond if 0
+	Precision time.Duration
+	// JoinName returns the metric name for a field of a measurement. JoinName (the function) is used if nil.
+	JoinName func(measurement, field string) string
+	// Now returns the time for lines without timestamp. time.Now is used if nil.
+	Now func() time.Time
+}
+
+// NewParser returns a Parser for metrics of the given org and interval, of mtype gauge,
+// with timestamps in nanoseconds
+func NewParser(orgId, interval int) *Parser {
+	return &Parser{
+		OrgId:    orgId,
+		Interval: interval,
+		Mtype:    "gauge",
+	}
+}
+
+// ParseLine parses a single line, with or without the trailing newline, and returns a MetricData
+// with its Id set for every numeric or boolean field. Booleans are mapped to 1 and 0.
+// String fields can't be represented and are skipped.
+// Tag keys and values are sanitized using schema.SanitizeTagKey and schema.SanitizeTagValue,
+// and a "name" tag key is renamed using schema.SanitizeNameTagKey. After that, each key may only occur once.
+// Timestamps must be at least a second after the epoch. Empty lines and comments result in no metrics.
+func (p *Parser) ParseLine(line []byte) ([]*schema.MetricData, error) {
+	s := strings.TrimRight(string(line), "\r\n")
+	l := lexer{s: s}
+	l.skipSpace()
+	if l.done() || l.peek() == '#' {
+		return nil, nil
+	}
+
+	measurementOffset := l.pos
+	measurement := l.token(", ")
+	if measurement == "" {
+		return nil, l.fail("measurement", measurementOffset, ErrMissingMeasurement)
+	}
+
+	var tags []string
+	for !l.done() && l.peek() == ',' {
+		l.pos++
+		offset := l.pos
+		key := l.token(",= ")
+		if l.done() || l.peek() != '=' {
+			return nil, l.fail("tags", offset, fmt.Errorf("%w: missing '='", ErrInvalidTag))
+		}
+		l.pos++
+		value := l.token(",= ")
+		key, value = schema.SanitizeNameTagKey(schema.SanitizeTagKey(key)), schema.SanitizeTagValue(value)
+		if !schema.ValidateTagKey(key) || !schema.ValidateTagValue(value) {
+			return nil, l.fail("tags", offset, fmt.Errorf("%w %q", ErrInvalidTag, s[offset:l.pos]))
+		}
+		for _, t := range tags {
+			if strings.HasPrefix(t, key+"=") {
+				return nil, l.fail("tags", offset, fmt.Errorf("%w %q: duplicate key", ErrInvalidTag, s[offset:l.pos]))
+			}
+		}
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+
+	type field struct {
+		key   string
+		value float64
+	}
+	var fields []field
+	if l.skipSpace() == 0 || l.done() {
+		return nil, l.fail("fields", l.pos, ErrMissingFields)
+	}
+	for {
+		offset := l.pos
+		key := l.token(",= ")
+		if key == "" || l.done() || l.peek() != '=' {
+			return nil, l.fail("fields", offset, fmt.Errorf("%w %q", ErrInvalidField, s[offset:l.pos]))
+		}
+		l.pos++
+		if !l.done() && l.peek() == '"' {
+			if !l.skipString() {
+				return nil, l.fail("fields", offset, fmt.Errorf("%w: unterminated string", ErrInvalidField))
+			}
+		} else {
+			valueOffset := l.pos
+			value, err := parseValue(l.token(", "))
+			if err != nil {
+				return nil, l.fail("fields", valueOffset, err)
+			}
+			fields = append(fields, field{key, value})
+		}
+		if l.done() || l.peek() != ',' {
+			break
+		}
+		l.pos++
+	}
+
+	var ts int64
+	if l.skipSpace() > 0 && !l.done() {
+		offset := l.pos
+		var err error
+		ts, err = p.parseTimestamp(l.token(" "))
+		if err != nil {
+			return nil, l.fail("timestamp", offset, err)
+		}
+		l.skipSpace()
+	} else if p.Now != nil {
+		ts = p.Now().Unix()
+	} else {
+		ts = time.Now().Unix()
+	}
+	if !l.done() {
+		return nil, l.fail("timestamp", l.pos, fmt.Errorf("%w: trailing data", ErrInvalidTimestamp))
+	}
+
+	joinName := p.JoinName
+	if joinName == nil {
+		joinName = JoinName
+	}
+	out := make([]*schema.MetricData, len(fields))
+	block := make([]schema.MetricData, len(fields))
+	for i, f := range fields {
+		md := &block[i]
+		md.OrgId = p.OrgId
+		md.Name = joinName(measurement, f.key)
+		md.Interval = p.Interval
+		md.Value = f.value
+		md.Unit = p.Unit
+		md.Time = ts
+		md.Mtype = p.Mtype
+		if len(tags) > 0 {
+			md.Tags = append([]string(nil), tags...)
+		}
+		md.SetId()
+		out[i] = md
+	}
+	return out, nil
+}
+
+// parseTimestamp converts a timestamp in p.Precision to unix seconds, rounding down.
+// like graphite and opentsdb, it only accepts timestamps of at least a second after the epoch.
+func (p *Parser) parseTimestamp(s string) (int64, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	precision := p.Precision
+	if precision <= 0 {
+		precision = time.Nanosecond
+	}
+	if precision >= time.Second {
+		mult := int64(precision / time.Second)
+		if ts > math.MaxInt64/mult {
+			return 0, ErrInvalidTimestamp
+		}
+		ts *= mult
+	} else {
+		div := int64(time.Second / precision)
+		ts = time.Unix(ts/div, ts%div*int64(precision)).Unix()
+	}
+	if ts <= 0 {
+		return 0, fmt.Errorf("%w %q", ErrInvalidTimestamp, s)
+	}
+	return ts, nil
+}
+
+// parseValue parses a field value that is not a string
+func parseValue(s string) (float64, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	case "":
+		return 0, ErrInvalidValue
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, ErrInvalidValue
+	}
+	return v, nil
+}
+
+// lexer tokenizes a line
+type lexer struct {
+	s   string
+	pos int
+}
+
+func (l *lexer) fail(field string, offset int, err error) error {
+	return &ParseError{
+		Input:  l.s,
+		Field:  field,
+		Offset: offset,
+		Err:    err,
+	}
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.s)
+}
+
+func (l *lexer) peek() byte {
+	return l.s[l.pos]
+}
+
+// skipSpace skips spaces and returns how many it skipped.
+// tabs are not separators, but part of whatever token they occur in.
+func (l *lexer) skipSpace() int {
+	start := l.pos
+	for !l.done() && l.peek() == ' ' {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+// token reads up to the first unescaped character of stop, or the end of the line, and returns it unescaped.
+// a backslash escapes any of the characters of stop or another backslash, and is taken literally before any other character.
+func (l *lexer) token(stop string) string {
+	start := l.pos
+	escaped := false
+	for !l.done() {
+		c := l.peek()
+		if c == '\\' && l.pos+1 < len(l.s) && isEscapable(l.s[l.pos+1], stop) {
+			escaped = true
+			l.pos += 2
+			continue
+		}
+		if strings.IndexByte(stop, c) >= 0 {
+			break
+		}
+		l.pos++
+	}
+	tok := l.s[start:l.pos]
+	if !escaped {
+		return tok
+	}
+	var b strings.Builder
+	for i := 0; i < len(tok); i++ {
+		if tok[i] == '\\' && i+1 < len(tok) && isEscapable(tok[i+1], stop) {
+			i++
+		}
+		b.WriteByte(tok[i])
+	}
+	return b.String()
+}
+
+func isEscapable(c byte, special string) bool {
+	return c == '\\' || strings.IndexByte(special, c) >= 0
+}
+
+// skipString skips a double quoted string, and returns whether it was terminated
+func (l *lexer) skipString() bool {
+	for l.pos++; !l.done(); l.pos++ {
+		switch l.peek() {
+		case '\\':
+			l.pos++
+		case '"':
+			l.pos++
+			return true
+		}
+	}
+	return false
+}
+
+// Reader reads MetricData from lines of line protocol
+type Reader struct {
+	p *Parser
+	s *lines.Scanner
+}
+
+// NewReader returns a Reader that parses the lines read from r using p
+func (p *Parser) NewReader(r io.Reader) *Reader {
+	return &Reader{
+		p: p,
+		s: lines.NewScanner(r),
+	}
+}
+
+// Read returns the metrics of the next line that has any, so comments and lines with only string fields are skipped.
+// It can be called again after a *ParseError, and returns io.EOF at the end of r.
+func (r *Reader) Read() ([]*schema.MetricData, error) {
+	for {
+		line, num, err := r.s.Next()
+		if err != nil {
+			return nil, err
+		}
+		metrics, err := r.p.ParseLine(line)
+		if err != nil {
+			err.(*ParseError).Line = num
+			return nil, err
+		}
+		if len(metrics) > 0 {
+			return metrics, nil
+		}
+	}
+}
+
+// Encoder turns MetricData into lines of line protocol, one line per metric.
+type Encoder struct {
+	// Precision is the unit of the timestamps, time.Nanosecond if 0
+	Precision time.Duration
+	// SplitName returns the measurement and field for a metric name. SplitName (the function) is used if nil.
+	SplitName func(name string) (measurement, field string)
+}
+
+// AppendLine appends the line for m, including the trailing newline, to b.
+// Tags are written in sorted order, except for any "name" tag, which is left out.
+// m is not modified.
+func (e *Encoder) AppendLine(b []byte, m *schema.MetricData) []byte {
+	splitName := e.SplitName
+	if splitName == nil {
+		splitName = SplitName
+	}
+	measurement, field := splitName(m.Name)
+	b = appendEscaped(b, measurement, ", ")
+
+	tags := m.Tags
+	if !sort.StringsAreSorted(tags) {
+		tags = append([]string(nil), tags...)
+		sort.Strings(tags)
+	}
+	for _, t := range tags {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 || t[:i] == "name" {
+			continue
+		}
+		b = append(b, ',')
+		b = appendEscaped(b, t[:i], ",= ")
+		b = append(b, '=')
+		b = appendEscaped(b, t[i+1:], ",= ")
+	}
+
+	b = append(b, ' ')
+	b = appendEscaped(b, field, ",= ")
+	b = append(b, '=')
+	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+
+	b = append(b, ' ')
+	precision := e.Precision
+	if precision <= 0 {
+		precision = time.Nanosecond
+	}
+	if precision >= time.Second {
+		b = strconv.AppendInt(b, m.Time/int64(precision/time.Second), 10)
+	} else {
+		b = strconv.AppendInt(b, m.Time*int64(time.Second/precision), 10)
+	}
+	return append(b, '\n')
+}
+
+// Encode writes a line for every metric to w
+func (e *Encoder) Encode(w io.Writer, metrics []*schema.MetricData) error {
+	var b []byte
+	for _, m := range metrics {
+		b = e.AppendLine(b, m)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// appendEscaped appends s to b, escaping backslashes and all characters of special with a backslash
+func appendEscaped(b []byte, s string, special string) []byte {
+	for i := 0; i < len(s); i++ {
+		if isEscapable(s[i], special) {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
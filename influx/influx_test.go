@@ -0,0 +1,354 @@
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+func TestParseLine(t *testing.T) {
+	p := NewParser(1, 10)
+	p.Now = func() time.Time { return time.Unix(1600000000, 0) }
+	cases := []struct {
+		line string
+		exp  []*schema.MetricData
+	}{
+		{
+			"cpu,host=a,dc=us usage_idle=98.5,usage_user=1i 1500000000000000000\n",
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "cpu.usage_idle", Interval: 10, Value: 98.5, Time: 1500000000, Mtype: "gauge", Tags: []string{"dc=us", "host=a"}},
+				{OrgId: 1, Name: "cpu.usage_user", Interval: 10, Value: 1, Time: 1500000000, Mtype: "gauge", Tags: []string{"dc=us", "host=a"}},
+			},
+		},
+		{
+			`disk\ io\,x,path=/var\ log,we\=ird=a\,b used=12u,ok=true,msg="hello, \"world\"",full=F`,
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "disk io,x.used", Interval: 10, Value: 12, Time: 1600000000, Mtype: "gauge", Tags: []string{"path=/var log", "we_ird=a,b"}},
+				{OrgId: 1, Name: "disk io,x.ok", Interval: 10, Value: 1, Time: 1600000000, Mtype: "gauge", Tags: []string{"path=/var log", "we_ird=a,b"}},
+				{OrgId: 1, Name: "disk io,x.full", Interval: 10, Value: 0, Time: 1600000000, Mtype: "gauge", Tags: []string{"path=/var log", "we_ird=a,b"}},
+			},
+		},
+		{
+			"mem,x=~~y;z free=-1e3 1500000000500000000",
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "mem.free", Interval: 10, Value: -1000, Time: 1500000000, Mtype: "gauge", Tags: []string{"x=y_z"}},
+			},
+		},
+		{
+			`c\d,a=b\c f\ g=1 1000000000`,
+			[]*schema.MetricData{
+				{OrgId: 1, Name: `c\d.f g`, Interval: 10, Value: 1, Time: 1, Mtype: "gauge", Tags: []string{`a=b\c`}},
+			},
+		},
+		{
+			`c\\\ d,a=b\\ f\\=1 1000000000`,
+			[]*schema.MetricData{
+				{OrgId: 1, Name: `c\ d.f\`, Interval: 10, Value: 1, Time: 1, Mtype: "gauge", Tags: []string{`a=b\`}},
+			},
+		},
+		{
+			// the name tag is reserved for the name, so a "name" tag key is renamed
+			"docker_container_cpu,name=c1,host=a usage=1 1000000000",
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "docker_container_cpu.usage", Interval: 10, Value: 1, Time: 1, Mtype: "gauge", Tags: []string{"exported_name=c1", "host=a"}},
+			},
+		},
+		{"", nil},
+		{"  \r\n", nil},
+		{"# a comment", nil},
+		{`strings only="foo"`, []*schema.MetricData{}},
+	}
+	for i, c := range cases {
+		for _, md := range c.exp {
+			md.SetId()
+		}
+		got, err := p.ParseLine([]byte(c.line))
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+		if !reflect.DeepEqual(c.exp, got) {
+			t.Fatalf("case %d: expected %v, got %v", i, c.exp, got)
+		}
+	}
+}
+
+func TestParseLineNameTag(t *testing.T) {
+	p := NewParser(1, 10)
+	var ids []schema.MKey
+	for _, line := range []string{"docker_container_cpu,name=c1 usage=1 1000000000", "docker_container_cpu,name=c2 usage=1 1000000000"} {
+		metrics, err := p.ParseLine([]byte(line))
+		if err != nil {
+			t.Fatalf("%q: %s", line, err.Error())
+		}
+		// MetricDefinition leaves out name tags, so this is where they would collide
+		ids = append(ids, schema.MetricDefinitionFromMetricData(metrics[0]).Id)
+		var e Encoder
+		again, err := p.ParseLine(e.AppendLine(nil, metrics[0]))
+		if err != nil || !reflect.DeepEqual(metrics, again) {
+			t.Fatalf("%q: expected %+v after round trip, got %v and %v", line, *metrics[0], again, err)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("expected series that only differ in their name tag to have different ids, got %s for both", ids[0])
+	}
+}
+
+func TestParseLineOptions(t *testing.T) {
+	p := &Parser{
+		OrgId:     3,
+		Interval:  60,
+		Mtype:     "rate",
+		Unit:      "B/s",
+		Precision: time.Second,
+		JoinName: func(measurement, field string) string {
+			return measurement + "_" + field
+		},
+	}
+	got, err := p.ParseLine([]byte("net bytes_in=12 1500000000"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(got))
+	}
+	md := got[0]
+	if md.OrgId != 3 || md.Interval != 60 || md.Mtype != "rate" || md.Unit != "B/s" || md.Name != "net_bytes_in" || md.Time != 1500000000 {
+		t.Fatalf("expected parser options to be applied, got %+v", *md)
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":   time.Nanosecond,
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"us": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	}
+	for s, exp := range cases {
+		got, err := ParsePrecision(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err.Error())
+		}
+		if got != exp {
+			t.Fatalf("%q: expected %s, got %s", s, exp, got)
+		}
+		p := NewParser(1, 10)
+		p.Precision = got
+		metrics, err := p.ParseLine([]byte("m f=1 " + strconv.FormatInt(int64(100000*time.Hour/got), 10)))
+		if err != nil {
+			t.Fatalf("%q: %s", s, err.Error())
+		}
+		if metrics[0].Time != 100000*3600 {
+			t.Fatalf("%q: expected time %d, got %d", s, 100000*3600, metrics[0].Time)
+		}
+	}
+	if _, err := ParsePrecision("d"); !errors.Is(err, ErrInvalidPrecision) {
+		t.Fatalf("expected ErrInvalidPrecision, got %v", err)
+	}
+}
+
+func TestParseLineInvalid(t *testing.T) {
+	p := NewParser(1, 10)
+	cases := []struct {
+		line   string
+		field  string
+		offset int
+		err    error
+	}{
+		{",a=b f=1", "measurement", 0, ErrMissingMeasurement},
+		{"m", "fields", 1, ErrMissingFields},
+		{"m,a=b", "fields", 5, ErrMissingFields},
+		{"m,a f=1", "tags", 2, ErrInvalidTag},
+		{"m,a= f=1", "tags", 2, ErrInvalidTag},
+		{"m,=b f=1", "tags", 2, ErrInvalidTag},
+		{"m,a=~ f=1", "tags", 2, ErrInvalidTag},
+		{"a,host=x,host=y v=1", "tags", 9, ErrInvalidTag},
+		{"a,name=x,exported_name=y v=1", "tags", 9, ErrInvalidTag},
+		{"m f", "fields", 2, ErrInvalidField},
+		{"m =1", "fields", 2, ErrInvalidField},
+		{`m f="a`, "fields", 2, ErrInvalidField},
+		{"m f=", "fields", 4, ErrInvalidValue},
+		{"m f=x", "fields", 4, strconv.ErrSyntax},
+		{"m f=1.5i", "fields", 4, strconv.ErrSyntax},
+		{"m f=-1u", "fields", 4, strconv.ErrSyntax},
+		{"m f=NaN", "fields", 4, ErrInvalidValue},
+		{"m f=1,", "fields", 6, ErrInvalidField},
+		{"m f=1 x", "timestamp", 6, strconv.ErrSyntax},
+		{"m f=1 1000000000 2", "timestamp", 17, ErrInvalidTimestamp},
+		{"m f=1 0", "timestamp", 6, ErrInvalidTimestamp},
+		{"m f=1 -1500000000000000000", "timestamp", 6, ErrInvalidTimestamp},
+		{"m f=1 999999999", "timestamp", 6, ErrInvalidTimestamp},
+		{`m f="a"x`, "timestamp", 7, ErrInvalidTimestamp},
+	}
+	for _, c := range cases {
+		_, err := p.ParseLine([]byte(c.line))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected ParseError, got %v", c.line, err)
+		}
+		if perr.Field != c.field || perr.Offset != c.offset || perr.Input != c.line || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at offset %d caused by %q, got %s at offset %d: %s", c.line, c.field, c.offset, c.err, perr.Field, perr.Offset, err.Error())
+		}
+	}
+
+	p.Precision = time.Hour
+	if _, err := p.ParseLine([]byte("m f=1 9223372036854775807")); !errors.Is(err, ErrInvalidTimestamp) {
+		t.Fatalf("expected ErrInvalidTimestamp for overflowing timestamp, got %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	input := "cpu a=1,b=2 10000000000\n\n# comment\nbogus\nmem c=3 20000000000"
+	r := NewParser(1, 10).NewReader(strings.NewReader(input))
+	var names []string
+	var lines []int
+	for {
+		metrics, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if perr, ok := err.(*ParseError); ok {
+			lines = append(lines, perr.Line)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		for _, md := range metrics {
+			names = append(names, md.Name)
+		}
+	}
+	if !reflect.DeepEqual([]string{"cpu.a", "cpu.b", "mem.c"}, names) {
+		t.Fatalf("expected metrics cpu.a, cpu.b and mem.c, got %v", names)
+	}
+	if !reflect.DeepEqual([]int{4}, lines) {
+		t.Fatalf("expected a parse error for line 4, got errors for lines %v", lines)
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	cases := []struct {
+		name, measurement, field string
+	}{
+		{"cpu.idle", "cpu", "idle"},
+		{"a.b.cpu.idle", "a.b.cpu", "idle"},
+		{"cpu", "cpu", "value"},
+		{"cpu.idle.", "cpu", "idle."},
+		{".", ".", "value"},
+	}
+	for _, c := range cases {
+		measurement, field := SplitName(c.name)
+		if measurement != c.measurement || field != c.field {
+			t.Fatalf("%q: expected %q and %q, got %q and %q", c.name, c.measurement, c.field, measurement, field)
+		}
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	md := &schema.MetricData{
+		OrgId:    1,
+		Name:     "disk io,x.us ed",
+		Interval: 10,
+		Value:    0.5,
+		Time:     1500000000,
+		Mtype:    "gauge",
+		Tags:     []string{"we=ird=a,b", "name=ignored", "path=/var log"},
+	}
+	var e Encoder
+	out := string(e.AppendLine([]byte("x\n"), md))
+	if out != `x`+"\n"+`disk\ io\,x,path=/var\ log,we=ird\=a\,b us\ ed=0.5 1500000000000000000`+"\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if md.Tags[0] != "we=ird=a,b" {
+		t.Fatalf("expected the tags to not be modified, got %v", md.Tags)
+	}
+	e.Precision = time.Minute
+	out = string(e.AppendLine(nil, &schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 120, Mtype: "gauge"}))
+	if out != "a value=1 2\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestEncodeRead(t *testing.T) {
+	var metrics []*schema.MetricData
+	for i := 0; i < 10; i++ {
+		var tags []string
+		if i%2 == 0 {
+			tags = []string{"foo=bar baz", "i=" + strconv.Itoa(i)}
+		}
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     "some.id.of.a.metric" + strconv.Itoa(i),
+			Interval: 10,
+			Value:    float64(i) / 3,
+			Time:     int64(1500000000 + i*10),
+			Mtype:    "gauge",
+			Tags:     tags,
+		}
+		md.SetId()
+		metrics = append(metrics, md)
+	}
+	var buf bytes.Buffer
+	e := Encoder{Precision: time.Millisecond}
+	if err := e.Encode(&buf, metrics); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	p := NewParser(1, 10)
+	p.Precision = time.Millisecond
+	r := p.NewReader(&buf)
+	for i := range metrics {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !reflect.DeepEqual(metrics[i:i+1], got) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *metrics[i], got)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// FuzzParseLine checks that ParseLine rejects arbitrary input without panicking,
+// and that whatever it accepts survives a round trip.
+func FuzzParseLine(f *testing.F) {
+	f.Add([]byte("cpu,host=a,dc=us usage_idle=98.5,usage_user=1i 1500000000"))
+	f.Add([]byte(`disk\ io\,x,path=/var\ log,we\=ird=a\,b used=12u,ok=true,msg="hello, \"world\"",full=F`))
+	p := NewParser(1, 10)
+	p.Precision = time.Second
+	p.Now = func() time.Time { return time.Unix(1600000000, 0) }
+	e := Encoder{Precision: time.Second}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := p.ParseLine(data)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("expected a *ParseError, got %T: %s", err, err.Error())
+			}
+			return
+		}
+		for _, md := range metrics {
+			if md.Time <= 0 {
+				t.Fatalf("invalid time %d", md.Time)
+			}
+			again, err := p.ParseLine(e.AppendLine(nil, md))
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+			if len(again) != 1 || !reflect.DeepEqual(md, again[0]) {
+				t.Fatalf("expected %+v after round trip, got %v", *md, again)
+			}
+		}
+	})
+}
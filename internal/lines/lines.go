@@ -0,0 +1,36 @@
+// Package lines reads the lines of the line based protocols, keeping track of line numbers.
+package lines
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Scanner returns the lines of a reader that have anything but whitespace on them
+type Scanner struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		s: bufio.NewScanner(r),
+	}
+}
+
+// Next returns the next non-empty line, without the trailing newline, and its number, starting at 1.
+// The line is only valid until the next call. Once r is exhausted, it returns the error of reading it, or io.EOF.
+func (s *Scanner) Next() ([]byte, int, error) {
+	for s.s.Scan() {
+		s.line++
+		line := s.s.Bytes()
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line, s.line, nil
+		}
+	}
+	if err := s.s.Err(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, io.EOF
+}
@@ -0,0 +1,30 @@
+package lines
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	s := NewScanner(strings.NewReader("a\n\n \t\r\nb c\r\n\nd"))
+	for _, exp := range []struct {
+		line string
+		num  int
+	}{
+		{"a", 1},
+		{"b c", 4},
+		{"d", 6},
+	} {
+		line, num, err := s.Next()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if string(line) != exp.line || num != exp.num {
+			t.Fatalf("expected %q on line %d, got %q on line %d", exp.line, exp.num, line, num)
+		}
+	}
+	if _, _, err := s.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
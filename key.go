@@ -15,6 +15,20 @@ import (
 var ErrStringTooShort = errors.New("string too short")
 var ErrInvalidFormat = errors.New("invalid format")
 
+// parseDecimal parses a canonical decimal representation of a uint32: digits only, without leading zeroes
+func parseDecimal(s string) (uint32, error) {
+	if len(s) > 1 && s[0] == '0' {
+		return 0, ErrInvalidFormat
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, ErrInvalidFormat
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint32(v), err
+}
+
 // Key identifies a metric
 type Key [16]byte
 
@@ -25,30 +39,34 @@ type MKey struct {
 }
 
 // KeyFromString parses a string id to an MKey
-// string id must be of form orgid.<hexadecimal 128bit hash>
+// string id must be of form orgid.<hexadecimal 128bit hash>, with orgid in decimal without leading zeroes.
+// Errors are a *ParseError, so compare them with ErrStringTooShort etc. using errors.Is, not ==.
 func MKeyFromString(s string) (MKey, error) {
 	l := len(s)
 
 	// shortest an orgid can be is single digit
 	if l < 34 {
-		return MKey{}, ErrStringTooShort
+		return MKey{}, &ParseError{Input: s, Field: "key", Err: ErrStringTooShort}
 	}
 
 	hashStr := s[l-32:]
 	orgStr := s[0 : l-33]
+	if s[l-33] != '.' {
+		return MKey{}, &ParseError{Input: s, Field: "key", Offset: l - 33, Err: ErrInvalidFormat}
+	}
 
 	hash, err := hex.DecodeString(hashStr)
 	if err != nil {
-		return MKey{}, err
+		return MKey{}, &ParseError{Input: s, Field: "key", Offset: l - 32, Err: err}
 	}
 
-	org, err := strconv.ParseUint(orgStr, 10, 32)
+	org, err := parseDecimal(orgStr)
 	if err != nil {
-		return MKey{}, err
+		return MKey{}, &ParseError{Input: s, Field: "org", Err: err}
 	}
 
 	k := MKey{
-		Org: uint32(org),
+		Org: org,
 	}
 
 	copy(k.Key[:], hash)
@@ -81,6 +99,8 @@ func GetAMKey(m MKey, method Method, span uint32) AMKey {
 	}
 }
 
+// AMKeyFromString parses a string id of an MKey, optionally followed by "_" and an archive (see ArchiveFromString).
+// Errors are a *ParseError, so compare them with ErrInvalidFormat etc. using errors.Is, not ==.
 func AMKeyFromString(s string) (AMKey, error) {
 	underscores := strings.Count(s, "_")
 	amk := AMKey{}
@@ -96,8 +116,8 @@ func AMKeyFromString(s string) (AMKey, error) {
 			return amk, err
 		}
 		amk.Archive, err = ArchiveFromString(s[pos+1:])
-		return amk, err
+		return amk, within(err, s, pos+1)
 
 	}
-	return amk, ErrInvalidFormat
+	return amk, &ParseError{Input: s, Field: "archive", Err: ErrInvalidFormat}
 }
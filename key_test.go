@@ -69,3 +69,41 @@ func TestAMKeyConversionBothWays(t *testing.T) {
 		}
 	}
 }
+
+func FuzzMKeyFromString(f *testing.F) {
+	f.Add("1.00112233445566778899aabbccddeeff")
+	f.Add("4294967295.00112233445566778899aabbccddeeff")
+	f.Add("01.00112233445566778899aabbccddeeff")
+	f.Fuzz(func(t *testing.T, s string) {
+		mk, err := MKeyFromString(s)
+		if err != nil {
+			return
+		}
+		again, err := MKeyFromString(mk.String())
+		if err != nil {
+			t.Fatalf("failed to parse %q, the string of %q: %s", mk.String(), s, err.Error())
+		}
+		if again != mk {
+			t.Fatalf("%q parsed to %v, but its string %q parsed to %v", s, mk, mk.String(), again)
+		}
+	})
+}
+
+func FuzzAMKeyFromString(f *testing.F) {
+	f.Add("0.00112233445566778899aabbccddeeff")
+	f.Add("0.00112233445566778899aabbccddeeff_min_600")
+	f.Add("0.0112233445566778899aab_bccd_deeff")
+	f.Fuzz(func(t *testing.T, s string) {
+		amk, err := AMKeyFromString(s)
+		if err != nil {
+			return
+		}
+		again, err := AMKeyFromString(amk.String())
+		if err != nil {
+			t.Fatalf("failed to parse %q, the string of %q: %s", amk.String(), s, err.Error())
+		}
+		if again != amk {
+			t.Fatalf("%q parsed to %v, but its string %q parsed to %v", s, amk, amk.String(), again)
+		}
+	})
+}
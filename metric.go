@@ -1,12 +1,11 @@
 package schema
 
 import (
-	"bytes"
 	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
-	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 )
@@ -16,6 +15,7 @@ var ErrInvalidOrgIdzero = errors.New("org-id cannot be 0")
 var ErrInvalidEmptyName = errors.New("name cannot be empty")
 var ErrInvalidMtype = errors.New("invalid mtype")
 var ErrInvalidTagFormat = errors.New("invalid tag format")
+var ErrDuplicateTag = errors.New("duplicate tag key")
 var ErrUnknownPartitionMethod = errors.New("unknown partition method")
 
 type PartitionedMetric interface {
@@ -40,21 +40,23 @@ type MetricData struct {
 	Tags     []string `json:"tags"`
 }
 
+// Validate returns a *ValidationError if m can't be stored.
+// Its cause is one of the ErrInvalid* errors above, so compare using errors.Is, not ==.
 func (m *MetricData) Validate() error {
 	if m.OrgId == 0 {
-		return ErrInvalidOrgIdzero
+		return &ValidationError{Field: "OrgId", Err: ErrInvalidOrgIdzero}
 	}
 	if m.Interval == 0 {
-		return ErrInvalidIntervalzero
+		return &ValidationError{Field: "Interval", Err: ErrInvalidIntervalzero}
 	}
 	if m.Name == "" {
-		return ErrInvalidEmptyName
+		return &ValidationError{Field: "Name", Err: ErrInvalidEmptyName}
 	}
 	if m.Mtype == "" || (m.Mtype != "gauge" && m.Mtype != "rate" && m.Mtype != "count" && m.Mtype != "counter" && m.Mtype != "timestamp") {
-		return ErrInvalidMtype
+		return &ValidationError{Field: "Mtype", Err: ErrInvalidMtype}
 	}
 	if !ValidateTags(m.Tags) {
-		return ErrInvalidTagFormat
+		return &ValidationError{Field: "Tags", Err: ErrInvalidTagFormat}
 	}
 	return nil
 }
@@ -63,21 +65,30 @@ func (m *MetricData) Validate() error {
 // the md5sum is a hash of the the concatination of the
 // metric + each tag key:value pair (in metrics2.0 sense, so also fields), sorted alphabetically.
 func (m *MetricData) SetId() {
-	sort.Strings(m.Tags)
+	m.Id = fmt.Sprintf("%d.%x", m.OrgId, idSum(m.Name, m.Unit, m.Mtype, m.Interval, sortTags(m.Tags)))
+}
 
-	buffer := bytes.NewBufferString(m.Name)
-	buffer.WriteByte(0)
-	buffer.WriteString(m.Unit)
-	buffer.WriteByte(0)
-	buffer.WriteString(m.Mtype)
-	buffer.WriteByte(0)
-	fmt.Fprintf(buffer, "%d", m.Interval)
+// idSum returns the md5sum of an Id: of the name, unit, mtype, interval and tags, separated by zero bytes
+func idSum(name, unit, mtype string, interval int, tags Tags) [md5.Size]byte {
+	b := make([]byte, 0, 64)
+	b = append(b, name...)
+	b = append(b, 0)
+	b = append(b, unit...)
+	b = append(b, 0)
+	b = append(b, mtype...)
+	b = append(b, 0)
+	b = strconv.AppendInt(b, int64(interval), 10)
+	return md5.Sum(tags.appendTo(b, 0))
+}
 
-	for _, k := range m.Tags {
-		buffer.WriteByte(0)
-		buffer.WriteString(k)
-	}
-	m.Id = fmt.Sprintf("%d.%x", m.OrgId, md5.Sum(buffer.Bytes()))
+// SetTags sets the tags of m to the wire form of tags. The Id is not updated.
+func (m *MetricData) SetTags(tags Tags) {
+	m.Tags = tags.Strings()
+}
+
+// ParsedTags returns the tags of m as Tags, see ParseTags
+func (m *MetricData) ParsedTags() (Tags, error) {
+	return ParseTags(m.Tags)
 }
 
 // can be used by some encoders, such as msgp
@@ -114,26 +125,18 @@ func (m *MetricDefinition) NameWithTags() string {
 		return m.nameWithTags
 	}
 
-	nameWithTagsBuffer := &bytes.Buffer{}
-	_ = writeSortedTagString(nameWithTagsBuffer, m.Name, m.Tags)
-	m.nameWithTags = nameWithTagsBuffer.String()
+	tags := sortTags(m.Tags).withoutNameTags()
+	m.nameWithTags = string(tags.appendTo([]byte(m.Name), ';'))
 
-	var i int
 	cursor := len(m.Name)
 	m.Name = m.nameWithTags[:cursor]
-	for _, t := range m.Tags {
-		if len(t) > 5 && t[:5] == "name=" {
-			continue
-		}
+	for i, t := range tags.tags {
 		m.Tags[i] = m.nameWithTags[cursor+1 : cursor+1+len(t)]
 		cursor += len(t) + 1
-		i++
 	}
 
 	// if a "name" tag existed, then we have to shorten the slice
-	if i < len(m.Tags) {
-		m.Tags = m.Tags[:i]
-	}
+	m.Tags = m.Tags[:tags.Len()]
 
 	return m.nameWithTags
 }
@@ -155,51 +158,46 @@ func (m *MetricDefinition) Clone() MetricDefinition {
 	}
 }
 
+// SetTags sets the tags of m to the wire form of tags, and resets the state of NameWithTags.
+// The Id is not updated.
+func (m *MetricDefinition) SetTags(tags Tags) {
+	m.Tags = tags.Strings()
+	m.nameWithTags = ""
+}
+
+// ParsedTags returns the tags of m as Tags, see ParseTags. Any "name" tag is included.
+func (m *MetricDefinition) ParsedTags() (Tags, error) {
+	return ParseTags(m.Tags)
+}
+
 func (m *MetricDefinition) NameSanitizedAsTagValue() string {
 	return SanitizeNameAsTagValue(m.Name)
 }
 
 func (m *MetricDefinition) SetId() {
-	sort.Strings(m.Tags)
-
-	buffer := bytes.NewBufferString(m.Name)
-	buffer.WriteByte(0)
-	buffer.WriteString(m.Unit)
-	buffer.WriteByte(0)
-	buffer.WriteString(m.Mtype)
-	buffer.WriteByte(0)
-	fmt.Fprintf(buffer, "%d", m.Interval)
-
-	for _, t := range m.Tags {
-		if len(t) > 5 && t[:5] == "name=" {
-			continue
-		}
-
-		buffer.WriteByte(0)
-		buffer.WriteString(t)
-	}
-
 	m.Id = MKey{
-		md5.Sum(buffer.Bytes()),
+		idSum(m.Name, m.Unit, m.Mtype, m.Interval, sortTags(m.Tags).withoutNameTags()),
 		uint32(m.OrgId),
 	}
 }
 
+// Validate returns a *ValidationError if m can't be stored, see MetricData.Validate.
+// Compare the result with the ErrInvalid* errors using errors.Is, not ==.
 func (m *MetricDefinition) Validate() error {
 	if m.OrgId == 0 {
-		return ErrInvalidOrgIdzero
+		return &ValidationError{Field: "OrgId", Err: ErrInvalidOrgIdzero}
 	}
 	if m.Interval == 0 {
-		return ErrInvalidIntervalzero
+		return &ValidationError{Field: "Interval", Err: ErrInvalidIntervalzero}
 	}
 	if m.Name == "" {
-		return ErrInvalidEmptyName
+		return &ValidationError{Field: "Name", Err: ErrInvalidEmptyName}
 	}
 	if m.Mtype == "" || (m.Mtype != "gauge" && m.Mtype != "rate" && m.Mtype != "count" && m.Mtype != "counter" && m.Mtype != "timestamp") {
-		return ErrInvalidMtype
+		return &ValidationError{Field: "Mtype", Err: ErrInvalidMtype}
 	}
 	if !ValidateTags(m.Tags) {
-		return ErrInvalidTagFormat
+		return &ValidationError{Field: "Tags", Err: ErrInvalidTagFormat}
 	}
 	return nil
 }
@@ -361,29 +359,118 @@ func ValidateTagValue(value string) bool {
 	return !strings.ContainsRune(value, ';')
 }
 
+// SanitizeTagKey replaces all characters of key that are not allowed by ValidateTagKey by underscores
+func SanitizeTagKey(key string) string {
+	if !strings.ContainsAny(key, ";!^=") {
+		return key
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ';', '!', '^', '=':
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// SanitizeTagValue makes value acceptable to ValidateTagValue, unless it is empty:
+// leading tildes are removed, and semicolons replaced by underscores
+func SanitizeTagValue(value string) string {
+	value = SanitizeNameAsTagValue(value)
+	return strings.Replace(value, ";", "_", -1)
+}
+
+// IsNameTag returns whether t is a "name" tag. The name tag is reserved for the name of a metric:
+// NameWithTags and the Id of a MetricDefinition leave it out, so protocols should not produce it as a regular tag.
+func IsNameTag(t string) bool {
+	return len(t) > 5 && t[:5] == "name="
+}
+
+// SanitizeNameTagKey returns "exported_name" for the key of a name tag (see IsNameTag), and key otherwise.
+// Protocols that sanitize rather than reject tags use it to keep a "name" tag of their input without it
+// clashing with the name, like Prometheus prefixes labels that clash with its own with "exported_".
+func SanitizeNameTagKey(key string) string {
+	if key == "name" {
+		return "exported_name"
+	}
+	return key
+}
+
 func writeSortedTagString(w io.Writer, name string, tags []string) error {
-	sort.Strings(tags)
+	_, err := w.Write(sortTags(tags).withoutNameTags().appendTo([]byte(name), ';'))
+	return err
+}
 
-	_, err := io.WriteString(w, name)
-	if err != nil {
-		return err
+// ParseNameWithTags is the inverse of NameWithTags: it splits a series in the graphite tagged format,
+// "name;key=value;key2=value2", into its name and its tags, sorted.
+// Tag keys and values must be valid according to ValidateTagKey and ValidateTagValue, and keys must be unique.
+// A "name" tag is left out, like NameWithTags does, but only if its value is the name as sanitized by
+// SanitizeNameAsTagValue, which must not be empty. Errors are of type *ParseError.
+func ParseNameWithTags(s string) (string, []string, error) {
+	name := s
+	var tags []string
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		name = s[:i]
+		tags = strings.Split(s[i+1:], ";")
+	}
+	if SanitizeNameAsTagValue(name) == "" {
+		return "", nil, &ParseError{Input: s, Field: "name", Err: ErrInvalidEmptyName}
 	}
 
+	offset := len(name) + 1
+	var parsed Tags
 	for _, t := range tags {
-		if len(t) > 5 && t[:5] == "name=" {
-			continue
+		tag, ok := parseTag(t)
+		if !ok {
+			return "", nil, &ParseError{Input: s, Field: "tags", Offset: offset, Err: ErrInvalidTagFormat}
 		}
-
-		_, err = io.WriteString(w, ";")
-		if err != nil {
-			return err
+		if parsed.Has(tag.Key) {
+			return "", nil, &ParseError{Input: s, Field: "tags", Offset: offset, Err: ErrDuplicateTag}
 		}
-
-		_, err = io.WriteString(w, t)
-		if err != nil {
-			return err
+		if tag.Key == "name" && tag.Value != SanitizeNameAsTagValue(name) {
+			return "", nil, &ParseError{Input: s, Field: "tags", Offset: offset, Err: ErrInvalidTagFormat}
 		}
+		parsed.set(tag.Key, tag.Value)
+		offset += len(t) + 1
 	}
+	parsed.Delete("name")
+	return name, parsed.Strings(), nil
+}
 
-	return nil
+// MetricDataFromNameWithTags returns a MetricData for the series s, see ParseNameWithTags, with its Id set
+func MetricDataFromNameWithTags(orgId int, s string, interval int, unit, mtype string) (*MetricData, error) {
+	name, tags, err := ParseNameWithTags(s)
+	if err != nil {
+		return nil, err
+	}
+	md := &MetricData{
+		OrgId:    orgId,
+		Name:     name,
+		Interval: interval,
+		Unit:     unit,
+		Mtype:    mtype,
+		Tags:     tags,
+	}
+	md.SetId()
+	return md, nil
+}
+
+// MetricDefinitionFromNameWithTags returns a MetricDefinition for the series s, see ParseNameWithTags,
+// with its Id set. NameWithTags has already been called on it.
+func MetricDefinitionFromNameWithTags(orgId uint32, s string, interval int, unit, mtype string) (*MetricDefinition, error) {
+	name, tags, err := ParseNameWithTags(s)
+	if err != nil {
+		return nil, err
+	}
+	md := &MetricDefinition{
+		OrgId:    orgId,
+		Name:     name,
+		Interval: interval,
+		Unit:     unit,
+		Mtype:    mtype,
+		Tags:     tags,
+	}
+	md.SetId()
+	md.NameWithTags()
+	return md, nil
 }
@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"errors"
 	"reflect"
 	"sort"
 	"testing"
@@ -53,6 +54,38 @@ func TestTagValidation(t *testing.T) {
 	}
 }
 
+func TestSanitizeTag(t *testing.T) {
+	keys := map[string]string{
+		"abc":     "abc",
+		"a;b!c^d": "a_b_c_d",
+		"a=b":     "a_b",
+		"~a":      "~a",
+	}
+	for in, exp := range keys {
+		if got := SanitizeTagKey(in); got != exp || !ValidateTagKey(got) {
+			t.Fatalf("expected key %q to be sanitized to %q, got %q", in, exp, got)
+		}
+	}
+	values := map[string]string{
+		"abc":    "abc",
+		"~~a;b~": "a_b~",
+		"a=b!":   "a=b!",
+	}
+	for in, exp := range values {
+		if got := SanitizeTagValue(in); got != exp || !ValidateTagValue(got) {
+			t.Fatalf("expected value %q to be sanitized to %q, got %q", in, exp, got)
+		}
+	}
+	if got := SanitizeTagValue("~~"); got != "" {
+		t.Fatalf("expected value of only tildes to be sanitized to an empty string, got %q", got)
+	}
+	for in, exp := range map[string]string{"name": "exported_name", "names": "names", "exported_name": "exported_name"} {
+		if got := SanitizeNameTagKey(in); got != exp || IsNameTag(got+"=x") {
+			t.Fatalf("expected key %q to be sanitized to %q, got %q", in, exp, got)
+		}
+	}
+}
+
 func newMetricDefinition(name string, tags []string) *MetricDefinition {
 	sort.Strings(tags)
 
@@ -185,3 +218,117 @@ func BenchmarkNameSanitizedAsTagValueWithInvalidValue(b *testing.B) {
 		SanitizeNameAsTagValue(inputValue)
 	}
 }
+
+func TestParseNameWithTags(t *testing.T) {
+	cases := []struct {
+		in   string
+		name string
+		tags []string
+	}{
+		{"a.b.c", "a.b.c", nil},
+		{"a.b.c;tag1=value1", "a.b.c", []string{"tag1=value1"}},
+		{"a.b.c;c=c;a=a;b=b", "a.b.c", []string{"a=a", "b=b", "c=c"}},
+		{"a.b.c;name=a.b.c;b=b", "a.b.c", []string{"b=b"}},
+		{"~a.b;name=a.b", "~a.b", nil},
+		{"a;b=c=d;e=f~", "a", []string{"b=c=d", "e=f~"}},
+	}
+	for _, c := range cases {
+		name, tags, err := ParseNameWithTags(c.in)
+		if err != nil {
+			t.Fatalf("%q: %s", c.in, err.Error())
+		}
+		if name != c.name || !reflect.DeepEqual(tags, c.tags) {
+			t.Fatalf("%q: expected name %q and tags %v, got %q and %v", c.in, c.name, c.tags, name, tags)
+		}
+	}
+
+	invalid := []struct {
+		in     string
+		field  string
+		offset int
+		err    error
+	}{
+		{"", "name", 0, ErrInvalidEmptyName},
+		{";a=b", "name", 0, ErrInvalidEmptyName},
+		{"~", "name", 0, ErrInvalidEmptyName},
+		{"a;", "tags", 2, ErrInvalidTagFormat},
+		{"a;b=c;", "tags", 6, ErrInvalidTagFormat},
+		{"a;b=c;;d=e", "tags", 6, ErrInvalidTagFormat},
+		{"a;b", "tags", 2, ErrInvalidTagFormat},
+		{"a;=b", "tags", 2, ErrInvalidTagFormat},
+		{"a;b=", "tags", 2, ErrInvalidTagFormat},
+		{"a;b!=c", "tags", 2, ErrInvalidTagFormat},
+		{"a;b=~c", "tags", 2, ErrInvalidTagFormat},
+		{"a;b=c;b=d", "tags", 6, ErrDuplicateTag},
+		{"a;name=a;name=a", "tags", 9, ErrDuplicateTag},
+		{"a;name=b", "tags", 2, ErrInvalidTagFormat},
+		{"~a;name=~a", "tags", 3, ErrInvalidTagFormat},
+	}
+	for _, c := range invalid {
+		_, _, err := ParseNameWithTags(c.in)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%q: expected ParseError, got %v", c.in, err)
+		}
+		if perr.Field != c.field || perr.Offset != c.offset || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at offset %d caused by %q, got %s", c.in, c.field, c.offset, c.err, err.Error())
+		}
+	}
+}
+
+func TestFromNameWithTags(t *testing.T) {
+	in := "a.b.c;name=a.b.c;c=c;a=a"
+	md, err := MetricDataFromNameWithTags(1, in, 10, "ms", "gauge")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := &MetricData{OrgId: 1, Name: "a.b.c", Interval: 10, Unit: "ms", Mtype: "gauge", Tags: []string{"c=c", "a=a"}}
+	exp.SetId()
+	if !reflect.DeepEqual(exp, md) {
+		t.Fatalf("expected %+v, got %+v", *exp, *md)
+	}
+
+	def, err := MetricDefinitionFromNameWithTags(1, in, 10, "ms", "gauge")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	expDef := MetricDefinitionFromMetricData(exp)
+	expDef.LastUpdate = 0
+	if def.Id != expDef.Id || def.NameWithTags() != expDef.NameWithTags() || !reflect.DeepEqual(def.Tags, expDef.Tags) {
+		t.Fatalf("expected %+v, got %+v", *expDef, *def)
+	}
+	if def.NameWithTags() != "a.b.c;a=a;c=c" {
+		t.Fatalf("unexpected name with tags %q", def.NameWithTags())
+	}
+
+	if _, err := MetricDataFromNameWithTags(1, "a;b", 10, "", "gauge"); !errors.Is(err, ErrInvalidTagFormat) {
+		t.Fatalf("expected ErrInvalidTagFormat, got %v", err)
+	}
+	if _, err := MetricDefinitionFromNameWithTags(1, "", 10, "", "gauge"); !errors.Is(err, ErrInvalidEmptyName) {
+		t.Fatalf("expected ErrInvalidEmptyName, got %v", err)
+	}
+}
+
+// FuzzParseNameWithTags checks that whatever ParseNameWithTags accepts is a valid series
+// that NameWithTags turns back into a string that parses to the same name and tags.
+func FuzzParseNameWithTags(f *testing.F) {
+	f.Add("a.b.c;c=c;a=a;b=b")
+	f.Add("~a.b;name=a.b;x=y=z")
+	f.Fuzz(func(t *testing.T, s string) {
+		name, tags, err := ParseNameWithTags(s)
+		if err != nil {
+			return
+		}
+		md := MetricDefinition{OrgId: 1, Name: name, Interval: 1, Mtype: "gauge", Tags: append([]string(nil), tags...)}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("%q: invalid definition: %s", s, err.Error())
+		}
+		name2, tags2, err := ParseNameWithTags(md.NameWithTags())
+		if err != nil {
+			t.Fatalf("failed to parse %q, the name with tags of %q: %s", md.NameWithTags(), s, err.Error())
+		}
+		if name2 != name || !reflect.DeepEqual(tags2, tags) {
+			t.Fatalf("%q parsed to %q and %v, but %q parsed to %q and %v", s, name, tags, md.NameWithTags(), name2, tags2)
+		}
+	})
+}
@@ -2,9 +2,12 @@ package schema
 
 import (
 	"encoding/binary"
+	"errors"
 	"math"
 )
 
+var ErrBufferTooShort = errors.New("buffer too short")
+
 //msgp:ignore MetricPoint
 
 // MetricPoint is a simple way to represent a point of a metric
@@ -45,6 +48,9 @@ func (m *MetricPoint) putWithoutOrg(b []byte) {
 
 // UnmarshalWithoutOrg unmarshals in a non-multi-tenancy aware way
 func (m *MetricPoint) UnmarshalWithoutOrg(bts []byte) (o []byte, err error) {
+	if len(bts) < 28 {
+		return bts, ErrBufferTooShort
+	}
 	copy(m.MKey.Key[:], bts[:16])
 	m.Value = math.Float64frombits(binary.LittleEndian.Uint64(bts[16:24]))
 	m.Time = binary.LittleEndian.Uint32(bts[24:])
@@ -72,6 +78,9 @@ func (m *MetricPoint) Marshal(b []byte) (o []byte, err error) {
 
 // Unmarshal unmarshals the MetricPoint
 func (m *MetricPoint) Unmarshal(bts []byte) (o []byte, err error) {
+	if len(bts) < 32 {
+		return bts, ErrBufferTooShort
+	}
 	copy(m.MKey.Key[:], bts[:16])
 	m.Value = math.Float64frombits(binary.LittleEndian.Uint64(bts[16:24]))
 	m.Time = binary.LittleEndian.Uint32(bts[24:])
@@ -222,3 +222,42 @@ func BenchmarkEatDots(b *testing.B) {
 		}
 	}
 }
+
+func FuzzMetricPointUnmarshal(f *testing.F) {
+	mp := MetricPoint{
+		MKey:  MKey{[16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255}, 12345},
+		Value: 1.5,
+		Time:  math.MaxUint32,
+	}
+	seed, _ := mp.Marshal(nil)
+	f.Add(seed)
+	f.Add(seed[:28])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var out MetricPoint
+		rest, err := out.Unmarshal(data)
+		if err == nil {
+			if len(rest) != len(data)-32 {
+				t.Fatalf("expected %d remaining bytes, got %d", len(data)-32, len(rest))
+			}
+			buf, _ := out.Marshal(nil)
+			if string(buf) != string(data[:32]) {
+				t.Fatalf("expected %v after re-marshaling, got %v", data[:32], buf)
+			}
+		} else if len(data) >= 32 {
+			t.Fatalf("unexpected error for %d bytes: %s", len(data), err.Error())
+		}
+
+		rest, err = out.UnmarshalWithoutOrg(data)
+		if err == nil {
+			if len(rest) != len(data)-28 {
+				t.Fatalf("expected %d remaining bytes, got %d", len(data)-28, len(rest))
+			}
+			buf, _ := out.MarshalWithoutOrg(nil)
+			if string(buf) != string(data[:28]) {
+				t.Fatalf("expected %v after re-marshaling, got %v", data[:28], buf)
+			}
+		} else if len(data) >= 28 {
+			t.Fatalf("unexpected error for %d bytes: %s", len(data), err.Error())
+		}
+	})
+}
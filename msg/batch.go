@@ -0,0 +1,105 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/raintank/schema"
+	"github.com/tinylib/msgp/msgp"
+)
+
+var ErrMetricTooLarge = errors.New("metric does not fit in a message")
+
+// batchOverhead is the upper bound of the size of a message without any metrics
+const batchOverhead = envelopeV1HeaderSize + msgp.ArrayHeaderSize
+
+// BatchEncoder accumulates MetricData and encodes them into messages, as created by CreateMsg,
+// that never exceed a given size in bytes.
+// Batches are planned based on the metrics' Msgsize(), which is an upper bound for the msgp
+// encoding. For formats whose encoding may turn out larger (e.g. json), batches are split further
+// after encoding as needed.
+type BatchEncoder struct {
+	version Format
+	maxSize int
+	emit    func(msg []byte) error
+
+	metrics []*schema.MetricData
+	size    int // planned size of the message for the current batch
+}
+
+// NewBatchEncoder returns a BatchEncoder that creates messages of the given format (see CreateMsg)
+// of at most maxSize bytes, and passes them to emit.
+// Messages get the current time in nanoseconds as id.
+func NewBatchEncoder(version Format, maxSize int, emit func(msg []byte) error) (*BatchEncoder, error) {
+	if _, ok := lookupMetricDataCodec(version); !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
+	if maxSize <= batchOverhead {
+		return nil, encodeError(version, "", fmt.Errorf("%w: max size must be more than %d bytes", ErrTooSmall, batchOverhead))
+	}
+	return &BatchEncoder{
+		version: version,
+		maxSize: maxSize,
+		emit:    emit,
+		size:    batchOverhead,
+	}, nil
+}
+
+// Add adds the metric to the current batch.
+// If the metric doesn't fit in the current batch, the batch is flushed first.
+// The metric must not be modified until it has been flushed.
+func (b *BatchEncoder) Add(md *schema.MetricData) error {
+	size := md.Msgsize()
+	if batchOverhead+size > b.maxSize {
+		return encodeError(b.version, "body", fmt.Errorf("%w: metric %q of %d bytes, max %d bytes", ErrMetricTooLarge, md.Id, size, b.maxSize))
+	}
+	if b.size+size > b.maxSize {
+		err := b.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	b.metrics = append(b.metrics, md)
+	b.size += size
+	return nil
+}
+
+// Len returns the number of metrics in the current batch
+func (b *BatchEncoder) Len() int {
+	return len(b.metrics)
+}
+
+// Flush encodes and emits the current batch, if any
+func (b *BatchEncoder) Flush() error {
+	if len(b.metrics) == 0 {
+		return nil
+	}
+	err := b.encode(b.metrics)
+	for i := range b.metrics {
+		b.metrics[i] = nil
+	}
+	b.metrics = b.metrics[:0]
+	b.size = batchOverhead
+	return err
+}
+
+// encode encodes metrics into one message, or more if it turns out to be too large
+func (b *BatchEncoder) encode(metrics []*schema.MetricData) error {
+	data, err := CreateMsg(metrics, time.Now().UnixNano(), b.version)
+	if err != nil {
+		return err
+	}
+	if len(data) > b.maxSize {
+		if len(metrics) == 1 {
+			return encodeError(b.version, "body", fmt.Errorf("%w: metric %q of %d bytes, max %d bytes", ErrMetricTooLarge, metrics[0].Id, len(data), b.maxSize))
+		}
+		half := len(metrics) / 2
+		err = b.encode(metrics[:half])
+		if err != nil {
+			return err
+		}
+		return b.encode(metrics[half:])
+	}
+	return b.emit(data)
+}
@@ -0,0 +1,116 @@
+package msg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestBatchEncoder(t *testing.T) {
+	metrics := getMetricData(1000)
+	for _, version := range []Format{
+		FormatMetricDataArrayMsgp,
+		FormatMetricDataArrayMsgp.WithChecksum(),
+		FormatMetricDataArrayMsgp.Compressed(CompressionGzip),
+		FormatMetricDataArrayJson,
+	} {
+		for _, maxSize := range []int{1000, 4096, 1 << 20} {
+			var msgs [][]byte
+			b, err := NewBatchEncoder(version, maxSize, func(msg []byte) error {
+				msgs = append(msgs, msg)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%d/%d: %s", version, maxSize, err.Error())
+			}
+			for _, md := range metrics {
+				err = b.Add(md)
+				if err != nil {
+					t.Fatalf("%d/%d: %s", version, maxSize, err.Error())
+				}
+			}
+			err = b.Flush()
+			if err != nil {
+				t.Fatalf("%d/%d: %s", version, maxSize, err.Error())
+			}
+			if b.Len() != 0 {
+				t.Fatalf("%d/%d: expected empty batch after flush, got %d metrics", version, maxSize, b.Len())
+			}
+
+			var got []*schema.MetricData
+			for i, msg := range msgs {
+				if len(msg) > maxSize {
+					t.Fatalf("%d/%d: message %d has %d bytes", version, maxSize, i, len(msg))
+				}
+				var c collector
+				err = Decode(msg, 6, &c)
+				if err != nil {
+					t.Fatalf("%d/%d: %s", version, maxSize, err.Error())
+				}
+				got = append(got, c.metrics...)
+			}
+			if !reflect.DeepEqual(metrics, got) {
+				t.Fatalf("%d/%d: metrics mismatch after decoding %d messages", version, maxSize, len(msgs))
+			}
+			if maxSize == 1<<20 && len(msgs) != 1 {
+				t.Fatalf("%d/%d: expected all metrics in 1 message, got %d", version, maxSize, len(msgs))
+			}
+		}
+	}
+}
+
+func TestBatchEncoderPlanning(t *testing.T) {
+	metrics := getMetricData(1000)
+	maxSize := 4096
+	var msgs int
+	b, err := NewBatchEncoder(FormatMetricDataArrayMsgp, maxSize, func(msg []byte) error {
+		msgs++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var total int
+	for _, md := range metrics {
+		total += md.Msgsize()
+		err = b.Add(md)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	err = b.Flush()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// every message except the last one is filled up to at least maxSize minus the largest metric
+	maxMsgs := total/(maxSize-batchOverhead-metrics[0].Msgsize()) + 1
+	if msgs > maxMsgs {
+		t.Fatalf("expected at most %d messages, got %d", maxMsgs, msgs)
+	}
+}
+
+func TestBatchEncoderTooLarge(t *testing.T) {
+	b, err := NewBatchEncoder(FormatMetricDataArrayMsgp, 1000, func(msg []byte) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	md := getMetricData(1)[0]
+	md.Name = strings.Repeat("a", 1000)
+	if err = b.Add(md); err == nil {
+		t.Fatal("expected error adding metric larger than max size, got nil")
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected empty batch, got %d metrics", b.Len())
+	}
+
+	if _, err = NewBatchEncoder(FormatMetricPoint, 1000, nil); err == nil {
+		t.Fatal("expected error for unsupported format, got nil")
+	}
+	if _, err = NewBatchEncoder(FormatMetricDataArrayMsgp, 10, nil); err == nil {
+		t.Fatal("expected error for too small max size, got nil")
+	}
+}
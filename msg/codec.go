@@ -0,0 +1,311 @@
+package msg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/raintank/schema"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Codec encodes and decodes the bodies of messages of a given Format.
+// Every Codec must also implement MetricDataCodec, MetricDefinitionCodec and/or PointCodec to be of any use.
+type Codec interface {
+	// Name is a short, human friendly description of the format
+	Name() string
+}
+
+// MetricDataCodec is a Codec for formats that carry a batch of MetricData.
+// Such formats can be used with CreateMsg, InitFromMsg and DecodeMetricData.
+type MetricDataCodec interface {
+	Codec
+	// EncodeMetricData appends the encoded metrics to b
+	EncodeMetricData(b []byte, metrics []*schema.MetricData) ([]byte, error)
+	// DecodeMetricData decodes body and returns the metrics therein.
+	// metrics may be re-used to hold the result.
+	// the returned metrics must not reference body.
+	DecodeMetricData(body []byte, metrics []*schema.MetricData) ([]*schema.MetricData, error)
+}
+
+// MetricDefinitionCodec is a Codec for formats that carry a batch of MetricDefinition.
+// Such formats can be used with CreateMetricDefinitionMsg and MetricDefinitions.
+type MetricDefinitionCodec interface {
+	Codec
+	// EncodeMetricDefinitions appends the encoded definitions to b
+	EncodeMetricDefinitions(b []byte, defs []*schema.MetricDefinition) ([]byte, error)
+	// DecodeMetricDefinitions decodes body and returns the definitions therein.
+	// defs may be re-used to hold the result.
+	// the returned definitions must not reference body.
+	DecodeMetricDefinitions(body []byte, defs []*schema.MetricDefinition) ([]*schema.MetricDefinition, error)
+}
+
+// PointCodec is a Codec for formats that carry a single MetricPoint of a fixed size.
+// Such formats can be used with WritePointMsg, IsPointMsg and ReadPointMsg.
+type PointCodec interface {
+	Codec
+	// PointSize is the size of an encoded point, not including the format byte
+	PointSize() int
+	// EncodePoint appends the encoded point to b, which is guaranteed to have a cap-len diff of at least PointSize()
+	EncodePoint(b []byte, point schema.MetricPoint) ([]byte, error)
+	// DecodePoint decodes the point at the start of body and returns the remainder.
+	// body is guaranteed to be at least PointSize() long.
+	DecodePoint(body []byte, defaultOrg uint32) ([]byte, schema.MetricPoint, error)
+}
+
+var codecs [formatMask + 1]Codec
+
+// firstPrivateFormat is the first format that can be registered outside of this package
+const firstPrivateFormat Format = 16
+
+// Register makes a codec available for the given Format, so it can be used by
+// CreateMsg, InitFromMsg, WritePointMsg etc.
+// Formats 0-15 are reserved for this package, so private formats must use 16-31.
+// It panics if the format is reserved, out of range or already registered, or if the codec is nil.
+// Register is not safe for concurrent use and should be called from an init function.
+func Register(f Format, c Codec) {
+	if f < firstPrivateFormat {
+		panic(fmt.Sprintf("msg: Register format %d is reserved", f))
+	}
+	register(f, c)
+}
+
+// register is Register without the check for reserved formats, for the built-in codecs
+func register(f Format, c Codec) {
+	if f > formatMask {
+		panic(fmt.Sprintf("msg: Register format %d out of range", f))
+	}
+	if c == nil {
+		panic("msg: Register codec is nil")
+	}
+	if codecs[f] != nil {
+		panic(fmt.Sprintf("msg: Register called twice for format %d (%s)", f, codecs[f].Name()))
+	}
+	codecs[f] = c
+}
+
+// Lookup returns the codec registered for the given Format, if any.
+// any compression or envelope flags in f are ignored.
+// There are no codecs for the point array and tombstone formats, which have their own readers and writers.
+func Lookup(f Format) (Codec, bool) {
+	c := codecs[f.Base()]
+	return c, c != nil
+}
+
+func lookupMetricDataCodec(f Format) (MetricDataCodec, bool) {
+	c, ok := codecs[f.Base()].(MetricDataCodec)
+	return c, ok
+}
+
+func lookupMetricDefinitionCodec(f Format) (MetricDefinitionCodec, bool) {
+	c, ok := codecs[f.Base()].(MetricDefinitionCodec)
+	return c, ok
+}
+
+func lookupPointCodec(f Format) (PointCodec, bool) {
+	if f > formatMask {
+		return nil, false
+	}
+	c, ok := codecs[f].(PointCodec)
+	return c, ok
+}
+
+func init() {
+	register(FormatMetricDataArrayJson, jsonCodec{})
+	register(FormatMetricDataArrayMsgp, msgpCodec{})
+	register(FormatMetricPoint, pointCodec{})
+	register(FormatMetricPointWithoutOrg, pointWithoutOrgCodec{})
+	register(FormatMetricDefinitionArrayJson, jsonDefinitionCodec{})
+	register(FormatMetricDefinitionArrayMsgp, msgpDefinitionCodec{})
+	register(FormatMetricDataArrayDict, dictCodec{})
+}
+
+// jsonCodec implements FormatMetricDataArrayJson
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) EncodeMetricData(b []byte, metrics []*schema.MetricData) ([]byte, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return b, err
+	}
+	return append(b, data...), nil
+}
+
+func (jsonCodec) DecodeMetricData(body []byte, metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	err := json.Unmarshal(body, &metrics)
+	return metrics, err
+}
+
+// msgpCodec implements FormatMetricDataArrayMsgp
+type msgpCodec struct{}
+
+func (msgpCodec) Name() string {
+	return "msgp"
+}
+
+func (msgpCodec) EncodeMetricData(b []byte, metrics []*schema.MetricData) ([]byte, error) {
+	return schema.MetricDataArray(metrics).MarshalMsg(b)
+}
+
+// maxMsgpDepth is the maximum nesting of arrays and maps accepted by checkMsgp
+const maxMsgpDepth = 16
+
+var errMsgpTooDeep = errors.New("msgp data nested too deeply")
+
+// checkMsgp validates the sizes of all arrays and maps in the msgp encoded b against the size of b.
+// The generated decoders allocate as many elements as headers claim, so without this check
+// a few bytes of malicious input can make them allocate gigabytes.
+func checkMsgp(b []byte, depth int) ([]byte, error) {
+	if depth > maxMsgpDepth {
+		return b, errMsgpTooDeep
+	}
+	var n uint32
+	var err error
+	switch msgp.NextType(b) {
+	case msgp.ArrayType:
+		n, b, err = msgp.ReadArrayHeaderBytes(b)
+	case msgp.MapType:
+		n, b, err = msgp.ReadMapHeaderBytes(b)
+		n *= 2
+	default:
+		return msgp.Skip(b)
+	}
+	if err != nil {
+		return b, err
+	}
+	// every element takes at least a byte
+	if uint64(n) > uint64(len(b)) {
+		return b, msgp.ErrShortBytes
+	}
+	for i := uint32(0); i < n; i++ {
+		b, err = checkMsgp(b, depth+1)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (msgpCodec) DecodeMetricData(body []byte, metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	if _, err := checkMsgp(body, 0); err != nil {
+		return metrics[:0], err
+	}
+	out := schema.MetricDataArray(metrics)
+	_, err := out.UnmarshalMsg(body)
+	return []*schema.MetricData(out), err
+}
+
+// jsonDefinitionCodec implements FormatMetricDefinitionArrayJson
+type jsonDefinitionCodec struct{}
+
+func (jsonDefinitionCodec) Name() string {
+	return "definition-json"
+}
+
+func (jsonDefinitionCodec) EncodeMetricDefinitions(b []byte, defs []*schema.MetricDefinition) ([]byte, error) {
+	data, err := json.Marshal(defs)
+	if err != nil {
+		return b, err
+	}
+	return append(b, data...), nil
+}
+
+func (jsonDefinitionCodec) DecodeMetricDefinitions(body []byte, defs []*schema.MetricDefinition) ([]*schema.MetricDefinition, error) {
+	err := json.Unmarshal(body, &defs)
+	return defs, err
+}
+
+// msgpDefinitionCodec implements FormatMetricDefinitionArrayMsgp:
+// a msgp array of MetricDefinition
+type msgpDefinitionCodec struct{}
+
+func (msgpDefinitionCodec) Name() string {
+	return "definition-msgp"
+}
+
+func (msgpDefinitionCodec) EncodeMetricDefinitions(b []byte, defs []*schema.MetricDefinition) ([]byte, error) {
+	b = msgp.AppendArrayHeader(b, uint32(len(defs)))
+	var err error
+	for _, d := range defs {
+		b, err = d.MarshalMsg(b)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (msgpDefinitionCodec) DecodeMetricDefinitions(body []byte, defs []*schema.MetricDefinition) ([]*schema.MetricDefinition, error) {
+	if _, err := checkMsgp(body, 0); err != nil {
+		return defs[:0], err
+	}
+	n, body, err := msgp.ReadArrayHeaderBytes(body)
+	if err != nil {
+		return defs, err
+	}
+	if cap(defs) >= int(n) {
+		defs = defs[:n]
+	} else {
+		defs = make([]*schema.MetricDefinition, n)
+	}
+	for i := range defs {
+		if defs[i] == nil {
+			defs[i] = new(schema.MetricDefinition)
+		} else {
+			// don't keep any state of the previous definition
+			*defs[i] = schema.MetricDefinition{}
+		}
+		body, err = defs[i].UnmarshalMsg(body)
+		if err != nil {
+			return defs[:i], err
+		}
+	}
+	return defs, nil
+}
+
+// pointCodec implements FormatMetricPoint
+type pointCodec struct{}
+
+func (pointCodec) Name() string {
+	return "point"
+}
+
+func (pointCodec) PointSize() int {
+	return 32
+}
+
+func (pointCodec) EncodePoint(b []byte, point schema.MetricPoint) ([]byte, error) {
+	return point.Marshal32(b)
+}
+
+func (pointCodec) DecodePoint(body []byte, defaultOrg uint32) ([]byte, schema.MetricPoint, error) {
+	var point schema.MetricPoint
+	o, err := point.Unmarshal(body)
+	return o, point, err
+}
+
+// pointWithoutOrgCodec implements FormatMetricPointWithoutOrg
+type pointWithoutOrgCodec struct{}
+
+func (pointWithoutOrgCodec) Name() string {
+	return "point-without-org"
+}
+
+func (pointWithoutOrgCodec) PointSize() int {
+	return 28
+}
+
+func (pointWithoutOrgCodec) EncodePoint(b []byte, point schema.MetricPoint) ([]byte, error) {
+	return point.MarshalWithoutOrg28(b)
+}
+
+func (pointWithoutOrgCodec) DecodePoint(body []byte, defaultOrg uint32) ([]byte, schema.MetricPoint, error) {
+	var point schema.MetricPoint
+	o, err := point.UnmarshalWithoutOrg(body)
+	point.MKey.Org = defaultOrg
+	return o, point, err
+}
@@ -0,0 +1,202 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+const testFormatGob Format = 30
+const testFormatBigEndianPoint Format = 31
+
+func init() {
+	Register(testFormatGob, gobCodec{})
+	Register(testFormatBigEndianPoint, bigEndianPointCodec{})
+}
+
+// gobCodec is an example of a private MetricData format
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) EncodeMetricData(b []byte, metrics []*schema.MetricData) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	err := gob.NewEncoder(buf).Encode(metrics)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) DecodeMetricData(body []byte, metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	metrics = metrics[:0]
+	err := gob.NewDecoder(bytes.NewReader(body)).Decode(&metrics)
+	return metrics, err
+}
+
+// bigEndianPointCodec is an example of a private MetricPoint format
+type bigEndianPointCodec struct{}
+
+func (bigEndianPointCodec) Name() string {
+	return "point-big-endian"
+}
+
+func (bigEndianPointCodec) PointSize() int {
+	return 32
+}
+
+func (bigEndianPointCodec) EncodePoint(b []byte, point schema.MetricPoint) ([]byte, error) {
+	l := len(b)
+	b = b[:l+32]
+	copy(b[l:], point.MKey.Key[:])
+	binary.BigEndian.PutUint64(b[l+16:], math.Float64bits(point.Value))
+	binary.BigEndian.PutUint32(b[l+24:], point.Time)
+	binary.BigEndian.PutUint32(b[l+28:], point.MKey.Org)
+	return b, nil
+}
+
+func (bigEndianPointCodec) DecodePoint(body []byte, defaultOrg uint32) ([]byte, schema.MetricPoint, error) {
+	var point schema.MetricPoint
+	copy(point.MKey.Key[:], body[:16])
+	point.Value = math.Float64frombits(binary.BigEndian.Uint64(body[16:]))
+	point.Time = binary.BigEndian.Uint32(body[24:])
+	point.MKey.Org = binary.BigEndian.Uint32(body[28:])
+	return body[32:], point, nil
+}
+
+func TestBuiltinCodecs(t *testing.T) {
+	cases := []struct {
+		format Format
+		name   string
+	}{
+		{FormatMetricDataArrayJson, "json"},
+		{FormatMetricDataArrayMsgp, "msgp"},
+		{FormatMetricPoint, "point"},
+		{FormatMetricPointWithoutOrg, "point-without-org"},
+		{FormatMetricDefinitionArrayJson, "definition-json"},
+		{FormatMetricDefinitionArrayMsgp, "definition-msgp"},
+		{FormatMetricDataArrayDict, "dict"},
+	}
+	for _, c := range cases {
+		codec, ok := Lookup(c.format)
+		if !ok {
+			t.Fatalf("%s: expected a registered codec", c.format)
+		}
+		if codec.Name() != c.name {
+			t.Fatalf("%s: expected name %q, got %q", c.format, c.name, codec.Name())
+		}
+	}
+	for _, f := range []Format{20, FormatMetricPointArray, FormatMetricPointArrayWithoutOrg, FormatMetricPointArrayOrg, FormatMetricPointArrayXor, FormatTombstone} {
+		if _, ok := Lookup(f); ok {
+			t.Fatalf("%s: expected no codec", f)
+		}
+	}
+}
+
+func TestPrivateMetricDataCodec(t *testing.T) {
+	metrics := getMetricData(10)
+	for _, version := range []Format{testFormatGob, testFormatGob.Compressed(CompressionGzip).WithChecksum()} {
+		data, err := CreateMsg(metrics, 1234567890, version)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if m.Format != testFormatGob {
+			t.Fatalf("%d: expected format %d, got %d", version, testFormatGob, m.Format)
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if !reflect.DeepEqual(metrics, m.Metrics) {
+			t.Fatalf("%d: metrics mismatch after decoding", version)
+		}
+	}
+
+	// point formats can't be used for MetricData
+	if _, err := CreateMsg(metrics, 1234567890, testFormatBigEndianPoint); err == nil {
+		t.Fatal("expected error creating MetricData message with a point format, got nil")
+	}
+}
+
+func TestPrivatePointCodec(t *testing.T) {
+	mp := schema.MetricPoint{
+		MKey: schema.MKey{
+			Key: [16]byte{1, 2, 3},
+			Org: 123,
+		},
+		Time:  math.MaxUint32,
+		Value: 123.45,
+	}
+	buf := make([]byte, 0, 33)
+	out, err := WritePointMsg(mp, buf, testFormatBigEndianPoint)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if f, ok := IsPointMsg(out); !ok || f != testFormatBigEndianPoint {
+		t.Fatalf("IsPointMsg: exp %d, true, got %d, %t", testFormatBigEndianPoint, f, ok)
+	}
+	leftover, outPoint, err := ReadPointMsg(out, 6)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(leftover) > 0 {
+		t.Fatalf("expected no leftover. got %v", leftover)
+	}
+	if outPoint != mp {
+		t.Fatalf("expected point %v, got %v", mp, outPoint)
+	}
+
+	// MetricData formats can't be used for points
+	if _, err := WritePointMsg(mp, buf, testFormatGob); err == nil {
+		t.Fatal("expected error writing point message with a MetricData format, got nil")
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	cases := []struct {
+		format Format
+		codec  Codec
+	}{
+		{FormatMetricDataArrayMsgp, gobCodec{}}, // duplicate
+		{testFormatGob, gobCodec{}},             // duplicate
+		{formatMask + 1, gobCodec{}},            // out of range
+		{20, nil},                               // nil codec
+		{FormatTombstone, gobCodec{}},           // reserved
+		{FormatMetricPointArrayXor, gobCodec{}}, // reserved
+		{13, gobCodec{}},                        // reserved, not yet in use
+		{firstPrivateFormat - 1, gobCodec{}},    // reserved, not yet in use
+	}
+	for i, c := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("case %d: expected Register to panic", i)
+				}
+			}()
+			Register(c.format, c.codec)
+		}()
+	}
+}
+
+// FuzzMsgpCodecs checks that the msgp codecs reject arbitrary input without panicking
+// or allocating based on bogus sizes
+func FuzzMsgpCodecs(f *testing.F) {
+	body, _ := msgpCodec{}.EncodeMetricData(nil, getMetricData(3))
+	f.Add(body)
+	body, _ = msgpDefinitionCodec{}.EncodeMetricDefinitions(nil, getMetricDefinitions(3))
+	f.Add(body)
+	f.Add([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msgpCodec{}.DecodeMetricData(data, nil)
+		msgpDefinitionCodec{}.DecodeMetricDefinitions(data, nil)
+	})
+}
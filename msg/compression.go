@@ -0,0 +1,137 @@
+package msg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+//go:generate stringer -type=Compression
+
+// Compression identifies the codec used to compress a message body
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+)
+
+// maxSnappyRatio is the largest factor by which snappy data can decompress:
+// every byte decodes to at most 22 bytes (a 3 byte copy of 64 bytes)
+const maxSnappyRatio = 22
+
+// maxDecompressedSize is the maximum size of a decompressed body
+const maxDecompressedSize = DefaultMaxMsgSize
+
+// pools to keep allocations low when (de)compressing many messages
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var gzipReaderPool sync.Pool
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// compress writes body, compressed with c, to w
+func compress(w *bytes.Buffer, body []byte, c Compression) error {
+	switch c {
+	case CompressionNone:
+		_, err := w.Write(body)
+		return err
+	case CompressionGzip:
+		zw := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(zw)
+		zw.Reset(w)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		return zw.Close()
+	case CompressionSnappy:
+		buf := getBuffer()
+		defer putBuffer(buf)
+		n := snappy.MaxEncodedLen(len(body))
+		buf.Grow(n)
+		_, err := w.Write(snappy.Encode(buf.Bytes()[:n], body))
+		return err
+	}
+	return fmt.Errorf("%w %d", ErrUnsupportedCompression, c)
+}
+
+// decompress decompresses body, which was compressed using c.
+// the returned buffer holds the decompressed body and should be returned via putBuffer
+// once the caller is done with it.
+func decompress(body []byte, c Compression) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	switch c {
+	case CompressionGzip:
+		var zr *gzip.Reader
+		var err error
+		if r, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+			zr = r
+			err = zr.Reset(bytes.NewReader(body))
+		} else {
+			zr, err = gzip.NewReader(bytes.NewReader(body))
+		}
+		if err == nil {
+			// gzip has no size limit of its own, read one byte more than allowed to detect bodies that exceed it
+			_, err = buf.ReadFrom(io.LimitReader(zr, maxDecompressedSize+1))
+			gzipReaderPool.Put(zr)
+		}
+		if err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		if buf.Len() > maxDecompressedSize {
+			// don't keep such a large buffer in the pool
+			return nil, fmt.Errorf("%w: gzip decompressed size exceeds max of %d", ErrInvalidSize, maxDecompressedSize)
+		}
+		return buf, nil
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		// don't let a corrupt header make us allocate more than the data can decode to
+		if uint64(n) > maxSnappyRatio*uint64(len(body)) {
+			putBuffer(buf)
+			return nil, fmt.Errorf("%w: snappy decoded length %d for %d bytes", ErrInvalidSize, n, len(body))
+		}
+		if n > maxDecompressedSize {
+			putBuffer(buf)
+			return nil, fmt.Errorf("%w: snappy decoded length %d exceeds max of %d", ErrInvalidSize, n, maxDecompressedSize)
+		}
+		buf.Grow(n)
+		out, err := snappy.Decode(buf.Bytes()[:n], body)
+		if err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		// out is backed by buf already, this merely sets its length
+		buf.Write(out)
+		return buf, nil
+	}
+	putBuffer(buf)
+	return nil, fmt.Errorf("%w %d", ErrUnsupportedCompression, c)
+}
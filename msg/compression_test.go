@@ -0,0 +1,157 @@
+package msg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCreateDecodeCompressedMsg(t *testing.T) {
+	metrics := getMetricData(100)
+	for _, version := range []Format{FormatMetricDataArrayJson, FormatMetricDataArrayMsgp} {
+		plain, err := CreateMsg(metrics, 1234567890, version)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+			data, err := CreateMsg(metrics, 1234567890, version.Compressed(c))
+			if err != nil {
+				t.Fatalf("%s %s: %s", version, c, err.Error())
+			}
+			if c != CompressionNone && len(data) >= len(plain) {
+				t.Fatalf("%s %s: expected compressed message to be smaller than %d bytes, got %d", version, c, len(plain), len(data))
+			}
+			// decode a few times to exercise the pools
+			for i := 0; i < 3; i++ {
+				var m MetricData
+				err = m.InitFromMsg(data)
+				if err != nil {
+					t.Fatalf("%s %s: %s", version, c, err.Error())
+				}
+				if m.Format != version || m.Compression != c || m.Id != 1234567890 {
+					t.Fatalf("%s %s: got format %s, compression %s, id %d", version, c, m.Format, m.Compression, m.Id)
+				}
+				err = m.DecodeMetricData()
+				if err != nil {
+					t.Fatalf("%s %s: %s", version, c, err.Error())
+				}
+				if !reflect.DeepEqual(metrics, m.Metrics) {
+					t.Fatalf("%s %s: metrics mismatch after decoding", version, c)
+				}
+			}
+		}
+	}
+}
+
+func TestFormatCompressed(t *testing.T) {
+	f := FormatMetricDataArrayMsgp.Compressed(CompressionSnappy)
+	if f.Base() != FormatMetricDataArrayMsgp {
+		t.Fatalf("expected base format %s, got %s", FormatMetricDataArrayMsgp, f.Base())
+	}
+	if f.Compression() != CompressionSnappy {
+		t.Fatalf("expected compression %s, got %s", CompressionSnappy, f.Compression())
+	}
+	if FormatMetricDataArrayMsgp.Compressed(CompressionNone) != FormatMetricDataArrayMsgp {
+		t.Fatal("expected uncompressed format to be unchanged")
+	}
+	if f.Compressed(CompressionNone) != FormatMetricDataArrayMsgp {
+		t.Fatal("expected compression to be cleared")
+	}
+}
+
+func TestInvalidCompressedMsg(t *testing.T) {
+	metrics := getMetricData(10)
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy} {
+		data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.Compressed(c))
+		if err != nil {
+			t.Fatalf("%s: %s", c, err.Error())
+		}
+		data = data[:len(data)-5]
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err.Error())
+		}
+		if err = m.DecodeMetricData(); err == nil {
+			t.Fatalf("%s: expected error decoding truncated message, got nil", c)
+		}
+	}
+
+	// a snappy body claiming to decode to 4GB
+	if _, err := decompress([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, CompressionSnappy); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("expected ErrInvalidSize for bogus snappy length, got %v", err)
+	}
+	// a snappy body claiming just over the max, which is within the ratio for its size
+	body := binary.AppendUvarint(nil, maxDecompressedSize+1)
+	body = append(body, make([]byte, (maxDecompressedSize+1)/maxSnappyRatio)...)
+	if _, err := decompress(body, CompressionSnappy); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("expected ErrInvalidSize for a snappy length over the max, got %v", err)
+	}
+
+	// a gzip body of zeroes that decompresses to just over the max
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := zw.Write(make([]byte, maxDecompressedSize+1)); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if _, err := decompress(buf.Bytes(), CompressionGzip); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("expected ErrInvalidSize for a gzip body of %d bytes decompressing to %d, got %v", buf.Len(), maxDecompressedSize+1, err)
+	}
+
+	data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	data[0] = byte(FormatMetricDataArrayMsgp.Compressed(3))
+	var m MetricData
+	if err = m.InitFromMsg(data); err == nil {
+		t.Fatal("expected error for unsupported compression, got nil")
+	}
+	if _, err = CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.Compressed(3)); err == nil {
+		t.Fatal("expected error for unsupported compression, got nil")
+	}
+}
+
+func BenchmarkDecodeSnappyMsgp(b *testing.B) {
+	metrics := getMetricData(1000)
+	data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.Compressed(CompressionSnappy))
+	if err != nil {
+		b.Fatalf("%s", err.Error())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var m MetricData
+	for i := 0; i < b.N; i++ {
+		err = m.InitFromMsg(data)
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+	}
+}
+
+// FuzzDecompress checks that decompress rejects arbitrary input without panicking
+func FuzzDecompress(f *testing.F) {
+	body, _ := msgpCodec{}.EncodeMetricData(nil, getMetricData(3))
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy} {
+		buf := getBuffer()
+		compress(buf, body, c)
+		f.Add(uint8(c), append([]byte(nil), buf.Bytes()...))
+		putBuffer(buf)
+	}
+	f.Fuzz(func(t *testing.T, c uint8, data []byte) {
+		buf, err := decompress(data, Compression(c))
+		if err == nil {
+			putBuffer(buf)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package msg
+
+import (
+	"github.com/raintank/schema"
+)
+
+// Handler processes the contents of messages decoded by Decode
+type Handler interface {
+	// HandleMetricData is called once for every message carrying a batch of MetricData,
+	// with md.Metrics decoded.
+	HandleMetricData(md *MetricData) error
+	// HandlePoint is called for every point in a message carrying MetricPoints.
+	// format is the format of the message the point came from.
+	HandlePoint(format Format, point schema.MetricPoint) error
+}
+
+// DefinitionHandler is implemented by Handlers that also process messages carrying MetricDefinitions.
+// Decode returns an error for such messages if the Handler does not implement it.
+type DefinitionHandler interface {
+	// HandleMetricDefinitions is called once for every message carrying a batch of MetricDefinition,
+	// with md.Defs decoded.
+	HandleMetricDefinitions(md *MetricDefinitions) error
+}
+
+// TombstoneHandler is implemented by Handlers that also process tombstone messages.
+// Decode returns an error for such messages if the Handler does not implement it.
+type TombstoneHandler interface {
+	// HandleTombstone is called once for every tombstone message, with tm.Tombstone decoded.
+	HandleTombstone(tm *TombstoneMsg) error
+}
+
+// HandlerFuncs is a Handler that calls the respective function, if set.
+type HandlerFuncs struct {
+	MetricData  func(md *MetricData) error
+	Point       func(format Format, point schema.MetricPoint) error
+	Definitions func(md *MetricDefinitions) error
+	Tombstone   func(tm *TombstoneMsg) error
+}
+
+func (h HandlerFuncs) HandleMetricData(md *MetricData) error {
+	if h.MetricData == nil {
+		return nil
+	}
+	return h.MetricData(md)
+}
+
+func (h HandlerFuncs) HandlePoint(format Format, point schema.MetricPoint) error {
+	if h.Point == nil {
+		return nil
+	}
+	return h.Point(format, point)
+}
+
+func (h HandlerFuncs) HandleMetricDefinitions(md *MetricDefinitions) error {
+	if h.Definitions == nil {
+		return nil
+	}
+	return h.Definitions(md)
+}
+
+func (h HandlerFuncs) HandleTombstone(tm *TombstoneMsg) error {
+	if h.Tombstone == nil {
+		return nil
+	}
+	return h.Tombstone(tm)
+}
+
+// Decode decodes a message of any known format and passes its contents to h.
+// defaultOrg is used as the org of points in formats that don't carry one.
+// Any error returned by h aborts decoding and is returned as is.
+func Decode(data []byte, defaultOrg uint32, h Handler) error {
+	if len(data) == 0 {
+		return decodeError(0, "", -1, ErrTooSmall)
+	}
+	version := Format(data[0])
+
+	if _, ok := lookupPointCodec(version); ok {
+		_, point, err := ReadPointMsg(data, defaultOrg)
+		if err != nil {
+			return err
+		}
+		return h.HandlePoint(version, point)
+	}
+
+	if _, ok := pointSize(version); ok {
+		it, err := NewPointArrayIter(data, defaultOrg)
+		if err != nil {
+			return err
+		}
+		for it.Next() {
+			err = h.HandlePoint(version, it.Point())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if version == FormatMetricPointArrayXor {
+		points, err := ReadPointArrayXorMsg(data, nil)
+		if err != nil {
+			return err
+		}
+		for _, point := range points {
+			err = h.HandlePoint(version, point)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, ok := lookupMetricDataCodec(version); ok {
+		md := &MetricData{}
+		err := md.InitFromMsg(data)
+		if err != nil {
+			return err
+		}
+		err = md.DecodeMetricData()
+		if err != nil {
+			return err
+		}
+		return h.HandleMetricData(md)
+	}
+
+	if _, ok := lookupMetricDefinitionCodec(version); ok {
+		dh, ok := h.(DefinitionHandler)
+		if !ok {
+			return decodeError(version, "format", 0, ErrUnhandledFormat)
+		}
+		md := &MetricDefinitions{}
+		err := md.InitFromMsg(data)
+		if err != nil {
+			return err
+		}
+		err = md.DecodeMetricDefinitions()
+		if err != nil {
+			return err
+		}
+		return dh.HandleMetricDefinitions(md)
+	}
+
+	if version.Base() == FormatTombstone {
+		th, ok := h.(TombstoneHandler)
+		if !ok {
+			return decodeError(version, "format", 0, ErrUnhandledFormat)
+		}
+		tm := &TombstoneMsg{}
+		err := tm.InitFromMsg(data)
+		if err != nil {
+			return err
+		}
+		err = tm.DecodeTombstone()
+		if err != nil {
+			return err
+		}
+		return th.HandleTombstone(tm)
+	}
+
+	return decodeError(version, "format", 0, ErrUnsupportedFormat)
+}
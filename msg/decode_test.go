@@ -0,0 +1,195 @@
+package msg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+// collector is a Handler that keeps everything it is handed
+type collector struct {
+	metrics []*schema.MetricData
+	ids     []int64
+	formats []Format
+	points  []schema.MetricPoint
+}
+
+func (c *collector) HandleMetricData(md *MetricData) error {
+	c.metrics = append(c.metrics, md.Metrics...)
+	c.ids = append(c.ids, md.Id)
+	return nil
+}
+
+func (c *collector) HandlePoint(format Format, point schema.MetricPoint) error {
+	c.formats = append(c.formats, format)
+	c.points = append(c.points, point)
+	return nil
+}
+
+func TestDecodeMetricData(t *testing.T) {
+	metrics := getMetricData(10)
+	for _, version := range []Format{
+		FormatMetricDataArrayJson,
+		FormatMetricDataArrayMsgp,
+		FormatMetricDataArrayMsgp.Compressed(CompressionGzip).WithChecksum(),
+	} {
+		data, err := CreateMsg(metrics, 1234567890, version)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		var c collector
+		err = Decode(data, 6, &c)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if !reflect.DeepEqual(metrics, c.metrics) {
+			t.Fatalf("%d: metrics mismatch after decoding", version)
+		}
+		if !reflect.DeepEqual([]int64{1234567890}, c.ids) || len(c.points) != 0 {
+			t.Fatalf("%d: expected a single batch with id 1234567890 and no points, got ids %v and %d points", version, c.ids, len(c.points))
+		}
+	}
+}
+
+func TestDecodePoints(t *testing.T) {
+	points := getPoints(3, 123)
+	withDefaultOrg := getPoints(3, 6)
+
+	type testCase struct {
+		format    Format
+		data      []byte
+		expPoints []schema.MetricPoint
+	}
+	var cases []testCase
+
+	for _, version := range []Format{FormatMetricPoint, FormatMetricPointWithoutOrg} {
+		data, err := WritePointMsg(points[0], make([]byte, 0, 33), version)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		exp := points[:1]
+		if version == FormatMetricPointWithoutOrg {
+			exp = withDefaultOrg[:1]
+		}
+		cases = append(cases, testCase{version, data, exp})
+	}
+	for _, version := range []Format{FormatMetricPointArray, FormatMetricPointArrayWithoutOrg} {
+		data, err := WritePointArrayMsg(points, nil, version)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		exp := points
+		if version == FormatMetricPointArrayWithoutOrg {
+			exp = withDefaultOrg
+		}
+		cases = append(cases, testCase{version, data, exp})
+	}
+
+	for _, tc := range cases {
+		var c collector
+		err := Decode(tc.data, 6, &c)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.format, err.Error())
+		}
+		if !reflect.DeepEqual(tc.expPoints, c.points) {
+			t.Fatalf("%s: expected points %v, got %v", tc.format, tc.expPoints, c.points)
+		}
+		for _, f := range c.formats {
+			if f != tc.format {
+				t.Fatalf("%s: handler was passed format %s", tc.format, f)
+			}
+		}
+		if len(c.metrics) != 0 {
+			t.Fatalf("%s: expected no metrics, got %d", tc.format, len(c.metrics))
+		}
+	}
+}
+
+func TestDecodeHandlerError(t *testing.T) {
+	data, err := WritePointArrayMsg(getPoints(3, 123), nil, FormatMetricPointArray)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	errStop := errors.New("stop")
+	var seen int
+	h := HandlerFuncs{
+		Point: func(format Format, point schema.MetricPoint) error {
+			seen++
+			return errStop
+		},
+	}
+	err = Decode(data, 6, h)
+	if err != errStop {
+		t.Fatalf("expected errStop, got %v", err)
+	}
+	if seen != 1 {
+		t.Fatalf("expected handler to be called once, got %d", seen)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{byte(FormatMetricPoint), 1, 2, 3},
+		{byte(FormatMetricPointArray), 1, 0, 0, 0},
+		{byte(FormatMetricDataArrayMsgp), 1},
+		{20, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	for i, data := range cases {
+		if err := Decode(data, 6, HandlerFuncs{}); err == nil {
+			t.Fatalf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+// FuzzDecode checks that Decode rejects arbitrary input without panicking
+func FuzzDecode(f *testing.F) {
+	metrics := getMetricData(3)
+	defs := getMetricDefinitions(3)
+	for _, version := range []Format{
+		FormatMetricDataArrayJson,
+		FormatMetricDataArrayMsgp,
+		FormatMetricDataArrayDict,
+		FormatMetricDataArrayMsgp.Compressed(CompressionGzip),
+		FormatMetricDataArrayMsgp.Compressed(CompressionSnappy).WithChecksum(),
+	} {
+		data, _ := CreateMsg(metrics, 1234567890, version)
+		f.Add(data)
+	}
+	data, _ := CreateMsgWithHeaders(metrics, 1234567890, FormatMetricDataArrayMsgp, getHeaders())
+	f.Add(data)
+	for _, version := range []Format{FormatMetricDefinitionArrayJson, FormatMetricDefinitionArrayMsgp} {
+		data, _ := CreateMetricDefinitionMsg(defs, 1234567890, version)
+		f.Add(data)
+	}
+	data, _ = CreateTombstoneMsg(getTombstone(), 1234567890, FormatTombstone)
+	f.Add(data)
+	points := getPoints(3, 123)
+	for _, version := range []Format{FormatMetricPoint, FormatMetricPointWithoutOrg} {
+		data, _ := WritePointMsg(points[0], make([]byte, 0, 33), version)
+		f.Add(data)
+	}
+	for _, version := range []Format{FormatMetricPointArray, FormatMetricPointArrayWithoutOrg, FormatMetricPointArrayOrg} {
+		data, _ := WritePointArrayMsg(points, nil, version)
+		f.Add(data)
+	}
+	f.Add(WritePointArrayXorMsg(getSeriesPoints(2, 5), nil))
+
+	h := HandlerFuncs{
+		MetricData:  func(md *MetricData) error { return nil },
+		Point:       func(format Format, point schema.MetricPoint) error { return nil },
+		Definitions: func(md *MetricDefinitions) error { return nil },
+		Tombstone:   func(tm *TombstoneMsg) error { return nil },
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := Decode(data, 6, h)
+		if err != nil {
+			var merr *Error
+			if !errors.As(err, &merr) {
+				t.Fatalf("expected a *msg.Error, got %T: %s", err, err.Error())
+			}
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package msg
+
+import (
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+// MetricDefinitions is the MetricDefinition counterpart of MetricData:
+// it holds a message carrying a batch of MetricDefinition, typically used
+// to replicate index updates between nodes.
+type MetricDefinitions struct {
+	Id          int64
+	Defs        []*schema.MetricDefinition
+	Produced    time.Time
+	Format      Format
+	Compression Compression
+	Headers     Headers
+	Msg         []byte
+}
+
+// parses format and id (cheap), but doesn't decode definitions (expensive) just yet.
+// for messages using the checksummed envelope, it also verifies the checksum of the body
+// and returns an Error caused by a ChecksumError on mismatch.
+func (m *MetricDefinitions) InitFromMsg(msg []byte) error {
+	if len(msg) < envelopeV0HeaderSize {
+		return decodeError(0, "", -1, ErrTooSmall)
+	}
+	m.Msg = msg
+
+	m.Format = Format(msg[0]).Base()
+	m.Compression = Format(msg[0]).Compression()
+	if _, ok := lookupMetricDefinitionCodec(m.Format); !ok {
+		return decodeError(Format(msg[0]), "format", 0, ErrUnsupportedFormat)
+	}
+
+	var err error
+	m.Id, m.Headers, err = initEnvelope(msg)
+	m.Produced = time.Unix(0, m.Id)
+	return err
+}
+
+// sets m.Defs to a []*schema.MetricDefinition
+// any subsequent call may however put different MetricDefinition into our m.Defs array
+func (m *MetricDefinitions) DecodeMetricDefinitions() error {
+	codec, ok := lookupMetricDefinitionCodec(m.Format)
+	if !ok {
+		return decodeError(m.Format, "format", 0, ErrUnsupportedFormat)
+	}
+	body, buf, err := openBody(m.Msg)
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		defer putBuffer(buf)
+	}
+
+	m.Defs, err = codec.DecodeMetricDefinitions(body, m.Defs)
+	if err != nil {
+		return decodeError(Format(m.Msg[0]), "body", -1, err)
+	}
+	m.Msg = nil // no more need for the original input
+	return nil
+}
+
+// CreateMetricDefinitionMsg is like CreateMsg, but for MetricDefinition.
+// version must be FormatMetricDefinitionArrayJson or FormatMetricDefinitionArrayMsgp,
+// optionally with compression and/or the checksummed envelope.
+func CreateMetricDefinitionMsg(defs []*schema.MetricDefinition, id int64, version Format) ([]byte, error) {
+	codec, ok := lookupMetricDefinitionCodec(version)
+	if !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
+	return writeMsg(version, id, nil, func(b []byte) ([]byte, error) {
+		return codec.EncodeMetricDefinitions(b, defs)
+	})
+}
@@ -0,0 +1,120 @@
+package msg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func getMetricDefinitions(amount int) []*schema.MetricDefinition {
+	metrics := getMetricData(amount)
+	out := make([]*schema.MetricDefinition, amount)
+	for i, md := range metrics {
+		out[i] = schema.MetricDefinitionFromMetricData(md)
+		out[i].Partition = int32(i % 8)
+	}
+	return out
+}
+
+func TestCreateDecodeMetricDefinitionMsg(t *testing.T) {
+	defs := getMetricDefinitions(10)
+	for _, version := range []Format{
+		FormatMetricDefinitionArrayJson,
+		FormatMetricDefinitionArrayMsgp,
+		FormatMetricDefinitionArrayMsgp.Compressed(CompressionSnappy).WithChecksum(),
+	} {
+		data, err := CreateMetricDefinitionMsg(defs, 1234567890, version)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		var m MetricDefinitions
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if m.Id != 1234567890 || m.Format != version.Base() || m.Compression != version.Compression() {
+			t.Fatalf("%d: got id %d, format %s, compression %s", version, m.Id, m.Format, m.Compression)
+		}
+		// decode twice to make sure re-using m.Defs works
+		for i := 0; i < 2; i++ {
+			m.Msg = data
+			err = m.DecodeMetricDefinitions()
+			if err != nil {
+				t.Fatalf("%d: %s", version, err.Error())
+			}
+			if !reflect.DeepEqual(defs, m.Defs) {
+				t.Fatalf("%d: expected definitions %v, got %v", version, defs, m.Defs)
+			}
+		}
+	}
+}
+
+func TestMetricDefinitionMsgFormats(t *testing.T) {
+	defs := getMetricDefinitions(1)
+	metrics := getMetricData(1)
+
+	// MetricData and MetricDefinition formats can't be mixed up
+	if _, err := CreateMetricDefinitionMsg(defs, 1, FormatMetricDataArrayMsgp); err == nil {
+		t.Fatal("expected error creating definitions message with a MetricData format, got nil")
+	}
+	if _, err := CreateMsg(metrics, 1, FormatMetricDefinitionArrayMsgp); err == nil {
+		t.Fatal("expected error creating MetricData message with a definitions format, got nil")
+	}
+	data, err := CreateMetricDefinitionMsg(defs, 1, FormatMetricDefinitionArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var md MetricData
+	if err = md.InitFromMsg(data); err == nil {
+		t.Fatal("expected error initializing MetricData from definitions message, got nil")
+	}
+}
+
+func TestDecodeMetricDefinitions(t *testing.T) {
+	defs := getMetricDefinitions(10)
+	data, err := CreateMetricDefinitionMsg(defs, 1234567890, FormatMetricDefinitionArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var got []*schema.MetricDefinition
+	h := HandlerFuncs{
+		Definitions: func(md *MetricDefinitions) error {
+			got = append(got, md.Defs...)
+			return nil
+		},
+	}
+	err = Decode(data, 6, h)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(defs, got) {
+		t.Fatalf("expected definitions %v, got %v", defs, got)
+	}
+
+	// collector does not implement DefinitionHandler
+	if err = Decode(data, 6, &collector{}); err == nil {
+		t.Fatal("expected error decoding definitions with a Handler that can't handle them, got nil")
+	}
+}
+
+func TestDecodeMetricDefinitionsInvalid(t *testing.T) {
+	defs := getMetricDefinitions(10)
+	data, err := CreateMetricDefinitionMsg(defs, 1234567890, FormatMetricDefinitionArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// claim a huge number of definitions
+	bogus := append([]byte{}, data[:envelopeV0HeaderSize]...)
+	bogus = append(bogus, 0xdd, 0xff, 0xff, 0xff, 0xff)
+	for i, c := range [][]byte{data[:len(data)-10], bogus} {
+		var m MetricDefinitions
+		err = m.InitFromMsg(c)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+		if err = m.DecodeMetricDefinitions(); err == nil {
+			t.Fatalf("case %d: expected error, got nil", i)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/raintank/schema"
+)
+
+var ErrInvalidDict = errors.New("invalid dictionary encoded message")
+
+// when decoding, tag slices are allocated in blocks of this many tags
+const dictTagsBlockSize = 256
+
+// dictMinMetricSize is the minimum size of an encoded metric: a byte for every varint and ref, and 8 for the value
+const dictMinMetricSize = 16
+
+// dictCodec implements FormatMetricDataArrayDict.
+// Names, units, mtypes and tags tend to be heavily repeated within a batch, so rather than
+// encoding them for every metric, they are stored once in a string table and referenced by index.
+// Decoding yields metrics that share the strings of the table.
+//
+// The body is laid out as follows (varints as per encoding/binary):
+// uvarint number of strings in the table
+// per string: uvarint length, bytes
+// uvarint number of metrics
+// followed by the metrics, each consisting of:
+// uvarint length of Id, Id
+// varint OrgId
+// uvarint Name ref
+// varint Interval
+// 8B Value (float64 bits, little endian)
+// uvarint Unit ref
+// varint Time
+// uvarint Mtype ref
+// uvarint number of tags, followed by a uvarint ref per tag
+type dictCodec struct{}
+
+func (dictCodec) Name() string {
+	return "dict"
+}
+
+// dictTable assigns indexes to strings
+type dictTable struct {
+	refs    map[string]uint64
+	strings []string
+}
+
+func (d *dictTable) add(s string) {
+	if _, ok := d.refs[s]; !ok {
+		d.refs[s] = uint64(len(d.strings))
+		d.strings = append(d.strings, s)
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func (dictCodec) EncodeMetricData(b []byte, metrics []*schema.MetricData) ([]byte, error) {
+	d := dictTable{
+		refs: make(map[string]uint64),
+	}
+	for _, m := range metrics {
+		d.add(m.Name)
+		d.add(m.Unit)
+		d.add(m.Mtype)
+		for _, t := range m.Tags {
+			d.add(t)
+		}
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(d.strings)))
+	for _, s := range d.strings {
+		b = appendString(b, s)
+	}
+	b = binary.AppendUvarint(b, uint64(len(metrics)))
+	for _, m := range metrics {
+		b = appendString(b, m.Id)
+		b = binary.AppendVarint(b, int64(m.OrgId))
+		b = binary.AppendUvarint(b, d.refs[m.Name])
+		b = binary.AppendVarint(b, int64(m.Interval))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(m.Value))
+		b = binary.AppendUvarint(b, d.refs[m.Unit])
+		b = binary.AppendVarint(b, m.Time)
+		b = binary.AppendUvarint(b, d.refs[m.Mtype])
+		b = binary.AppendUvarint(b, uint64(len(m.Tags)))
+		for _, t := range m.Tags {
+			b = binary.AppendUvarint(b, d.refs[t])
+		}
+	}
+	return b, nil
+}
+
+// dictReader reads the elements of a dictionary encoded body
+type dictReader struct {
+	b       []byte
+	strings []string
+	err     error
+}
+
+func (r *dictReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = ErrInvalidDict
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *dictReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ErrInvalidDict
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *dictReader) float64() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 8 {
+		r.err = ErrInvalidDict
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *dictReader) string() string {
+	l := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.b)) < l {
+		r.err = ErrInvalidDict
+		return ""
+	}
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+	return s
+}
+
+// skip skips over a string
+func (r *dictReader) skip() {
+	l := r.uvarint()
+	if r.err == nil && uint64(len(r.b)) < l {
+		r.err = ErrInvalidDict
+	}
+	if r.err != nil {
+		return
+	}
+	r.b = r.b[l:]
+}
+
+// ref returns the string from the table referenced by the next uvarint
+func (r *dictReader) ref() string {
+	i := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if i >= uint64(len(r.strings)) {
+		r.err = ErrInvalidDict
+		return ""
+	}
+	return r.strings[i]
+}
+
+// count reads a number of elements that each take at least size bytes, and validates it against the remaining data
+func (r *dictReader) count(size int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.b)/size) {
+		r.err = ErrInvalidDict
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (dictCodec) DecodeMetricData(body []byte, metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	r := dictReader{
+		b: body,
+	}
+	numStrings := r.count(1)
+	r.strings = make([]string, numStrings)
+	for i := range r.strings {
+		r.strings[i] = r.string()
+	}
+	numMetrics := r.count(dictMinMetricSize)
+	if r.err != nil {
+		return metrics[:0], r.err
+	}
+
+	if cap(metrics) >= numMetrics {
+		metrics = metrics[:numMetrics]
+	} else {
+		metrics = make([]*schema.MetricData, numMetrics)
+	}
+	// allocate all new metrics, and all tags, in one go
+	var block []schema.MetricData
+	var tags []string
+	for i, m := range metrics {
+		if m == nil {
+			if block == nil {
+				block = make([]schema.MetricData, numMetrics-i)
+			}
+			m = &block[0]
+			block = block[1:]
+			metrics[i] = m
+		}
+		m.Id = r.string()
+		m.OrgId = int(r.varint())
+		m.Name = r.ref()
+		m.Interval = int(r.varint())
+		m.Value = r.float64()
+		m.Unit = r.ref()
+		m.Time = r.varint()
+		m.Mtype = r.ref()
+		numTags := r.count(1)
+		if r.err != nil {
+			return metrics[:i], r.err
+		}
+		if numTags == 0 {
+			// like the other codecs, and regardless of the state of the block
+			m.Tags = nil
+			continue
+		}
+		if len(tags) < numTags {
+			tags = make([]string, numTags+dictTagsBlockSize)
+		}
+		m.Tags = tags[:numTags:numTags]
+		tags = tags[numTags:]
+		for j := range m.Tags {
+			m.Tags[j] = r.ref()
+		}
+		if r.err != nil {
+			return metrics[:i], r.err
+		}
+	}
+	if len(r.b) != 0 {
+		return metrics, ErrInvalidDict
+	}
+	return metrics, nil
+}
@@ -0,0 +1,178 @@
+package msg
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/raintank/schema"
+)
+
+func TestCreateDecodeDictMsg(t *testing.T) {
+	for _, amount := range []int{0, 1, 10, 1000} {
+		metrics := getMetricData(amount)
+		data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayDict)
+		if err != nil {
+			t.Fatalf("%d metrics: %s", amount, err.Error())
+		}
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%d metrics: %s", amount, err.Error())
+		}
+		if m.Format != FormatMetricDataArrayDict {
+			t.Fatalf("%d metrics: expected format %s, got %s", amount, FormatMetricDataArrayDict, m.Format)
+		}
+		// decode twice to make sure re-using m.Metrics works
+		for i := 0; i < 2; i++ {
+			m.Msg = data
+			err = m.DecodeMetricData()
+			if err != nil {
+				t.Fatalf("%d metrics: %s", amount, err.Error())
+			}
+			if len(m.Metrics) != amount {
+				t.Fatalf("%d metrics: got %d metrics", amount, len(m.Metrics))
+			}
+			for j := range metrics {
+				if !reflect.DeepEqual(metrics[j], m.Metrics[j]) {
+					t.Fatalf("%d metrics: metric %d: expected %v, got %v", amount, j, metrics[j], m.Metrics[j])
+				}
+			}
+		}
+	}
+}
+
+func TestDictMsgSmaller(t *testing.T) {
+	metrics := getMetricData(1000)
+	msgp, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	dict, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayDict)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(dict) >= len(msgp)*2/3 {
+		t.Fatalf("expected dict encoding to be less than 2/3 of msgp's %d bytes, got %d", len(msgp), len(dict))
+	}
+}
+
+func TestDictMsgInterned(t *testing.T) {
+	metrics := getMetricData(10)
+	body, err := dictCodec{}.EncodeMetricData(nil, metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	out, err := dictCodec{}.DecodeMetricData(body, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	getAddress := func(s string) uintptr {
+		return uintptr(unsafe.Pointer(unsafe.StringData(s)))
+	}
+	for i := 1; i < len(out); i++ {
+		if getAddress(out[i].Unit) != getAddress(out[0].Unit) || getAddress(out[i].Mtype) != getAddress(out[0].Mtype) {
+			t.Fatalf("metric %d: expected unit and mtype to be shared with metric 0", i)
+		}
+		// tags are sorted by SetId
+		if out[i].Tags[1] != "foo=bar" || getAddress(out[i].Tags[1]) != getAddress(out[0].Tags[1]) {
+			t.Fatalf("metric %d: expected tag %q to be shared with metric 0", i, out[i].Tags[1])
+		}
+	}
+}
+
+func TestDictMsgInvalid(t *testing.T) {
+	metrics := getMetricData(10)
+	body, err := dictCodec{}.EncodeMetricData(nil, metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cases := [][]byte{
+		body[:len(body)-1],
+		append(body[:len(body):len(body)], 0),
+		{0x01, 0x03, 'f', 'o', 'o', 0x01, 0x00, 0x02, 0x05},                   // a ref beyond the string table
+		{0xff, 0xff, 0xff, 0xff, 0x0f},                                        // a huge string table
+		{0x00, 0xff, 0xff, 0xff, 0xff, 0x0f},                                  // a huge number of metrics
+		append([]byte{0x00, 0x20}, make([]byte, 0x20*dictMinMetricSize-1)...), // more metrics than fit in the data
+	}
+	for i, c := range cases {
+		if _, err := (dictCodec{}).DecodeMetricData(c, nil); err == nil {
+			t.Fatalf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestDictMsgNoTags(t *testing.T) {
+	metrics := getMetricData(3)
+	metrics[1].Tags = nil
+	metrics[2].Tags = []string{}
+	body, err := dictCodec{}.EncodeMetricData(nil, metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// decode into metrics that have tags, with and without a partially used block of tags
+	for _, reuse := range [][]*schema.MetricData{nil, getMetricData(3), getMetricData(1)} {
+		got, err := dictCodec{}.DecodeMetricData(body, reuse)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if got[0].Tags == nil || got[1].Tags != nil || got[2].Tags != nil {
+			t.Fatalf("expected nil tags for metrics without tags, got %#v, %#v and %#v", got[0].Tags, got[1].Tags, got[2].Tags)
+		}
+	}
+}
+
+func BenchmarkDecodeDict(b *testing.B) {
+	benchmarkDecode(b, FormatMetricDataArrayDict)
+}
+
+func BenchmarkDecodeMsgp(b *testing.B) {
+	benchmarkDecode(b, FormatMetricDataArrayMsgp)
+}
+
+func benchmarkDecode(b *testing.B, version Format) {
+	metrics := getMetricData(1000)
+	data, err := CreateMsg(metrics, 1234567890, version)
+	if err != nil {
+		b.Fatalf("%s", err.Error())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+	}
+	b.Logf("%d bytes for %d metrics", len(data), len(metrics))
+}
+
+// FuzzDecodeDict checks that the dict codec rejects arbitrary input without panicking,
+// and that whatever it accepts survives a round trip.
+func FuzzDecodeDict(f *testing.F) {
+	var c dictCodec
+	body, _ := c.EncodeMetricData(nil, getMetricData(3))
+	f.Add(body)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := c.DecodeMetricData(data, nil)
+		if err != nil {
+			return
+		}
+		buf, err := c.EncodeMetricData(nil, metrics)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		again, err := c.DecodeMetricData(buf, nil)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if len(again) != len(metrics) {
+			t.Fatalf("expected %d metrics after round trip, got %d", len(metrics), len(again))
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// messages created via CreateMsg come in two envelope versions, as indicated by the format byte:
+//
+// version 0 (legacy):
+// 1B format
+// 8B id (big endian)
+// body
+//
+// version 1 (checksummed):
+// 1B format
+// 1B flags
+// 8B id (big endian)
+// 4B CRC32C (Castagnoli) of everything that follows (big endian)
+// header section (only if flags has envelopeFlagHeaders set, see header.go)
+// body
+const envelopeV0HeaderSize = 9
+const envelopeV1HeaderSize = 14
+
+// envelopeFlagHeaders marks the presence of a header section
+const envelopeFlagHeaders = 0x01
+
+var ErrHeadersNeedChecksum = errors.New("headers require the checksummed envelope")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is the cause of the Error returned when the checksum of a message body does not match
+// the checksum in its envelope, which typically means the message was truncated or corrupted.
+type ChecksumError struct {
+	Expected uint32 // checksum as found in the envelope
+	Actual   uint32 // checksum computed over the body
+	Size     int    // size of the body in bytes
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: envelope has crc32c %08x, but body of %d bytes has crc32c %08x", e.Expected, e.Size, e.Actual)
+}
+
+// headerSize returns the size of the envelope header for the given format byte
+func headerSize(version Format) int {
+	if version.HasChecksum() {
+		return envelopeV1HeaderSize
+	}
+	return envelopeV0HeaderSize
+}
+
+// readEnvelope validates the envelope of msg and returns its id and the data following the
+// fixed size part of the envelope: the header section, if any, and the body
+func readEnvelope(msg []byte) (int64, []byte, error) {
+	if len(msg) < envelopeV0HeaderSize {
+		return 0, nil, decodeError(0, "", -1, ErrTooSmall)
+	}
+	if !Format(msg[0]).HasChecksum() {
+		return int64(binary.BigEndian.Uint64(msg[1:9])), msg[envelopeV0HeaderSize:], nil
+	}
+	if len(msg) < envelopeV1HeaderSize {
+		return 0, nil, decodeError(Format(msg[0]), "envelope", 0, ErrTooSmall)
+	}
+	if msg[1]&^envelopeFlagHeaders != 0 {
+		return 0, nil, decodeError(Format(msg[0]), "envelope", 1, fmt.Errorf("%w %d", ErrUnsupportedFlags, msg[1]))
+	}
+	id := int64(binary.BigEndian.Uint64(msg[2:10]))
+	body := msg[envelopeV1HeaderSize:]
+	expected := binary.BigEndian.Uint32(msg[10:14])
+	actual := crc32.Checksum(body, crc32cTable)
+	if expected != actual {
+		return id, body, decodeError(Format(msg[0]), "body", envelopeV1HeaderSize, ChecksumError{
+			Expected: expected,
+			Actual:   actual,
+			Size:     len(body),
+		})
+	}
+	return id, body, nil
+}
+
+// appendEnvelopeHeader appends the envelope header for the given format byte, id and headers to b.
+// headers require the checksummed envelope.
+// for the checksummed envelope, the checksum must be filled in by sealEnvelope once the body has been appended.
+func appendEnvelopeHeader(b []byte, version Format, id int64, headers Headers) ([]byte, error) {
+	if len(headers) > 0 && !version.HasChecksum() {
+		return b, encodeError(version, "headers", ErrHeadersNeedChecksum)
+	}
+	b = append(b, byte(version))
+	if version.HasChecksum() {
+		var flags byte
+		if len(headers) > 0 {
+			flags |= envelopeFlagHeaders
+		}
+		b = append(b, flags)
+	}
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(id))
+	if version.HasChecksum() {
+		b = append(b, 0, 0, 0, 0)
+	}
+	if len(headers) > 0 {
+		b, err := appendHeaders(b, headers)
+		if err != nil {
+			return b, encodeError(version, "headers", err)
+		}
+		return b, nil
+	}
+	return b, nil
+}
+
+// sealEnvelope computes and sets the checksum of msg, if its envelope has one
+func sealEnvelope(msg []byte) {
+	if Format(msg[0]).HasChecksum() {
+		binary.BigEndian.PutUint32(msg[10:14], crc32.Checksum(msg[envelopeV1HeaderSize:], crc32cTable))
+	}
+}
+
+// initEnvelope validates the envelope of msg, and the compression of its body, and returns its id and headers
+func initEnvelope(msg []byte) (int64, Headers, error) {
+	if c := Format(msg[0]).Compression(); c > CompressionSnappy {
+		return 0, nil, decodeError(Format(msg[0]), "format", 0, fmt.Errorf("%w %d", ErrUnsupportedCompression, c))
+	}
+	id, rest, err := readEnvelope(msg)
+	if err != nil || !hasHeaders(msg) {
+		return id, nil, err
+	}
+	var headers Headers
+	_, err = readHeaders(rest, &headers)
+	if err != nil {
+		return id, nil, decodeError(Format(msg[0]), "headers", envelopeV1HeaderSize, err)
+	}
+	return id, headers, nil
+}
+
+// hasHeaders returns whether msg, which must have a valid envelope, has a header section
+func hasHeaders(msg []byte) bool {
+	return Format(msg[0]).HasChecksum() && msg[1]&envelopeFlagHeaders != 0
+}
+
+// openBody returns the body of msg, decompressed if needed.
+// if the returned buffer is non-nil, body is backed by it and it should be returned via
+// putBuffer once the caller is done with body.
+func openBody(msg []byte) ([]byte, *bytes.Buffer, error) {
+	body := msg[headerSize(Format(msg[0])):]
+	if hasHeaders(msg) {
+		var err error
+		body, err = readHeaders(body, nil)
+		if err != nil {
+			return nil, nil, decodeError(Format(msg[0]), "headers", envelopeV1HeaderSize, err)
+		}
+	}
+	c := Format(msg[0]).Compression()
+	if c == CompressionNone {
+		return body, nil, nil
+	}
+	buf, err := decompress(body, c)
+	if err != nil {
+		return nil, nil, decodeError(Format(msg[0]), "body", len(msg)-len(body), err)
+	}
+	return buf.Bytes(), buf, nil
+}
+
+// writeMsg creates a message of the given format (including envelope and compression flags), id and headers,
+// with a body as produced by encode, which should append the encoded payload to the given slice.
+func writeMsg(version Format, id int64, headers Headers, encode func(b []byte) ([]byte, error)) ([]byte, error) {
+	out, err := appendEnvelopeHeader(nil, version, id, headers)
+	if err != nil {
+		return nil, err
+	}
+	if version.Compression() == CompressionNone {
+		out, err = encode(out)
+		if err != nil {
+			return nil, encodeError(version, "body", err)
+		}
+	} else {
+		var body []byte
+		body, err = encode(nil)
+		if err != nil {
+			return nil, encodeError(version, "body", err)
+		}
+		buf := bytes.NewBuffer(out)
+		err = compress(buf, body, version.Compression())
+		if err != nil {
+			return nil, encodeError(version, "body", err)
+		}
+		out = buf.Bytes()
+	}
+	sealEnvelope(out)
+	return out, nil
+}
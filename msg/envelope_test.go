@@ -0,0 +1,91 @@
+package msg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestChecksummedMsg(t *testing.T) {
+	metrics := getMetricData(10)
+	for _, version := range []Format{
+		FormatMetricDataArrayJson,
+		FormatMetricDataArrayMsgp,
+		FormatMetricDataArrayMsgp.Compressed(CompressionSnappy),
+	} {
+		data, err := CreateMsg(metrics, 1234567890, version.WithChecksum())
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if m.Id != 1234567890 || m.Format != version.Base() || m.Compression != version.Compression() {
+			t.Fatalf("%d: got id %d, format %s, compression %s", version, m.Id, m.Format, m.Compression)
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if !reflect.DeepEqual(metrics, m.Metrics) {
+			t.Fatalf("%d: metrics mismatch after decoding", version)
+		}
+	}
+}
+
+func TestChecksummedMsgCorrupt(t *testing.T) {
+	metrics := getMetricData(10)
+	data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.WithChecksum())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	truncated := data[:len(data)-1]
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)/2] ^= 0xFF
+
+	for i, c := range [][]byte{truncated, corrupted} {
+		var m MetricData
+		err = m.InitFromMsg(c)
+		var cerr ChecksumError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("case %d: expected ChecksumError, got %v", i, err)
+		}
+		if cerr.Size != len(c)-envelopeV1HeaderSize {
+			t.Fatalf("case %d: expected ChecksumError for body of %d bytes, got %d", i, len(c)-envelopeV1HeaderSize, cerr.Size)
+		}
+	}
+
+	var m MetricData
+	if err = m.InitFromMsg(data[:envelopeV1HeaderSize-1]); !errors.Is(err, ErrTooSmall) {
+		t.Fatalf("expected ErrTooSmall, got %v", err)
+	}
+
+	flags := append([]byte{}, data...)
+	flags[1] = 0x80
+	if err = m.InitFromMsg(flags); !errors.Is(err, ErrUnsupportedFlags) {
+		t.Fatalf("expected ErrUnsupportedFlags, got %v", err)
+	}
+}
+
+func TestLegacyEnvelope(t *testing.T) {
+	metrics := getMetricData(10)
+	data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if data[0] != byte(FormatMetricDataArrayMsgp) {
+		t.Fatalf("expected format byte %d, got %d", FormatMetricDataArrayMsgp, data[0])
+	}
+	if headerSize(Format(data[0])) != envelopeV0HeaderSize {
+		t.Fatalf("expected legacy header size %d, got %d", envelopeV0HeaderSize, headerSize(Format(data[0])))
+	}
+	// the legacy envelope has no checksum, so corruption of the body goes unnoticed until decoding
+	data[len(data)/2] ^= 0xFF
+	var m MetricData
+	if err = m.InitFromMsg(data); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,72 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errors that may be the cause of an Error, to be matched using errors.Is.
+// besides these, an Error may be caused by a ChecksumError, or an error of a codec or compression.
+var (
+	ErrTooSmall               = errors.New("too small")
+	ErrInvalidSize            = errors.New("invalid size")
+	ErrUnsupportedFormat      = errors.New("unsupported format")
+	ErrUnhandledFormat        = errors.New("handler does not support format")
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+	ErrUnsupportedFlags       = errors.New("unsupported envelope flags")
+)
+
+// Error is returned by all functions that decode or encode messages, except for errors returned by a Handler.
+// It holds the cause of the problem, and where in the message it was found.
+type Error struct {
+	Op     string // "decode" or "encode"
+	Format Format // the format byte of the message, including envelope and compression flags
+	Field  string // the part of the message that has a problem: "format", "envelope", "headers", "body" or "" for the message as a whole
+	Offset int    // the offset in the message of the problem or of the part that has it, or -1 if not known
+	Err    error  // the cause
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("msg: cannot ")
+	b.WriteString(e.Op)
+	switch e.Field {
+	case "":
+		b.WriteString(" message")
+	case "format":
+		fmt.Fprintf(&b, " message of format %d", uint8(e.Format))
+	default:
+		fmt.Fprintf(&b, " %s of %s message", e.Field, e.Format.Base())
+	}
+	if e.Offset >= 0 {
+		fmt.Fprintf(&b, " at offset %d", e.Offset)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func decodeError(version Format, field string, offset int, err error) error {
+	return &Error{
+		Op:     "decode",
+		Format: version,
+		Field:  field,
+		Offset: offset,
+		Err:    err,
+	}
+}
+
+func encodeError(version Format, field string, err error) error {
+	return &Error{
+		Op:     "encode",
+		Format: version,
+		Field:  field,
+		Offset: -1,
+		Err:    err,
+	}
+}
@@ -0,0 +1,60 @@
+package msg
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	metrics := getMetricData(3)
+	data, err := CreateMsgWithHeaders(metrics, 1234567890, FormatMetricDataArrayMsgp, getHeaders())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	badHeaders := append([]byte{}, data...)
+	badHeaders[envelopeV1HeaderSize] = 0xFF
+	sealEnvelope(badHeaders)
+	xor := WritePointArrayXorMsg(getPoints(2, 123), nil)
+
+	cases := []struct {
+		name   string
+		err    error
+		cause  error
+		op     string
+		format Format
+		field  string
+		offset int
+	}{
+		{"empty", Decode(nil, 6, &collector{}), ErrTooSmall, "decode", 0, "", -1},
+		{"unknown format", Decode([]byte{20, 0, 0, 0, 0, 0, 0, 0, 0}, 6, &collector{}), ErrUnsupportedFormat, "decode", 20, "format", 0},
+		{"unknown compression", Decode([]byte{3 << compressionShift, 0, 0, 0, 0, 0, 0, 0, 0}, 6, &collector{}), ErrUnsupportedCompression, "decode", 3 << compressionShift, "format", 0},
+		{"checksum", Decode(corrupted, 6, &collector{}), nil, "decode", Format(data[0]), "body", envelopeV1HeaderSize},
+		{"headers", Decode(badHeaders, 6, &collector{}), ErrInvalidHeaders, "decode", Format(data[0]), "headers", envelopeV1HeaderSize},
+		{"point size", Decode([]byte{byte(FormatMetricPoint), 0, 0}, 6, &collector{}), ErrInvalidSize, "decode", FormatMetricPoint, "", -1},
+		{"xor body", Decode(xor[:len(xor)-1], 6, &collector{}), ErrInvalidPointArrayXor, "decode", FormatMetricPointArrayXor, "body", len(xor) - 1},
+		{"encode format", func() error { _, err := CreateMsg(metrics, 1, FormatTombstone); return err }(), ErrUnsupportedFormat, "encode", FormatTombstone, "format", -1},
+	}
+	for _, c := range cases {
+		var e *Error
+		if !errors.As(c.err, &e) {
+			t.Fatalf("%s: expected an *Error, got %v", c.name, c.err)
+		}
+		if c.cause != nil && !errors.Is(c.err, c.cause) {
+			t.Fatalf("%s: expected error caused by %q, got %v", c.name, c.cause, c.err)
+		}
+		if e.Op != c.op || e.Format != c.format || e.Field != c.field || e.Offset != c.offset {
+			t.Fatalf("%s: expected op %q, format %d, field %q, offset %d, got %q, %d, %q, %d", c.name, c.op, c.format, c.field, c.offset, e.Op, e.Format, e.Field, e.Offset)
+		}
+	}
+
+	var cerr ChecksumError
+	if !errors.As(cases[3].err, &cerr) {
+		t.Fatalf("expected ChecksumError, got %v", cases[3].err)
+	}
+	exp := "msg: cannot decode body of FormatMetricDataArrayMsgp message at offset 14: " + cerr.Error()
+	if cases[3].err.Error() != exp {
+		t.Fatalf("expected message %q, got %q", exp, cases[3].err.Error())
+	}
+}
@@ -2,6 +2,11 @@ package msg
 
 //go:generate stringer -type=Format
 
+// Format identifies the encoding of a message.
+// the first byte of every message is laid out as follows:
+// bits 0-4: the Format
+// bit 5:    the envelope version (see Format.WithChecksum)
+// bits 6-7: the Compression of the message body (see Format.Compressed)
 type Format uint8
 
 // identifier of message format
@@ -10,4 +15,43 @@ const (
 	FormatMetricDataArrayMsgp
 	FormatMetricPoint
 	FormatMetricPointWithoutOrg
+	FormatMetricPointArray
+	FormatMetricPointArrayWithoutOrg
+	FormatMetricDefinitionArrayJson
+	FormatMetricDefinitionArrayMsgp
+	FormatTombstone
+	FormatMetricDataArrayDict
+	FormatMetricPointArrayOrg
+	FormatMetricPointArrayXor
 )
+
+const formatMask = 0x1F
+const envelopeV1Mask = 0x20
+const compressionShift = 6
+
+// Compressed returns the format byte to pass to CreateMsg to get messages
+// of format f with a body compressed using c.
+func (f Format) Compressed(c Compression) Format {
+	return f&formatMask | Format(c)<<compressionShift
+}
+
+// Compression returns the compression encoded in the format byte f
+func (f Format) Compression() Compression {
+	return Compression(f >> compressionShift)
+}
+
+// WithChecksum returns the format byte to pass to CreateMsg to get messages
+// of format f using the checksummed envelope (see envelope.go)
+func (f Format) WithChecksum() Format {
+	return f | envelopeV1Mask
+}
+
+// HasChecksum returns whether the format byte f denotes the checksummed envelope
+func (f Format) HasChecksum() bool {
+	return f&envelopeV1Mask != 0
+}
+
+// Base returns the Format encoded in the format byte f, without any flags or compression
+func (f Format) Base() Format {
+	return f & formatMask
+}
@@ -4,9 +4,9 @@ package msg
 
 import "strconv"
 
-const _Format_name = "FormatMetricDataArrayJsonFormatMetricDataArrayMsgpFormatMetricPointFormatMetricPointWithoutOrg"
+const _Format_name = "FormatMetricDataArrayJsonFormatMetricDataArrayMsgpFormatMetricPointFormatMetricPointWithoutOrgFormatMetricPointArrayFormatMetricPointArrayWithoutOrgFormatMetricDefinitionArrayJsonFormatMetricDefinitionArrayMsgpFormatTombstoneFormatMetricDataArrayDictFormatMetricPointArrayOrgFormatMetricPointArrayXor"
 
-var _Format_index = [...]uint8{0, 25, 50, 67, 94}
+var _Format_index = [...]uint16{0, 25, 50, 67, 94, 116, 148, 179, 210, 225, 250, 275, 300}
 
 func (i Format) String() string {
 	if i >= Format(len(_Format_index)-1) {
@@ -0,0 +1,162 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+//go:generate stringer -type=HeaderType
+
+// HeaderType is the type of the value of a Header
+type HeaderType uint8
+
+const (
+	HeaderString HeaderType = iota
+	HeaderInt
+	HeaderFloat
+	HeaderBytes
+)
+
+var ErrInvalidHeaders = errors.New("invalid headers")
+var ErrUnsupportedHeaderType = errors.New("unsupported header type")
+
+// Header is a typed key/value pair that can be attached to a message,
+// to carry metadata such as producer name, schema version or trace ids.
+// Use StringHeader, IntHeader, FloatHeader or BytesHeader to create one.
+type Header struct {
+	Key  string
+	Type HeaderType
+	str  string // value of HeaderString and HeaderBytes
+	num  uint64 // value of HeaderInt, and the bits of HeaderFloat
+}
+
+func StringHeader(key, value string) Header {
+	return Header{Key: key, Type: HeaderString, str: value}
+}
+
+func IntHeader(key string, value int64) Header {
+	return Header{Key: key, Type: HeaderInt, num: uint64(value)}
+}
+
+func FloatHeader(key string, value float64) Header {
+	return Header{Key: key, Type: HeaderFloat, num: math.Float64bits(value)}
+}
+
+func BytesHeader(key string, value []byte) Header {
+	return Header{Key: key, Type: HeaderBytes, str: string(value)}
+}
+
+// StringValue returns the value of a HeaderString header
+func (h Header) StringValue() (string, bool) {
+	return h.str, h.Type == HeaderString
+}
+
+// IntValue returns the value of a HeaderInt header
+func (h Header) IntValue() (int64, bool) {
+	return int64(h.num), h.Type == HeaderInt
+}
+
+// FloatValue returns the value of a HeaderFloat header
+func (h Header) FloatValue() (float64, bool) {
+	return math.Float64frombits(h.num), h.Type == HeaderFloat
+}
+
+// BytesValue returns the value of a HeaderBytes header
+func (h Header) BytesValue() ([]byte, bool) {
+	if h.Type != HeaderBytes {
+		return nil, false
+	}
+	return []byte(h.str), true
+}
+
+// Headers is the header section of a message
+type Headers []Header
+
+// Get returns the first header with the given key
+func (hs Headers) Get(key string) (Header, bool) {
+	for _, h := range hs {
+		if h.Key == key {
+			return h, true
+		}
+	}
+	return Header{}, false
+}
+
+// the header section is laid out as follows (varints as per encoding/binary):
+// uvarint number of headers
+// followed by the headers, each consisting of:
+// uvarint length of key, key
+// 1B type
+// the value: uvarint length and bytes for HeaderString and HeaderBytes,
+// varint for HeaderInt, 8B little endian bits for HeaderFloat
+
+// appendHeaders appends the encoded header section to b
+func appendHeaders(b []byte, hs Headers) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(hs)))
+	for _, h := range hs {
+		b = appendString(b, h.Key)
+		b = append(b, byte(h.Type))
+		switch h.Type {
+		case HeaderString, HeaderBytes:
+			b = appendString(b, h.str)
+		case HeaderInt:
+			b = binary.AppendVarint(b, int64(h.num))
+		case HeaderFloat:
+			b = binary.LittleEndian.AppendUint64(b, h.num)
+		default:
+			return b, fmt.Errorf("%w %d", ErrUnsupportedHeaderType, h.Type)
+		}
+	}
+	return b, nil
+}
+
+// readHeaders decodes the header section at the start of b, and returns the headers and the remainder of b.
+// if hs is nil, the headers are merely skipped without allocating.
+func readHeaders(b []byte, hs *Headers) ([]byte, error) {
+	r := dictReader{
+		b: b,
+	}
+	n := r.count(1)
+	if hs != nil {
+		*hs = make(Headers, 0, n)
+	}
+	for i := 0; i < n && r.err == nil; i++ {
+		var h Header
+		if hs != nil {
+			h.Key = r.string()
+		} else {
+			r.skip()
+		}
+		if r.err != nil {
+			break
+		}
+		if len(r.b) == 0 {
+			return b, ErrInvalidHeaders
+		}
+		h.Type = HeaderType(r.b[0])
+		r.b = r.b[1:]
+		switch h.Type {
+		case HeaderString, HeaderBytes:
+			if hs != nil {
+				h.str = r.string()
+			} else {
+				r.skip()
+			}
+		case HeaderInt:
+			h.num = uint64(r.varint())
+		case HeaderFloat:
+			h.num = math.Float64bits(r.float64())
+		default:
+			return b, fmt.Errorf("%w %d", ErrUnsupportedHeaderType, h.Type)
+		}
+		if hs != nil {
+			*hs = append(*hs, h)
+		}
+	}
+	if r.err != nil {
+		return b, ErrInvalidHeaders
+	}
+	return r.b, nil
+}
@@ -0,0 +1,168 @@
+package msg
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func getHeaders() Headers {
+	return Headers{
+		StringHeader("producer", "tsdb-gw"),
+		IntHeader("schema-version", -2),
+		FloatHeader("sample-rate", 0.25),
+		BytesHeader("trace-id", []byte{0, 1, 2, 0xFF}),
+	}
+}
+
+func TestCreateMsgWithHeaders(t *testing.T) {
+	metrics := getMetricData(10)
+	headers := getHeaders()
+	for _, version := range []Format{
+		FormatMetricDataArrayJson,
+		FormatMetricDataArrayMsgp.Compressed(CompressionSnappy),
+		FormatMetricDataArrayDict.Compressed(CompressionGzip).WithChecksum(),
+	} {
+		data, err := CreateMsgWithHeaders(metrics, 1234567890, version, headers)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if m.Id != 1234567890 || m.Format != version.Base() || m.Compression != version.Compression() {
+			t.Fatalf("%d: got id %d, format %s, compression %s", version, m.Id, m.Format, m.Compression)
+		}
+		if !reflect.DeepEqual(headers, m.Headers) {
+			t.Fatalf("%d: expected headers %v, got %v", version, headers, m.Headers)
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			t.Fatalf("%d: %s", version, err.Error())
+		}
+		if !reflect.DeepEqual(metrics, m.Metrics) {
+			t.Fatalf("%d: metrics mismatch after decoding", version)
+		}
+	}
+}
+
+func TestCreateMsgWithoutHeaders(t *testing.T) {
+	metrics := getMetricData(3)
+	exp, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.WithChecksum())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	data, err := CreateMsgWithHeaders(metrics, 1234567890, FormatMetricDataArrayMsgp, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !bytes.Equal(exp, data) {
+		t.Fatal("expected message without headers to be identical to a regular checksummed message")
+	}
+	var m MetricData
+	err = m.InitFromMsg(data)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if m.Headers != nil {
+		t.Fatalf("expected no headers, got %v", m.Headers)
+	}
+}
+
+func TestHeadersGet(t *testing.T) {
+	headers := getHeaders()
+	h, ok := headers.Get("producer")
+	if !ok {
+		t.Fatal("expected header producer to be found")
+	}
+	if v, ok := h.StringValue(); !ok || v != "tsdb-gw" {
+		t.Fatalf("expected string value tsdb-gw, got %q (%t)", v, ok)
+	}
+	if _, ok := h.IntValue(); ok {
+		t.Fatal("expected string header to not have an int value")
+	}
+	h, _ = headers.Get("schema-version")
+	if v, ok := h.IntValue(); !ok || v != -2 {
+		t.Fatalf("expected int value -2, got %d (%t)", v, ok)
+	}
+	h, _ = headers.Get("sample-rate")
+	if v, ok := h.FloatValue(); !ok || v != 0.25 {
+		t.Fatalf("expected float value 0.25, got %f (%t)", v, ok)
+	}
+	h, _ = headers.Get("trace-id")
+	if v, ok := h.BytesValue(); !ok || !bytes.Equal(v, []byte{0, 1, 2, 0xFF}) {
+		t.Fatalf("expected bytes value, got %v (%t)", v, ok)
+	}
+	if _, ok := headers.Get("nope"); ok {
+		t.Fatal("expected header nope to not be found")
+	}
+}
+
+func TestReadHeadersInvalid(t *testing.T) {
+	data, err := appendHeaders(nil, getHeaders())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for l := 0; l < len(data); l++ {
+		var hs Headers
+		if _, err := readHeaders(data[:l], &hs); err == nil {
+			t.Fatalf("expected error reading %d of %d bytes, got nil", l, len(data))
+		}
+		if _, err := readHeaders(data[:l], nil); err == nil {
+			t.Fatalf("expected error skipping %d of %d bytes, got nil", l, len(data))
+		}
+	}
+
+	unknown := Headers{{Key: "foo", Type: HeaderBytes + 1}}
+	if _, err := appendHeaders(nil, unknown); err == nil {
+		t.Fatal("expected error encoding header of unknown type, got nil")
+	}
+	data = []byte{1, 3, 'f', 'o', 'o', byte(HeaderBytes + 1), 0}
+	if _, err := readHeaders(data, nil); err == nil {
+		t.Fatal("expected error reading header of unknown type, got nil")
+	}
+}
+
+func TestHeadersNeedChecksum(t *testing.T) {
+	_, err := writeMsg(FormatMetricDataArrayMsgp, 1, getHeaders(), func(b []byte) ([]byte, error) {
+		return b, nil
+	})
+	if !errors.Is(err, ErrHeadersNeedChecksum) {
+		t.Fatalf("expected ErrHeadersNeedChecksum, got %v", err)
+	}
+}
+
+// FuzzReadHeaders checks that readHeaders rejects arbitrary input without panicking,
+// that reading and skipping headers agree, and that whatever is accepted survives a round trip.
+func FuzzReadHeaders(f *testing.F) {
+	data, _ := appendHeaders(nil, getHeaders())
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var hs Headers
+		rest, err := readHeaders(data, &hs)
+		skipped, skipErr := readHeaders(data, nil)
+		if (err == nil) != (skipErr == nil) {
+			t.Fatalf("reading returned error %v, skipping returned %v", err, skipErr)
+		}
+		if err != nil {
+			return
+		}
+		if len(rest) != len(skipped) {
+			t.Fatalf("reading left %d bytes, skipping left %d", len(rest), len(skipped))
+		}
+		buf, err := appendHeaders(nil, hs)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		var again Headers
+		if _, err := readHeaders(buf, &again); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !reflect.DeepEqual(hs, again) {
+			t.Fatalf("expected %v after round trip, got %v", hs, again)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package msg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lag returns the time elapsed between the production of the message, as derived from its id, and now.
+// it may be negative if the clocks of producer and consumer are not in sync.
+func (m *MetricData) Lag(now time.Time) time.Duration {
+	return now.Sub(m.Produced)
+}
+
+// lag histograms have exponential buckets, the first one holding lags up to 1ms,
+// each next one covering twice the range of the previous one, and a last one for anything
+// over the largest bound (about 17 minutes).
+const lagBuckets = 21
+
+var lagBucketBounds [lagBuckets]time.Duration
+
+func init() {
+	for i := range lagBucketBounds {
+		lagBucketBounds[i] = time.Millisecond << uint(i)
+	}
+}
+
+// LagBucket is a bucket of a LagHistogram
+type LagBucket struct {
+	// UpperBound is the largest lag counted in this bucket. It is 0 for the overflow bucket.
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// LagHistogram aggregates lags. The zero value is ready to use.
+// it is not safe for concurrent use, see LagTracker for that.
+type LagHistogram struct {
+	counts [lagBuckets + 1]uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Observe adds the lag to the histogram. Negative lags, caused by clock skew, are counted as 0.
+func (h *LagHistogram) Observe(lag time.Duration) {
+	if lag < 0 {
+		lag = 0
+	}
+	i := sort.Search(lagBuckets, func(i int) bool {
+		return lagBucketBounds[i] >= lag
+	})
+	h.counts[i]++
+	h.count++
+	h.sum += lag
+	if lag > h.max {
+		h.max = lag
+	}
+}
+
+// Count returns the number of observed lags
+func (h *LagHistogram) Count() uint64 {
+	return h.count
+}
+
+// Sum returns the sum of all observed lags
+func (h *LagHistogram) Sum() time.Duration {
+	return h.sum
+}
+
+// Mean returns the average of all observed lags, or 0 if there are none
+func (h *LagHistogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Max returns the largest observed lag
+func (h *LagHistogram) Max() time.Duration {
+	return h.max
+}
+
+// Quantile returns an upper bound of the q-quantile (0 <= q <= 1) of the observed lags,
+// with the resolution of the buckets. It never exceeds Max.
+func (h *LagHistogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.count))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts[:lagBuckets] {
+		seen += c
+		if seen >= rank {
+			if lagBucketBounds[i] < h.max {
+				return lagBucketBounds[i]
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// Buckets returns the non-empty buckets of the histogram, ordered by bound, with the overflow bucket last
+func (h *LagHistogram) Buckets() []LagBucket {
+	var out []LagBucket
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		b := LagBucket{Count: c}
+		if i < lagBuckets {
+			b.UpperBound = lagBucketBounds[i]
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// Merge adds all observations of o to h
+func (h *LagHistogram) Merge(o *LagHistogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// LagTracker aggregates the lag of consumed messages per Format and per partition.
+// The zero value is ready to use. It is safe for concurrent use.
+type LagTracker struct {
+	mu         sync.Mutex
+	formats    map[Format]*LagHistogram
+	partitions map[int32]*LagHistogram
+}
+
+// NewLagTracker returns a LagTracker without observations
+func NewLagTracker() *LagTracker {
+	return &LagTracker{}
+}
+
+// Observe records the lag of a message of the given format, consumed from the given partition,
+// that was produced at the given time, and returns it.
+// format is reduced to its Base, so that e.g. compressed and uncompressed messages are aggregated together.
+func (t *LagTracker) Observe(format Format, partition int32, produced, now time.Time) time.Duration {
+	lag := now.Sub(produced)
+	format = format.Base()
+	t.mu.Lock()
+	// the maps are created on demand, so that the zero value works, and Reset can simply drop them
+	if t.formats == nil {
+		t.formats = make(map[Format]*LagHistogram)
+		t.partitions = make(map[int32]*LagHistogram)
+	}
+	h, ok := t.formats[format]
+	if !ok {
+		h = &LagHistogram{}
+		t.formats[format] = h
+	}
+	h.Observe(lag)
+	h, ok = t.partitions[partition]
+	if !ok {
+		h = &LagHistogram{}
+		t.partitions[partition] = h
+	}
+	h.Observe(lag)
+	t.mu.Unlock()
+	return lag
+}
+
+// ObserveMsg is like Observe, for a message on which InitFromMsg has been called
+func (t *LagTracker) ObserveMsg(m *MetricData, partition int32, now time.Time) time.Duration {
+	return t.Observe(m.Format, partition, m.Produced, now)
+}
+
+// Format returns a copy of the histogram of the given format
+func (t *LagTracker) Format(format Format) (LagHistogram, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.formats[format.Base()]
+	if !ok {
+		return LagHistogram{}, false
+	}
+	return *h, true
+}
+
+// Partition returns a copy of the histogram of the given partition
+func (t *LagTracker) Partition(partition int32) (LagHistogram, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.partitions[partition]
+	if !ok {
+		return LagHistogram{}, false
+	}
+	return *h, true
+}
+
+// Formats returns the formats for which lags have been observed, in ascending order
+func (t *LagTracker) Formats() []Format {
+	t.mu.Lock()
+	out := make([]Format, 0, len(t.formats))
+	for f := range t.formats {
+		out = append(out, f)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Partitions returns the partitions for which lags have been observed, in ascending order
+func (t *LagTracker) Partitions() []int32 {
+	t.mu.Lock()
+	out := make([]int32, 0, len(t.partitions))
+	for p := range t.partitions {
+		out = append(out, p)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Reset discards all observations
+func (t *LagTracker) Reset() {
+	t.mu.Lock()
+	t.formats = nil
+	t.partitions = nil
+	t.mu.Unlock()
+}
@@ -0,0 +1,153 @@
+package msg
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricDataLag(t *testing.T) {
+	produced := time.Unix(1500000000, 123456789)
+	data, err := CreateMsg(getMetricData(1), produced.UnixNano(), FormatMetricDataArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var m MetricData
+	err = m.InitFromMsg(data)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if lag := m.Lag(produced.Add(1500 * time.Millisecond)); lag != 1500*time.Millisecond {
+		t.Fatalf("expected lag of 1.5s, got %s", lag)
+	}
+	if lag := m.Lag(produced.Add(-time.Second)); lag != -time.Second {
+		t.Fatalf("expected lag of -1s, got %s", lag)
+	}
+}
+
+func TestLagHistogram(t *testing.T) {
+	var h LagHistogram
+	if h.Quantile(0.5) != 0 || h.Mean() != 0 {
+		t.Fatal("expected empty histogram to report 0")
+	}
+	for _, lag := range []time.Duration{
+		-time.Second, // clock skew, counted as 0
+		500 * time.Microsecond,
+		time.Millisecond,
+		3 * time.Millisecond,
+		3 * time.Millisecond,
+		time.Hour,
+	} {
+		h.Observe(lag)
+	}
+	if h.Count() != 6 || h.Max() != time.Hour {
+		t.Fatalf("expected count 6 and max 1h, got %d and %s", h.Count(), h.Max())
+	}
+	exp := time.Hour + 7*time.Millisecond + 500*time.Microsecond
+	if h.Sum() != exp || h.Mean() != exp/6 {
+		t.Fatalf("expected sum %s and mean %s, got %s and %s", exp, exp/6, h.Sum(), h.Mean())
+	}
+	expBuckets := []LagBucket{
+		{time.Millisecond, 3},
+		{4 * time.Millisecond, 2},
+		{0, 1},
+	}
+	if !reflect.DeepEqual(expBuckets, h.Buckets()) {
+		t.Fatalf("expected buckets %v, got %v", expBuckets, h.Buckets())
+	}
+	cases := []struct {
+		q   float64
+		exp time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, time.Millisecond},
+		{0.8, 4 * time.Millisecond},
+		{0.99, 4 * time.Millisecond},
+		{1, time.Hour},
+	}
+	for _, c := range cases {
+		if got := h.Quantile(c.q); got != c.exp {
+			t.Fatalf("quantile %f: expected %s, got %s", c.q, c.exp, got)
+		}
+	}
+
+	var small LagHistogram
+	small.Observe(1500 * time.Microsecond)
+	if got := small.Quantile(1); got != 1500*time.Microsecond {
+		t.Fatalf("expected quantile to not exceed max, got %s", got)
+	}
+	small.Merge(&h)
+	if small.Count() != 7 || small.Max() != time.Hour || small.Sum() != exp+1500*time.Microsecond {
+		t.Fatalf("unexpected histogram after merge: count %d, max %s, sum %s", small.Count(), small.Max(), small.Sum())
+	}
+}
+
+func TestLagTracker(t *testing.T) {
+	tr := NewLagTracker()
+	now := time.Unix(1500000000, 0)
+	var wg sync.WaitGroup
+	for p := int32(0); p < 4; p++ {
+		wg.Add(1)
+		go func(p int32) {
+			for i := 0; i < 100; i++ {
+				tr.Observe(FormatMetricDataArrayMsgp.Compressed(CompressionSnappy), p, now.Add(-time.Duration(p)*time.Second), now)
+				tr.Observe(FormatMetricPointArray, p, now.Add(-time.Millisecond), now)
+			}
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	if !reflect.DeepEqual([]Format{FormatMetricDataArrayMsgp, FormatMetricPointArray}, tr.Formats()) {
+		t.Fatalf("unexpected formats %v", tr.Formats())
+	}
+	if !reflect.DeepEqual([]int32{0, 1, 2, 3}, tr.Partitions()) {
+		t.Fatalf("unexpected partitions %v", tr.Partitions())
+	}
+	h, ok := tr.Format(FormatMetricDataArrayMsgp.WithChecksum())
+	if !ok || h.Count() != 400 || h.Max() != 3*time.Second {
+		t.Fatalf("expected 400 lags up to 3s for msgp, got %d up to %s", h.Count(), h.Max())
+	}
+	h, ok = tr.Partition(2)
+	if !ok || h.Count() != 200 || h.Sum() != 100*(2*time.Second+time.Millisecond) {
+		t.Fatalf("expected 200 lags summing to %s for partition 2, got %d summing to %s", 100*(2*time.Second+time.Millisecond), h.Count(), h.Sum())
+	}
+	if _, ok := tr.Partition(4); ok {
+		t.Fatal("expected no histogram for partition 4")
+	}
+
+	var m MetricData
+	m.Format = FormatMetricDataArrayJson
+	m.Produced = now.Add(-time.Minute)
+	if lag := tr.ObserveMsg(&m, 5, now); lag != time.Minute {
+		t.Fatalf("expected lag of 1m, got %s", lag)
+	}
+	if h, ok := tr.Partition(5); !ok || h.Max() != time.Minute {
+		t.Fatal("expected message to be recorded for partition 5")
+	}
+
+	tr.Reset()
+	if len(tr.Formats()) != 0 || len(tr.Partitions()) != 0 {
+		t.Fatal("expected no histograms after reset")
+	}
+}
+
+func TestLagTrackerZeroValue(t *testing.T) {
+	var tr LagTracker
+	if _, ok := tr.Format(FormatMetricPoint); ok || len(tr.Formats()) != 0 || len(tr.Partitions()) != 0 {
+		t.Fatal("expected no histograms for the zero value")
+	}
+	now := time.Unix(1500000000, 0)
+	if lag := tr.Observe(FormatMetricPoint, 1, now.Add(-time.Second), now); lag != time.Second {
+		t.Fatalf("expected lag of 1s, got %s", lag)
+	}
+	if h, ok := tr.Partition(1); !ok || h.Count() != 1 {
+		t.Fatal("expected the lag to be recorded for partition 1")
+	}
+	tr.Reset()
+	tr.Observe(FormatMetricPoint, 2, now, now)
+	if !reflect.DeepEqual([]int32{2}, tr.Partitions()) {
+		t.Fatalf("expected only partition 2 after reset, got %v", tr.Partitions())
+	}
+}
@@ -1,114 +1,109 @@
 package msg
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
-	"errors"
-	"fmt"
 	"time"
 
 	"github.com/raintank/schema"
 )
 
-var errTooSmall = errors.New("too small")
-var errFmtBinWriteFailed = "binary write failed: %q"
-var errFmtUnsupportedFormat = "unsupported format %d"
-
 type MetricData struct {
-	Id       int64
-	Metrics  []*schema.MetricData
-	Produced time.Time
-	Format   Format
-	Msg      []byte
+	Id          int64
+	Metrics     []*schema.MetricData
+	Produced    time.Time
+	Format      Format
+	Compression Compression
+	Headers     Headers
+	Msg         []byte
 }
 
 // parses format and id (cheap), but doesn't decode metrics (expensive) just yet.
+// for messages using the checksummed envelope, it also verifies the checksum of the body
+// and returns an Error caused by a ChecksumError on mismatch.
 func (m *MetricData) InitFromMsg(msg []byte) error {
-	if len(msg) < 9 {
-		return errTooSmall
+	if len(msg) < envelopeV0HeaderSize {
+		return decodeError(0, "", -1, ErrTooSmall)
 	}
 	m.Msg = msg
 
-	buf := bytes.NewReader(msg[1:9])
-	binary.Read(buf, binary.BigEndian, &m.Id)
-	m.Produced = time.Unix(0, m.Id)
-
-	m.Format = Format(msg[0])
-	if m.Format != FormatMetricDataArrayJson && m.Format != FormatMetricDataArrayMsgp {
-		return fmt.Errorf(errFmtUnsupportedFormat, m.Format)
+	m.Format = Format(msg[0]).Base()
+	m.Compression = Format(msg[0]).Compression()
+	if _, ok := lookupMetricDataCodec(m.Format); !ok {
+		return decodeError(Format(msg[0]), "format", 0, ErrUnsupportedFormat)
 	}
-	return nil
+
+	var err error
+	m.Id, m.Headers, err = initEnvelope(msg)
+	m.Produced = time.Unix(0, m.Id)
+	return err
 }
 
 // sets m.Metrics to a []*schema.MetricData
 // any subsequent call may however put different MetricData into our m.Metrics array
 func (m *MetricData) DecodeMetricData() error {
-	var err error
-	switch m.Format {
-	case FormatMetricDataArrayJson:
-		err = json.Unmarshal(m.Msg[9:], &m.Metrics)
-	case FormatMetricDataArrayMsgp:
-		out := schema.MetricDataArray(m.Metrics)
-		_, err = out.UnmarshalMsg(m.Msg[9:])
-		m.Metrics = []*schema.MetricData(out)
-	default:
-		return fmt.Errorf("unrecognized format %d", m.Msg[0])
+	codec, ok := lookupMetricDataCodec(m.Format)
+	if !ok {
+		return decodeError(m.Format, "format", 0, ErrUnsupportedFormat)
 	}
+	body, buf, err := openBody(m.Msg)
 	if err != nil {
-		return fmt.Errorf("ERROR: failure to unmarshal message body via format %q: %s", m.Format, err)
+		return err
+	}
+	if buf != nil {
+		// codecs may not reference body in their output, so we can recycle the buffer once done
+		defer putBuffer(buf)
+	}
+
+	m.Metrics, err = codec.DecodeMetricData(body, m.Metrics)
+	if err != nil {
+		return decodeError(Format(m.Msg[0]), "body", -1, err)
 	}
 	m.Msg = nil // no more need for the original input
 	return nil
 }
 
 // CreateMsg is the legacy function to create messages. It's not very fast
+// To compress the message body, pass a version obtained via Format.Compressed
+// To use the checksummed envelope, pass a version obtained via Format.WithChecksum
 func CreateMsg(metrics []*schema.MetricData, id int64, version Format) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.LittleEndian, uint8(version))
-	if err != nil {
-		return nil, fmt.Errorf(errFmtBinWriteFailed, err)
-	}
-	err = binary.Write(buf, binary.BigEndian, id)
-	if err != nil {
-		return nil, fmt.Errorf(errFmtBinWriteFailed, err)
-	}
-	var msg []byte
-	switch version {
-	case FormatMetricDataArrayJson:
-		msg, err = json.Marshal(metrics)
-	case FormatMetricDataArrayMsgp:
-		m := schema.MetricDataArray(metrics)
-		msg, err = m.MarshalMsg(nil)
-	default:
-		return nil, fmt.Errorf(errFmtUnsupportedFormat, version)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal metrics payload: %s", err)
+	codec, ok := lookupMetricDataCodec(version)
+	if !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
 	}
-	_, err = buf.Write(msg)
-	if err != nil {
-		return nil, fmt.Errorf(errFmtBinWriteFailed, err)
+	return writeMsg(version, id, nil, func(b []byte) ([]byte, error) {
+		return codec.EncodeMetricData(b, metrics)
+	})
+}
+
+// CreateMsgWithHeaders is like CreateMsg, but attaches the given headers to the message.
+// headers require the checksummed envelope, which is used regardless of version.
+// the headers can be read via MetricData.InitFromMsg, without decoding the metrics.
+func CreateMsgWithHeaders(metrics []*schema.MetricData, id int64, version Format, headers Headers) ([]byte, error) {
+	codec, ok := lookupMetricDataCodec(version)
+	if !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
 	}
-	return buf.Bytes(), nil
+	return writeMsg(version.WithChecksum(), id, headers, func(b []byte) ([]byte, error) {
+		return codec.EncodeMetricData(b, metrics)
+	})
 }
 
 // WritePointMsg is like CreateMsg, except optimized for MetricPoint and buffer re-use.
-// caller must assure a cap-len diff of at least:
+// caller must assure a cap-len diff of at least 1B + the PointSize() of the format's codec:
 // 33B (for FormatMetricPoint)
 // 29B (for FormatMetricPointWithoutOrg)
-// no other formats supported.
+// only formats with a registered PointCodec are supported.
 func WritePointMsg(point schema.MetricPoint, buf []byte, version Format) (o []byte, err error) {
+	codec, ok := lookupPointCodec(version)
+	if !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
 	b := buf[:1]
-	switch version {
-	case FormatMetricPoint:
-		b[0] = byte(FormatMetricPoint)
-		return point.Marshal32(b)
-	case FormatMetricPointWithoutOrg:
-		b[0] = byte(FormatMetricPointWithoutOrg)
-		return point.MarshalWithoutOrg28(b)
-	}
-	return nil, fmt.Errorf(errFmtUnsupportedFormat, version)
+	b[0] = byte(version)
+	o, err = codec.EncodePoint(b, point)
+	if err != nil {
+		return nil, encodeError(version, "body", err)
+	}
+	return o, nil
 }
 
 func IsPointMsg(data []byte) (Format, bool) {
@@ -117,26 +112,29 @@ func IsPointMsg(data []byte) (Format, bool) {
 		return 0, false
 	}
 	version := Format(data[0])
-	if l == 29 && version == FormatMetricPointWithoutOrg {
-		return FormatMetricPointWithoutOrg, true
-	}
-	if l == 33 && version == FormatMetricPoint {
-		return FormatMetricPoint, true
+	codec, ok := lookupPointCodec(version)
+	if !ok || l != 1+codec.PointSize() {
+		return 0, false
 	}
-	return 0, false
+	return version, true
 }
 
 func ReadPointMsg(data []byte, defaultOrg uint32) ([]byte, schema.MetricPoint, error) {
 	var point schema.MetricPoint
+	if len(data) == 0 {
+		return data, point, decodeError(0, "", -1, ErrTooSmall)
+	}
 	version := Format(data[0])
-	if len(data) == 29 && version == FormatMetricPointWithoutOrg {
-		o, err := point.UnmarshalWithoutOrg(data[1:])
-		point.MKey.Org = defaultOrg
-		return o, point, err
+	codec, ok := lookupPointCodec(version)
+	if !ok {
+		return data, point, decodeError(version, "format", 0, ErrUnsupportedFormat)
+	}
+	if len(data) != 1+codec.PointSize() {
+		return data, point, decodeError(version, "", -1, ErrInvalidSize)
 	}
-	if len(data) == 33 && version == FormatMetricPoint {
-		o, err := point.Unmarshal(data[1:])
-		return o, point, err
+	o, point, err := codec.DecodePoint(data[1:], defaultOrg)
+	if err != nil {
+		return o, point, decodeError(version, "body", 1, err)
 	}
-	return data, point, fmt.Errorf(errFmtUnsupportedFormat, version)
+	return o, point, nil
 }
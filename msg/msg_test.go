@@ -1,8 +1,10 @@
 package msg
 
 import (
+	"bytes"
 	"math"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/raintank/schema"
@@ -22,7 +24,7 @@ func TestWriteReadPointMsg(t *testing.T) {
 		t.Fatalf("%s", err.Error())
 	}
 
-	if !IsPointMsg(out) {
+	if _, ok := IsPointMsg(out); !ok {
 		t.Fatal("IsPointMsg: exp true, got false")
 	}
 
@@ -53,7 +55,7 @@ func TestWriteReadPointMsgWithoutOrg(t *testing.T) {
 		t.Fatalf("%s", err.Error())
 	}
 
-	if !IsPointMsg(out) {
+	if _, ok := IsPointMsg(out); !ok {
 		t.Fatal("IsPointMsg: exp true, got false")
 	}
 
@@ -71,3 +73,71 @@ func TestWriteReadPointMsgWithoutOrg(t *testing.T) {
 		t.Fatalf("expected point %v, got %v", exp, outPoint)
 	}
 }
+
+func getMetricData(amount int) []*schema.MetricData {
+	out := make([]*schema.MetricData, amount)
+	for i := 0; i < amount; i++ {
+		out[i] = &schema.MetricData{
+			OrgId:    1 + i%3,
+			Name:     "some.id.of.a.metric." + strconv.Itoa(i),
+			Interval: 10,
+			Value:    float64(i) * 1.5,
+			Unit:     "ms",
+			Time:     1512345678 + int64(i),
+			Mtype:    "gauge",
+			Tags:     []string{"foo=bar", "endpoint=" + strconv.Itoa(i%5)},
+		}
+		out[i].SetId()
+	}
+	return out
+}
+
+func TestCreateDecodeMsg(t *testing.T) {
+	metrics := getMetricData(10)
+	for _, version := range []Format{FormatMetricDataArrayJson, FormatMetricDataArrayMsgp} {
+		data, err := CreateMsg(metrics, 1234567890, version)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		var m MetricData
+		err = m.InitFromMsg(data)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		if m.Id != 1234567890 || m.Format != version {
+			t.Fatalf("%s: expected id 1234567890 and format %s, got %d and %s", version, version, m.Id, m.Format)
+		}
+		err = m.DecodeMetricData()
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		if !reflect.DeepEqual(metrics, m.Metrics) {
+			t.Fatalf("%s: expected metrics %v, got %v", version, metrics, m.Metrics)
+		}
+	}
+}
+
+// FuzzReadPointMsg checks that ReadPointMsg rejects arbitrary input without panicking,
+// and that whatever it accepts re-encodes to the same message.
+func FuzzReadPointMsg(f *testing.F) {
+	for _, version := range []Format{FormatMetricPoint, FormatMetricPointWithoutOrg} {
+		data, _ := WritePointMsg(getPoints(1, 123)[0], make([]byte, 0, 33), version)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, point, err := ReadPointMsg(data, 6)
+		if err != nil {
+			return
+		}
+		if _, ok := IsPointMsg(data); !ok {
+			t.Fatalf("ReadPointMsg accepted data that IsPointMsg rejects")
+		}
+		buf, err := WritePointMsg(point, make([]byte, 0, 33), Format(data[0]))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("expected %v after re-encoding, got %v", data, buf)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/raintank/schema"
+)
+
+// a point array message consists of:
+// 1B format (FormatMetricPointArray, FormatMetricPointArrayWithoutOrg or FormatMetricPointArrayOrg)
+// 4B number of points (little endian, like the points themselves)
+// 4B org (FormatMetricPointArrayOrg only)
+// followed by the points, 32B (FormatMetricPointArray) or 28B (the other formats) each
+const pointArrayHeaderSize = 5
+
+var ErrMixedOrgs = errors.New("points of different orgs")
+
+// pointSize returns the size of a single point in a point array message of the given format
+func pointSize(version Format) (int, bool) {
+	switch version {
+	case FormatMetricPointArray:
+		return 32, true
+	case FormatMetricPointArrayWithoutOrg, FormatMetricPointArrayOrg:
+		return 28, true
+	}
+	return 0, false
+}
+
+// pointArrayHeaderLen returns the size of the header of a point array message of the given format
+func pointArrayHeaderLen(version Format) int {
+	if version == FormatMetricPointArrayOrg {
+		return pointArrayHeaderSize + 4
+	}
+	return pointArrayHeaderSize
+}
+
+// PointArrayWriter builds a point array message by appending points one at a time.
+// Its buffer is re-used across Reset calls.
+type PointArrayWriter struct {
+	version Format
+	org     uint32
+	count   uint32
+	buf     []byte
+}
+
+// NewPointArrayWriter returns a PointArrayWriter for the given format.
+// buf is optional and will be used as the initial buffer.
+// For FormatMetricPointArrayOrg, use NewOrgPointArrayWriter instead.
+func NewPointArrayWriter(version Format, buf []byte) (*PointArrayWriter, error) {
+	if _, ok := pointSize(version); !ok || version == FormatMetricPointArrayOrg {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
+	w := &PointArrayWriter{
+		version: version,
+		buf:     buf,
+	}
+	w.Reset()
+	return w, nil
+}
+
+// NewOrgPointArrayWriter returns a PointArrayWriter for FormatMetricPointArrayOrg messages of the given org.
+// buf is optional and will be used as the initial buffer.
+func NewOrgPointArrayWriter(org uint32, buf []byte) *PointArrayWriter {
+	w := &PointArrayWriter{
+		version: FormatMetricPointArrayOrg,
+		org:     org,
+		buf:     buf,
+	}
+	w.Reset()
+	return w
+}
+
+// Reset discards all appended points but keeps the underlying buffer
+func (w *PointArrayWriter) Reset() {
+	w.count = 0
+	w.buf = append(w.buf[:0], byte(w.version), 0, 0, 0, 0)
+	if w.version == FormatMetricPointArrayOrg {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, w.org)
+	}
+}
+
+// Append adds the point to the message.
+// for FormatMetricPointArrayOrg, the org of the point is not encoded: it is assumed to be the org of the writer.
+func (w *PointArrayWriter) Append(point schema.MetricPoint) {
+	if w.version == FormatMetricPointArray {
+		w.buf, _ = point.Marshal(w.buf)
+	} else {
+		w.buf, _ = point.MarshalWithoutOrg(w.buf)
+	}
+	w.count++
+}
+
+// Len returns the number of points appended so far
+func (w *PointArrayWriter) Len() int {
+	return int(w.count)
+}
+
+// Size returns the size in bytes of the message built so far
+func (w *PointArrayWriter) Size() int {
+	return len(w.buf)
+}
+
+// Bytes returns the message. The returned slice is only valid until the next call to Append or Reset.
+func (w *PointArrayWriter) Bytes() []byte {
+	binary.LittleEndian.PutUint32(w.buf[1:], w.count)
+	return w.buf
+}
+
+// WritePointArrayMsg is like WritePointMsg, but for many points at once.
+// The message is appended to buf, which is grown as needed, and the extended buffer is returned.
+// only FormatMetricPointArray, FormatMetricPointArrayWithoutOrg and FormatMetricPointArrayOrg are supported.
+// for FormatMetricPointArrayOrg, all points must have the same org.
+func WritePointArrayMsg(points []schema.MetricPoint, buf []byte, version Format) ([]byte, error) {
+	size, ok := pointSize(version)
+	if !ok {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
+	var org uint32
+	if version == FormatMetricPointArrayOrg && len(points) > 0 {
+		org = points[0].MKey.Org
+		for i := range points {
+			if points[i].MKey.Org != org {
+				return nil, encodeError(version, "body", fmt.Errorf("%w: point %d has org %d, expected %d", ErrMixedOrgs, i, points[i].MKey.Org, org))
+			}
+		}
+	}
+	need := pointArrayHeaderLen(version) + len(points)*size
+	if cap(buf)-len(buf) < need {
+		o := make([]byte, len(buf), len(buf)+need)
+		copy(o, buf)
+		buf = o
+	}
+	l := len(buf)
+	buf = append(buf, byte(version), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buf[l+1:], uint32(len(points)))
+	if version == FormatMetricPointArrayOrg {
+		buf = binary.LittleEndian.AppendUint32(buf, org)
+	}
+	for i := range points {
+		if version == FormatMetricPointArray {
+			buf, _ = points[i].Marshal32(buf)
+		} else {
+			buf, _ = points[i].MarshalWithoutOrg28(buf)
+		}
+	}
+	return buf, nil
+}
+
+// IsPointArrayMsg returns whether data looks like a well formed point array message, and its format
+func IsPointArrayMsg(data []byte) (Format, bool) {
+	if len(data) < pointArrayHeaderSize {
+		return 0, false
+	}
+	version := Format(data[0])
+	size, ok := pointSize(version)
+	if !ok {
+		return 0, false
+	}
+	hdr := pointArrayHeaderLen(version)
+	if len(data) < hdr {
+		return 0, false
+	}
+	count := binary.LittleEndian.Uint32(data[1:])
+	if uint64(len(data)-hdr) != uint64(count)*uint64(size) {
+		return 0, false
+	}
+	return version, true
+}
+
+// PointArrayIter iterates over the points in a point array message.
+// it decodes the points in place and does not allocate.
+type PointArrayIter struct {
+	data       []byte
+	version    Format
+	defaultOrg uint32
+	remaining  uint32
+	point      schema.MetricPoint
+}
+
+// NewPointArrayIter validates the point array message in data and returns an iterator over its points.
+// defaultOrg is used as the org of the points if the format is FormatMetricPointArrayWithoutOrg.
+// for FormatMetricPointArrayOrg, the org from the message is used instead.
+func NewPointArrayIter(data []byte, defaultOrg uint32) (PointArrayIter, error) {
+	version, ok := IsPointArrayMsg(data)
+	if !ok {
+		if len(data) == 0 {
+			return PointArrayIter{}, decodeError(0, "", -1, ErrTooSmall)
+		}
+		if _, ok := pointSize(Format(data[0])); !ok {
+			return PointArrayIter{}, decodeError(Format(data[0]), "format", 0, ErrUnsupportedFormat)
+		}
+		return PointArrayIter{}, decodeError(Format(data[0]), "", -1, fmt.Errorf("%w: %d bytes", ErrInvalidSize, len(data)))
+	}
+	if version == FormatMetricPointArrayOrg {
+		defaultOrg = binary.LittleEndian.Uint32(data[pointArrayHeaderSize:])
+	}
+	return PointArrayIter{
+		data:       data[pointArrayHeaderLen(version):],
+		version:    version,
+		defaultOrg: defaultOrg,
+		remaining:  binary.LittleEndian.Uint32(data[1:]),
+	}, nil
+}
+
+// Next decodes the next point, which can then be retrieved via Point.
+// it returns false once all points have been consumed.
+func (it *PointArrayIter) Next() bool {
+	if it.remaining == 0 {
+		return false
+	}
+	// lengths have been validated by NewPointArrayIter
+	if it.version == FormatMetricPointArray {
+		it.data, _ = it.point.Unmarshal(it.data)
+	} else {
+		it.data, _ = it.point.UnmarshalWithoutOrg(it.data)
+		it.point.MKey.Org = it.defaultOrg
+	}
+	it.remaining--
+	return true
+}
+
+// Point returns the point decoded by the last call to Next
+func (it *PointArrayIter) Point() schema.MetricPoint {
+	return it.point
+}
+
+// Remaining returns the number of points that have not been decoded yet
+func (it *PointArrayIter) Remaining() int {
+	return int(it.remaining)
+}
+
+// Format returns the format of the message being iterated
+func (it *PointArrayIter) Format() Format {
+	return it.version
+}
+
+// ReadPointArrayMsg decodes all points in the point array message and appends them to out.
+func ReadPointArrayMsg(data []byte, defaultOrg uint32, out []schema.MetricPoint) ([]schema.MetricPoint, error) {
+	it, err := NewPointArrayIter(data, defaultOrg)
+	if err != nil {
+		return out, err
+	}
+	for it.Next() {
+		out = append(out, it.Point())
+	}
+	return out, nil
+}
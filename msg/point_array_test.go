@@ -0,0 +1,275 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func getPoints(amount int, org uint32) []schema.MetricPoint {
+	out := make([]schema.MetricPoint, amount)
+	for i := 0; i < amount; i++ {
+		out[i] = schema.MetricPoint{
+			MKey: schema.MKey{
+				Key: md5.Sum([]byte("some.id.of.a.metric." + strconv.Itoa(i))),
+				Org: org,
+			},
+			Value: float64(i) * 1.5,
+			Time:  math.MaxUint32 - uint32(i),
+		}
+	}
+	return out
+}
+
+func TestWriteReadPointArrayMsg(t *testing.T) {
+	for _, version := range []Format{FormatMetricPointArray, FormatMetricPointArrayWithoutOrg, FormatMetricPointArrayOrg} {
+		for _, amount := range []int{0, 1, 2, 100} {
+			points := getPoints(amount, 123)
+			out, err := WritePointArrayMsg(points, nil, version)
+			if err != nil {
+				t.Fatalf("%s with %d points: %s", version, amount, err.Error())
+			}
+			size, _ := pointSize(version)
+			if len(out) != pointArrayHeaderLen(version)+amount*size {
+				t.Fatalf("%s with %d points: expected %d bytes, got %d", version, amount, pointArrayHeaderLen(version)+amount*size, len(out))
+			}
+			if f, ok := IsPointArrayMsg(out); !ok || f != version {
+				t.Fatalf("%s with %d points: IsPointArrayMsg: exp %s, true, got %s, %t", version, amount, version, f, ok)
+			}
+			if _, ok := IsPointMsg(out); ok {
+				t.Fatalf("%s with %d points: IsPointMsg: exp false, got true", version, amount)
+			}
+
+			exp := getPoints(amount, 123)
+			if version == FormatMetricPointArrayWithoutOrg {
+				exp = getPoints(amount, 6)
+			}
+			got, err := ReadPointArrayMsg(out, 6, nil)
+			if err != nil {
+				t.Fatalf("%s with %d points: %s", version, amount, err.Error())
+			}
+			if len(got) != amount {
+				t.Fatalf("%s with %d points: got %d points", version, amount, len(got))
+			}
+			for i := range exp {
+				if !reflect.DeepEqual(exp[i], got[i]) {
+					t.Fatalf("%s with %d points: point %d: expected %v, got %v", version, amount, i, exp[i], got[i])
+				}
+			}
+		}
+	}
+}
+
+func TestWritePointArrayMsgAppends(t *testing.T) {
+	points := getPoints(3, 123)
+	buf := []byte{'f', 'o', 'o'}
+	out, err := WritePointArrayMsg(points, buf, FormatMetricPointArray)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if string(out[:3]) != "foo" {
+		t.Fatalf("pre-existing data was modified to %q", string(out[:3]))
+	}
+	if _, ok := IsPointArrayMsg(out[3:]); !ok {
+		t.Fatal("IsPointArrayMsg: exp true, got false")
+	}
+}
+
+func TestPointArrayWriter(t *testing.T) {
+	points := getPoints(10, 123)
+	for _, version := range []Format{FormatMetricPointArray, FormatMetricPointArrayWithoutOrg} {
+		w, err := NewPointArrayWriter(version, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", version, err.Error())
+		}
+		// write a few rounds to make sure Reset works as expected
+		for round := 0; round < 3; round++ {
+			w.Reset()
+			for _, p := range points[:5+round] {
+				w.Append(p)
+			}
+			if w.Len() != 5+round {
+				t.Fatalf("%s: expected Len %d, got %d", version, 5+round, w.Len())
+			}
+			exp, err := WritePointArrayMsg(points[:5+round], nil, version)
+			if err != nil {
+				t.Fatalf("%s: %s", version, err.Error())
+			}
+			if !reflect.DeepEqual(exp, w.Bytes()) {
+				t.Fatalf("%s round %d: expected %v, got %v", version, round, exp, w.Bytes())
+			}
+		}
+	}
+}
+
+func TestOrgPointArrayWriter(t *testing.T) {
+	points := getPoints(10, 123)
+	w := NewOrgPointArrayWriter(123, nil)
+	for round := 0; round < 2; round++ {
+		w.Reset()
+		for _, p := range points {
+			w.Append(p)
+		}
+		exp, err := WritePointArrayMsg(points, nil, FormatMetricPointArrayOrg)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !reflect.DeepEqual(exp, w.Bytes()) {
+			t.Fatalf("round %d: expected %v, got %v", round, exp, w.Bytes())
+		}
+	}
+	// the org is carried once, in the header
+	exp := pointArrayHeaderSize + 4 + len(points)*28
+	if w.Size() != exp {
+		t.Fatalf("expected size %d, got %d", exp, w.Size())
+	}
+	got, err := ReadPointArrayMsg(w.Bytes(), 6, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(points, got) {
+		t.Fatalf("expected %v, got %v", points, got)
+	}
+
+	mixed := append(getPoints(2, 123), getPoints(1, 124)...)
+	if _, err := WritePointArrayMsg(mixed, nil, FormatMetricPointArrayOrg); err == nil {
+		t.Fatal("expected error for points of different orgs, got nil")
+	}
+	if _, err := NewPointArrayWriter(FormatMetricPointArrayOrg, nil); err == nil {
+		t.Fatal("expected error creating org scoped writer without org, got nil")
+	}
+}
+
+func TestPointArrayIter(t *testing.T) {
+	points := getPoints(10, 123)
+	out, err := WritePointArrayMsg(points, nil, FormatMetricPointArray)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	it, err := NewPointArrayIter(out, 6)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var i int
+	for it.Next() {
+		if it.Point() != points[i] {
+			t.Fatalf("point %d: expected %v, got %v", i, points[i], it.Point())
+		}
+		i++
+		if it.Remaining() != len(points)-i {
+			t.Fatalf("expected %d remaining, got %d", len(points)-i, it.Remaining())
+		}
+	}
+	if i != len(points) {
+		t.Fatalf("expected %d points, got %d", len(points), i)
+	}
+}
+
+func TestInvalidPointArrayMsg(t *testing.T) {
+	points := getPoints(2, 123)
+	out, err := WritePointArrayMsg(points, nil, FormatMetricPointArray)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cases := [][]byte{
+		nil,
+		out[:4],
+		out[:len(out)-1],
+		append(out, 0),
+		append([]byte{byte(FormatMetricPoint)}, out[1:]...),
+		append([]byte{byte(FormatMetricPointArrayWithoutOrg)}, out[1:]...),
+		append([]byte{byte(FormatMetricPointArrayOrg)}, out[1:]...),
+		{byte(FormatMetricPointArrayOrg), 0, 0, 0, 0},
+	}
+	for i, c := range cases {
+		if _, ok := IsPointArrayMsg(c); ok {
+			t.Fatalf("case %d: IsPointArrayMsg: exp false, got true", i)
+		}
+		if _, err := NewPointArrayIter(c, 6); err == nil {
+			t.Fatalf("case %d: expected error, got nil", i)
+		}
+	}
+	if _, err := WritePointArrayMsg(points, nil, FormatMetricPoint); err == nil {
+		t.Fatal("expected error for unsupported format, got nil")
+	}
+	if _, err := NewPointArrayWriter(FormatMetricDataArrayMsgp, nil); err == nil {
+		t.Fatal("expected error for unsupported format, got nil")
+	}
+}
+
+func BenchmarkWritePointArrayMsg(b *testing.B) {
+	points := getPoints(1000, 123)
+	w, err := NewPointArrayWriter(FormatMetricPointArray, nil)
+	if err != nil {
+		b.Fatalf("%s", err.Error())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		for _, p := range points {
+			w.Append(p)
+		}
+		w.Bytes()
+	}
+}
+
+func BenchmarkReadPointArrayMsg(b *testing.B) {
+	points := getPoints(1000, 123)
+	data, err := WritePointArrayMsg(points, nil, FormatMetricPointArray)
+	if err != nil {
+		b.Fatalf("%s", err.Error())
+	}
+	var sum float64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, err := NewPointArrayIter(data, 6)
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+		for it.Next() {
+			sum += it.Point().Value
+		}
+	}
+}
+
+// FuzzPointArrayIter checks that NewPointArrayIter rejects arbitrary input without panicking,
+// and that whatever it accepts re-encodes to the same message.
+func FuzzPointArrayIter(f *testing.F) {
+	points := getPoints(3, 123)
+	for _, version := range []Format{FormatMetricPointArray, FormatMetricPointArrayWithoutOrg, FormatMetricPointArrayOrg} {
+		data, _ := WritePointArrayMsg(points, nil, version)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		it, err := NewPointArrayIter(data, 6)
+		if err != nil {
+			return
+		}
+		if _, ok := IsPointArrayMsg(data); !ok {
+			t.Fatalf("NewPointArrayIter accepted data that IsPointArrayMsg rejects")
+		}
+		var w *PointArrayWriter
+		if it.Format() == FormatMetricPointArrayOrg {
+			w = NewOrgPointArrayWriter(binary.LittleEndian.Uint32(data[5:]), nil)
+		} else {
+			w, err = NewPointArrayWriter(it.Format(), nil)
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+		}
+		for it.Next() {
+			w.Append(it.Point())
+		}
+		if !bytes.Equal(w.Bytes(), data) {
+			t.Fatalf("expected %v after re-encoding, got %v", data, w.Bytes())
+		}
+	})
+}
@@ -0,0 +1,333 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+
+	"github.com/raintank/schema"
+)
+
+var ErrInvalidPointArrayXor = errors.New("invalid xor point array message")
+
+// a FormatMetricPointArrayXor message compresses the points of each series Gorilla style:
+// timestamps are stored as delta-of-deltas and values as the XOR with the previous value,
+// both using a variable number of bits. It is laid out as follows (varints as per encoding/binary):
+// 1B format
+// uvarint number of series
+// followed by the series, each consisting of:
+// 16B key
+// uvarint org
+// uvarint number of points (at least 1)
+// the points as a bitstream (most significant bit first), padded with zeroes to a byte boundary:
+// first point: 32 bits timestamp, 64 bits value
+// following points: timestamp, then value, as per xorWriter.
+//
+// timestamps are delta-of-delta encoded, the delta of the first point being 0:
+// '0'                        delta-of-delta 0
+// '10' + 7 bits              delta-of-delta in [-63, 64]
+// '110' + 9 bits             delta-of-delta in [-255, 256]
+// '1110' + 12 bits           delta-of-delta in [-2047, 2048]
+// '1111' + 64 bits           any other delta-of-delta
+// the bits hold the delta-of-delta plus 63, 255 and 2047 respectively, or its two's complement.
+//
+// values are XOR'ed with the previous value:
+// '0'                        XOR is 0, the value is identical
+// '10' + meaningful bits     the meaningful bits of the XOR fit in those of the previous XOR
+// '11' + 5 bits leading zeroes + 6 bits number of meaningful bits minus 1 + meaningful bits
+//
+// since the bits of values are stored, values round-trip exactly, including NaN payloads.
+
+// xorBucket is a range of delta-of-deltas that is stored with a fixed number of bits
+type xorBucket struct {
+	prefix     uint64 // control bits
+	prefixBits int
+	offset     int64 // added to the delta-of-delta to make it non-negative
+	bits       int
+}
+
+var xorBuckets = []xorBucket{
+	{0x2, 2, 63, 7},
+	{0x6, 3, 255, 9},
+	{0xE, 4, 2047, 12},
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first
+type bitWriter struct {
+	b    []byte
+	free int // number of unused bits in the last byte of b
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		if w.free == 0 {
+			w.b = append(w.b, 0)
+			w.free = 8
+		}
+		take := n
+		if take > w.free {
+			take = w.free
+		}
+		chunk := byte(v>>uint(n-take)) & (0xFF >> uint(8-take))
+		w.b[len(w.b)-1] |= chunk << uint(w.free-take)
+		w.free -= take
+		n -= take
+	}
+}
+
+// bitReader reads bits from a byte slice, most significant bit first
+type bitReader struct {
+	b    []byte
+	cur  byte
+	free int // number of unread bits in cur
+	err  error
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		if r.free == 0 {
+			if len(r.b) == 0 {
+				r.err = ErrInvalidPointArrayXor
+				return 0
+			}
+			r.cur = r.b[0]
+			r.b = r.b[1:]
+			r.free = 8
+		}
+		take := n
+		if take > r.free {
+			take = r.free
+		}
+		chunk := (r.cur >> uint(r.free-take)) & (0xFF >> uint(8-take))
+		v = v<<uint(take) | uint64(chunk)
+		r.free -= take
+		n -= take
+	}
+	return v
+}
+
+// readBit reads a single control bit
+func (r *bitReader) readBit() bool {
+	return r.readBits(1) == 1
+}
+
+// xorState is the state of the encoding or decoding of a series that carries over between points
+type xorState struct {
+	t        uint32
+	delta    int64
+	v        uint64 // bits of the value
+	leading  int
+	trailing int // -1 until a window of meaningful bits has been established
+}
+
+// xorWriter encodes the points of a single series
+type xorWriter struct {
+	bitWriter
+	xorState
+	n int
+}
+
+func (w *xorWriter) write(t uint32, val float64) {
+	v := math.Float64bits(val)
+	if w.n == 0 {
+		w.writeBits(uint64(t), 32)
+		w.writeBits(v, 64)
+		w.t, w.v, w.trailing = t, v, -1
+		w.n++
+		return
+	}
+
+	delta := int64(t) - int64(w.t)
+	dod := delta - w.delta
+	w.writeDod(dod)
+	w.t, w.delta = t, delta
+
+	xor := v ^ w.v
+	w.v = v
+	w.n++
+	if xor == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31
+	}
+	if w.trailing >= 0 && leading >= w.leading && trailing >= w.trailing {
+		w.writeBits(0x2, 2)
+		w.writeBits(xor>>uint(w.trailing), 64-w.leading-w.trailing)
+		return
+	}
+	meaningful := 64 - leading - trailing
+	w.writeBits(0x3, 2)
+	w.writeBits(uint64(leading), 5)
+	w.writeBits(uint64(meaningful-1), 6)
+	w.writeBits(xor>>uint(trailing), meaningful)
+	w.leading, w.trailing = leading, trailing
+}
+
+func (w *xorWriter) writeDod(dod int64) {
+	if dod == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	for _, b := range xorBuckets {
+		if dod >= -b.offset && dod <= int64(1)<<uint(b.bits)-1-b.offset {
+			w.writeBits(b.prefix, b.prefixBits)
+			w.writeBits(uint64(dod+b.offset), b.bits)
+			return
+		}
+	}
+	w.writeBits(0xF, 4)
+	w.writeBits(uint64(dod), 64)
+}
+
+// xorReader decodes the points of a single series
+type xorReader struct {
+	bitReader
+	xorState
+	n int
+}
+
+func (r *xorReader) read() (uint32, float64) {
+	if r.n == 0 {
+		r.t = uint32(r.readBits(32))
+		r.v = r.readBits(64)
+		r.trailing = -1
+		r.n++
+		return r.t, math.Float64frombits(r.v)
+	}
+
+	delta := r.delta + r.readDod()
+	t := int64(r.t) + delta
+	if t < 0 || t > math.MaxUint32 {
+		r.err = ErrInvalidPointArrayXor
+	}
+	r.t, r.delta = uint32(t), delta
+
+	if r.readBit() {
+		if !r.readBit() {
+			if r.trailing < 0 {
+				r.err = ErrInvalidPointArrayXor
+				return 0, 0
+			}
+			r.v ^= r.readBits(64-r.leading-r.trailing) << uint(r.trailing)
+		} else {
+			leading := int(r.readBits(5))
+			meaningful := int(r.readBits(6)) + 1
+			if leading+meaningful > 64 {
+				r.err = ErrInvalidPointArrayXor
+				return 0, 0
+			}
+			r.leading, r.trailing = leading, 64-leading-meaningful
+			r.v ^= r.readBits(meaningful) << uint(r.trailing)
+		}
+	}
+	r.n++
+	return r.t, math.Float64frombits(r.v)
+}
+
+func (r *xorReader) readDod() int64 {
+	if !r.readBit() {
+		return 0
+	}
+	// the control bits of bucket i are i+1 ones followed by a zero, the first one has been read.
+	for _, b := range xorBuckets {
+		if !r.readBit() {
+			return int64(r.readBits(b.bits)) - b.offset
+		}
+	}
+	return int64(r.readBits(64))
+}
+
+// appendXorSeries appends the given points of a single series to b
+func appendXorSeries(b []byte, mkey schema.MKey, points []schema.Point) []byte {
+	b = append(b, mkey.Key[:]...)
+	b = binary.AppendUvarint(b, uint64(mkey.Org))
+	b = binary.AppendUvarint(b, uint64(len(points)))
+	w := xorWriter{
+		bitWriter: bitWriter{b: b},
+	}
+	for _, p := range points {
+		w.write(p.Ts, p.Val)
+	}
+	return w.b
+}
+
+// WritePointArrayXorMsg encodes the points as a FormatMetricPointArrayXor message,
+// appends it to buf, which is grown as needed, and returns the extended buffer.
+// points are grouped by series: ReadPointArrayXorMsg returns the points of each series in their original order,
+// with the series in the order in which they first appear in points.
+func WritePointArrayXorMsg(points []schema.MetricPoint, buf []byte) []byte {
+	idx := make(map[schema.MKey]int)
+	var keys []schema.MKey
+	var series [][]schema.Point
+	for _, p := range points {
+		i, ok := idx[p.MKey]
+		if !ok {
+			i = len(series)
+			idx[p.MKey] = i
+			keys = append(keys, p.MKey)
+			series = append(series, nil)
+		}
+		series[i] = append(series[i], schema.Point{Val: p.Value, Ts: p.Time})
+	}
+
+	buf = append(buf, byte(FormatMetricPointArrayXor))
+	buf = binary.AppendUvarint(buf, uint64(len(series)))
+	for i, s := range series {
+		buf = appendXorSeries(buf, keys[i], s)
+	}
+	return buf
+}
+
+// ReadPointArrayXorMsg decodes all points in the FormatMetricPointArrayXor message and appends them to out.
+func ReadPointArrayXorMsg(data []byte, out []schema.MetricPoint) ([]schema.MetricPoint, error) {
+	if len(data) == 0 {
+		return out, decodeError(0, "", -1, ErrTooSmall)
+	}
+	if Format(data[0]) != FormatMetricPointArrayXor {
+		return out, decodeError(Format(data[0]), "format", 0, ErrUnsupportedFormat)
+	}
+	// invalid returns the error for a problem found where rest starts
+	invalid := func(rest []byte) error {
+		return decodeError(FormatMetricPointArrayXor, "body", len(data)-len(rest), ErrInvalidPointArrayXor)
+	}
+	r := dictReader{
+		b: data[1:],
+	}
+	numSeries := r.count(1)
+	for i := 0; i < numSeries && r.err == nil; i++ {
+		if len(r.b) < 16 {
+			return out, invalid(r.b)
+		}
+		var mkey schema.MKey
+		copy(mkey.Key[:], r.b[:16])
+		r.b = r.b[16:]
+		org := r.uvarint()
+		numPoints := r.uvarint()
+		if r.err != nil || org > math.MaxUint32 || numPoints == 0 {
+			return out, invalid(r.b)
+		}
+		mkey.Org = uint32(org)
+
+		xr := xorReader{
+			bitReader: bitReader{b: r.b},
+		}
+		for j := uint64(0); j < numPoints; j++ {
+			t, v := xr.read()
+			if xr.err != nil {
+				return out, invalid(xr.b)
+			}
+			out = append(out, schema.MetricPoint{MKey: mkey, Value: v, Time: t})
+		}
+		r.b = xr.b
+	}
+	if r.err != nil || len(r.b) != 0 {
+		return out, invalid(r.b)
+	}
+	return out, nil
+}
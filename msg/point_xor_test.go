@@ -0,0 +1,226 @@
+package msg
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+// getSeriesPoints returns amount points for each of the given number of series, interleaved,
+// at a regular interval with a bit of jitter
+func getSeriesPoints(series, amount int) []schema.MetricPoint {
+	keys := getPoints(series, 123)
+	var out []schema.MetricPoint
+	for i := 0; i < amount; i++ {
+		for j, k := range keys {
+			out = append(out, schema.MetricPoint{
+				MKey:  k.MKey,
+				Value: float64(j*1000) + float64(i%7)*0.5,
+				Time:  1500000000 + uint32(i*10) + uint32(i%3),
+			})
+		}
+	}
+	return out
+}
+
+// groupBySeries returns the points in the order WritePointArrayXorMsg stores them
+func groupBySeries(points []schema.MetricPoint) []schema.MetricPoint {
+	var keys []schema.MKey
+	series := make(map[schema.MKey][]schema.MetricPoint)
+	for _, p := range points {
+		if _, ok := series[p.MKey]; !ok {
+			keys = append(keys, p.MKey)
+		}
+		series[p.MKey] = append(series[p.MKey], p)
+	}
+	out := make([]schema.MetricPoint, 0, len(points))
+	for _, k := range keys {
+		out = append(out, series[k]...)
+	}
+	return out
+}
+
+// samePoint compares points, including the bits of their values
+func samePoint(a, b schema.MetricPoint) bool {
+	return a.MKey == b.MKey && a.Time == b.Time && math.Float64bits(a.Value) == math.Float64bits(b.Value)
+}
+
+func TestWriteReadPointArrayXorMsg(t *testing.T) {
+	nan := math.Float64frombits(0x7FF8000000000BAD)
+	key := getPoints(1, 123)[0].MKey
+	cases := map[string][]schema.MetricPoint{
+		"empty":       nil,
+		"single":      getPoints(1, 123),
+		"interleaved": getSeriesPoints(5, 100),
+		"irregular": {
+			{MKey: key, Value: 1, Time: 10},
+			{MKey: key, Value: 1, Time: 20},
+			{MKey: key, Value: -1, Time: 19},
+			{MKey: key, Value: nan, Time: 1000},
+			{MKey: key, Value: math.Inf(1), Time: 1000},
+			{MKey: key, Value: math.Copysign(0, -1), Time: math.MaxUint32},
+			{MKey: key, Value: math.MaxFloat64, Time: 0},
+			{MKey: key, Value: math.SmallestNonzeroFloat64, Time: 3000},
+			{MKey: key, Value: 1, Time: 3064},
+			{MKey: key, Value: 2, Time: 3064 + 64 + 256},
+			{MKey: key, Value: 2, Time: 3064 + 64 + 256 + 2048 + 256},
+		},
+	}
+	for name, points := range cases {
+		out := WritePointArrayXorMsg(points, nil)
+		got, err := ReadPointArrayXorMsg(out, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		exp := groupBySeries(points)
+		if len(got) != len(exp) {
+			t.Fatalf("%s: expected %d points, got %d", name, len(exp), len(got))
+		}
+		for i := range exp {
+			if !samePoint(exp[i], got[i]) {
+				t.Fatalf("%s: point %d: expected %v, got %v", name, i, exp[i], got[i])
+			}
+		}
+	}
+}
+
+func TestPointArrayXorMsgSize(t *testing.T) {
+	points := getSeriesPoints(10, 100)
+	out := WritePointArrayXorMsg(points, nil)
+	plain, err := WritePointArrayMsg(points, nil, FormatMetricPointArray)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(out)*4 > len(plain) {
+		t.Fatalf("expected xor encoding to be at most a quarter of the plain size %d, got %d", len(plain), len(out))
+	}
+}
+
+func TestDecodePointArrayXor(t *testing.T) {
+	points := getSeriesPoints(3, 10)
+	data := WritePointArrayXorMsg(points, []byte{'f', 'o', 'o'})
+	if string(data[:3]) != "foo" {
+		t.Fatalf("pre-existing data was modified to %q", string(data[:3]))
+	}
+	var c collector
+	err := Decode(data[3:], 6, &c)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := groupBySeries(points)
+	if len(c.points) != len(exp) {
+		t.Fatalf("expected %d points, got %d", len(exp), len(c.points))
+	}
+	for i := range exp {
+		if !samePoint(exp[i], c.points[i]) || c.formats[i] != FormatMetricPointArrayXor {
+			t.Fatalf("point %d: expected %v, got %v with format %s", i, exp[i], c.points[i], c.formats[i])
+		}
+	}
+}
+
+func TestInvalidPointArrayXorMsg(t *testing.T) {
+	out := WritePointArrayXorMsg(getSeriesPoints(2, 10), nil)
+	cases := [][]byte{
+		nil,
+		{byte(FormatMetricPointArray), 0},
+		{byte(FormatMetricPointArrayXor)},
+		out[:len(out)-1],
+		append(out, 0),
+	}
+	for l := 1; l < 20; l++ {
+		cases = append(cases, out[:l])
+	}
+	for i, c := range cases {
+		if _, err := ReadPointArrayXorMsg(c, nil); err == nil {
+			t.Fatalf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+// FuzzPointArrayXor interprets the input as a sequence of FormatMetricPoint messages,
+// and checks that the points survive a round trip through FormatMetricPointArrayXor bit for bit.
+func FuzzPointArrayXor(f *testing.F) {
+	for _, points := range [][]schema.MetricPoint{getPoints(3, 123), getSeriesPoints(2, 5)} {
+		var seed []byte
+		for _, p := range points {
+			msg, _ := WritePointMsg(p, make([]byte, 33), FormatMetricPoint)
+			seed = append(seed, msg...)
+		}
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var points []schema.MetricPoint
+		var msgs [][]byte
+		for ; len(data) >= 33; data = data[33:] {
+			if Format(data[0]) != FormatMetricPoint {
+				continue
+			}
+			_, p, err := ReadPointMsg(data[:33], 6)
+			if err != nil {
+				continue
+			}
+			points = append(points, p)
+			msgs = append(msgs, data[:33])
+		}
+
+		got, err := ReadPointArrayXorMsg(WritePointArrayXorMsg(points, nil), nil)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		exp := groupBySeries(points)
+		if len(got) != len(exp) {
+			t.Fatalf("expected %d points, got %d", len(exp), len(got))
+		}
+		for i := range exp {
+			if !samePoint(exp[i], got[i]) {
+				t.Fatalf("point %d: expected %v, got %v", i, exp[i], got[i])
+			}
+		}
+
+		// every decoded point must encode to one of the original messages
+		orig := make(map[string]bool, len(msgs))
+		for _, m := range msgs {
+			orig[string(m)] = true
+		}
+		for i, p := range got {
+			buf, err := WritePointMsg(p, make([]byte, 0, 33), FormatMetricPoint)
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+			if !orig[string(buf)] {
+				t.Fatalf("point %d: %v does not encode to any of the original FormatMetricPoint messages", i, p)
+			}
+		}
+	})
+}
+
+// FuzzReadPointArrayXorMsg checks that arbitrary input is rejected without panicking,
+// and that whatever is accepted survives a round trip.
+func FuzzReadPointArrayXorMsg(f *testing.F) {
+	f.Add(WritePointArrayXorMsg(getSeriesPoints(2, 5), nil))
+	f.Add([]byte{byte(FormatMetricPointArrayXor), 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		points, err := ReadPointArrayXorMsg(data, nil)
+		if err != nil {
+			return
+		}
+		again, err := ReadPointArrayXorMsg(WritePointArrayXorMsg(points, nil), nil)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		exp := groupBySeries(points)
+		if len(again) != len(exp) {
+			t.Fatalf("expected %d points, got %d", len(exp), len(again))
+		}
+		for i := range exp {
+			if !samePoint(exp[i], again[i]) {
+				t.Fatalf("point %d: expected %v, got %v", i, exp[i], again[i])
+			}
+		}
+		if !bytes.Equal(WritePointArrayXorMsg(exp, nil), WritePointArrayXorMsg(again, nil)) {
+			t.Fatal("expected re-encoding to be stable")
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// a stream is a sequence of frames, each holding one message (as created by CreateMsg, WritePointMsg, etc):
+// 2B magic
+// 4B message length (big endian)
+// 4B CRC32C (Castagnoli) of the message (big endian)
+// message
+// the magic and checksum allow readers to detect corrupt frames and to resynchronize on the next frame.
+const frameHeaderSize = 10
+
+var frameMagic = []byte{0xF7, 0x4D}
+
+var ErrBadMagic = errors.New("bad magic")
+
+// DefaultMaxMsgSize is the default maximum message size accepted by a StreamReader
+const DefaultMaxMsgSize = 64 << 20
+
+// FrameError is returned by StreamReader.ReadMsg when a corrupt frame is encountered.
+// The reader has then skipped ahead to the next frame, so reading can continue.
+type FrameError struct {
+	Offset  int64 // offset in the stream where the corrupt frame started
+	Skipped int64 // number of bytes that were skipped
+	// Err is what was wrong with the frame: ErrBadMagic, ErrInvalidSize, ErrTooSmall for a truncated frame,
+	// or a ChecksumError
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("corrupt frame at offset %d: %s (skipped %d bytes)", e.Offset, e.Err, e.Skipped)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// StreamWriter writes messages as frames to an io.Writer.
+// Every message results in two writes, so wrapping the writer in a bufio.Writer is recommended.
+type StreamWriter struct {
+	w   io.Writer
+	hdr [frameHeaderSize]byte
+}
+
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	s := &StreamWriter{
+		w: w,
+	}
+	copy(s.hdr[:], frameMagic)
+	return s
+}
+
+// WriteMsg writes msg as a single frame
+func (s *StreamWriter) WriteMsg(msg []byte) error {
+	binary.BigEndian.PutUint32(s.hdr[2:], uint32(len(msg)))
+	binary.BigEndian.PutUint32(s.hdr[6:], crc32.Checksum(msg, crc32cTable))
+	_, err := s.w.Write(s.hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(msg)
+	return err
+}
+
+// StreamReader reads messages from a stream written by a StreamWriter
+type StreamReader struct {
+	// MaxMsgSize is the largest message the reader accepts. Frames claiming
+	// to be larger are considered corrupt.
+	MaxMsgSize int
+
+	r      io.Reader
+	err    error  // sticky error from r
+	buf    []byte // holds buffered data in buf[start:end]
+	start  int
+	end    int
+	offset int64 // stream offset of buf[start]
+}
+
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{
+		MaxMsgSize: DefaultMaxMsgSize,
+		r:          r,
+		buf:        make([]byte, 32*1024),
+	}
+}
+
+// ReadMsg returns the next message in the stream.
+// The returned slice is only valid until the next call to ReadMsg.
+// It returns io.EOF once the stream is exhausted, and a *FrameError when
+// a corrupt frame was skipped, after which ReadMsg can be called again.
+func (s *StreamReader) ReadMsg() ([]byte, error) {
+	if !s.fill(frameHeaderSize) {
+		if s.end == s.start {
+			return nil, s.err
+		}
+		if s.err != io.EOF {
+			return nil, s.err
+		}
+		return nil, s.resync(fmt.Errorf("%w: truncated frame header", ErrTooSmall))
+	}
+	hdr := s.buf[s.start : s.start+frameHeaderSize]
+	if !bytes.Equal(hdr[:2], frameMagic) {
+		return nil, s.resync(ErrBadMagic)
+	}
+	size := binary.BigEndian.Uint32(hdr[2:])
+	if uint64(size) > uint64(s.MaxMsgSize) {
+		return nil, s.resync(fmt.Errorf("%w: message size %d exceeds max of %d", ErrInvalidSize, size, s.MaxMsgSize))
+	}
+	if !s.fill(frameHeaderSize + int(size)) {
+		if s.err != io.EOF {
+			return nil, s.err
+		}
+		return nil, s.resync(fmt.Errorf("%w: truncated frame", ErrTooSmall))
+	}
+	hdr = s.buf[s.start : s.start+frameHeaderSize]
+	msg := s.buf[s.start+frameHeaderSize : s.start+frameHeaderSize+int(size)]
+	expected := binary.BigEndian.Uint32(hdr[6:])
+	if actual := crc32.Checksum(msg, crc32cTable); actual != expected {
+		return nil, s.resync(ChecksumError{
+			Expected: expected,
+			Actual:   actual,
+			Size:     len(msg),
+		})
+	}
+	s.advance(frameHeaderSize + int(size))
+	return msg, nil
+}
+
+// resync skips over the frame at the current position and any data up to the next frame magic
+func (s *StreamReader) resync(cause error) error {
+	err := &FrameError{
+		Offset: s.offset,
+		Err:    cause,
+	}
+	s.advance(1)
+	for {
+		i := bytes.Index(s.buf[s.start:s.end], frameMagic)
+		if i >= 0 {
+			s.advance(i)
+			break
+		}
+		// keep the last byte, it may be the start of the next magic
+		if s.end-s.start > 1 {
+			s.advance(s.end - s.start - 1)
+		}
+		if !s.fill(s.end - s.start + 1) {
+			s.advance(s.end - s.start)
+			break
+		}
+	}
+	err.Skipped = s.offset - err.Offset
+	return err
+}
+
+// fill makes sure at least n bytes are buffered, reading from the underlying reader as needed.
+// it returns false if that was not possible due to an error, which is then stored in s.err
+func (s *StreamReader) fill(n int) bool {
+	if s.end-s.start >= n {
+		return true
+	}
+	if s.start > 0 {
+		s.end = copy(s.buf, s.buf[s.start:s.end])
+		s.start = 0
+	}
+	for s.end < n && s.err == nil {
+		if s.end == len(s.buf) {
+			// grow gradually, so a corrupt frame size can't make us allocate much more than the stream holds
+			size := 2 * len(s.buf)
+			if size > n {
+				size = n
+			}
+			buf := make([]byte, size)
+			copy(buf, s.buf[:s.end])
+			s.buf = buf
+		}
+		var read int
+		read, s.err = s.r.Read(s.buf[s.end:])
+		s.end += read
+	}
+	return s.end >= n
+}
+
+func (s *StreamReader) advance(n int) {
+	s.start += n
+	s.offset += int64(n)
+}
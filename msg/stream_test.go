@@ -0,0 +1,219 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func getStreamMsgs(t *testing.T) [][]byte {
+	var msgs [][]byte
+	for i := 0; i < 5; i++ {
+		data, err := CreateMsg(getMetricData(i*100), int64(i), FormatMetricDataArrayMsgp)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		msgs = append(msgs, data)
+		data, err = WritePointArrayMsg(getPoints(i, 123), nil, FormatMetricPointArray)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		msgs = append(msgs, data)
+	}
+	return msgs
+}
+
+func writeStream(t *testing.T, msgs [][]byte) []byte {
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf)
+	for _, m := range msgs {
+		if err := w.WriteMsg(m); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	return buf.Bytes()
+}
+
+// readStream reads all messages from the stream and returns them along with all FrameErrors
+func readStream(t *testing.T, r *StreamReader) ([][]byte, []*FrameError) {
+	var msgs [][]byte
+	var frameErrs []*FrameError
+	for {
+		m, err := r.ReadMsg()
+		if err == io.EOF {
+			return msgs, frameErrs
+		}
+		if ferr, ok := err.(*FrameError); ok {
+			frameErrs = append(frameErrs, ferr)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		msgs = append(msgs, append([]byte(nil), m...))
+	}
+}
+
+func TestStream(t *testing.T) {
+	msgs := getStreamMsgs(t)
+	stream := writeStream(t, msgs)
+
+	readers := map[string]io.Reader{
+		"plain":   bytes.NewReader(stream),
+		"onebyte": iotest.OneByteReader(bytes.NewReader(stream)),
+		"half":    iotest.HalfReader(bytes.NewReader(stream)),
+	}
+	for name, r := range readers {
+		got, frameErrs := readStream(t, NewStreamReader(r))
+		if len(frameErrs) != 0 {
+			t.Fatalf("%s: expected no frame errors, got %v", name, frameErrs)
+		}
+		if !reflect.DeepEqual(msgs, got) {
+			t.Fatalf("%s: expected %d messages, got %d that don't match", name, len(msgs), len(got))
+		}
+	}
+}
+
+func TestStreamResync(t *testing.T) {
+	msgs := getStreamMsgs(t)
+	frames := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		frames[i] = writeStream(t, [][]byte{m})
+	}
+
+	type testCase struct {
+		stream       []byte
+		expMsgs      [][]byte
+		expFrameErrs int
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	corruptBody := append([]byte(nil), frames[2]...)
+	corruptBody[len(corruptBody)-1] ^= 0xFF
+	corruptLen := append([]byte(nil), frames[2]...)
+	corruptLen[2] = 0xFF
+
+	cases := []testCase{
+		// garbage at the start
+		{join([]byte("garbage"), frames[0], frames[1]), msgs[:2], 1},
+		// garbage between frames
+		{join(frames[0], []byte("garbage"), frames[1]), msgs[:2], 1},
+		// a frame with a corrupt body
+		{join(frames[0], frames[1], corruptBody, frames[3]), [][]byte{msgs[0], msgs[1], msgs[3]}, 1},
+		// a frame with a corrupt length
+		{join(frames[0], corruptLen, frames[3]), [][]byte{msgs[0], msgs[3]}, 1},
+		// a truncated frame followed by a good one
+		{join(frames[0], frames[2][:len(frames[2])/2], frames[3]), [][]byte{msgs[0], msgs[3]}, 1},
+		// a truncated frame at the end
+		{join(frames[0], frames[2][:len(frames[2])/2]), msgs[:1], 1},
+		// a truncated frame header at the end
+		{join(frames[0], frames[2][:5]), msgs[:1], 1},
+	}
+	for i, c := range cases {
+		got, frameErrs := readStream(t, NewStreamReader(bytes.NewReader(c.stream)))
+		if len(frameErrs) != c.expFrameErrs {
+			t.Fatalf("case %d: expected %d frame errors, got %v", i, c.expFrameErrs, frameErrs)
+		}
+		if !reflect.DeepEqual(c.expMsgs, got) {
+			t.Fatalf("case %d: expected %d messages, got %d that don't match", i, len(c.expMsgs), len(got))
+		}
+	}
+}
+
+func TestStreamMaxMsgSize(t *testing.T) {
+	msgs := [][]byte{
+		[]byte("small"),
+		bytes.Repeat([]byte("large"), 100),
+		[]byte("small again"),
+	}
+	r := NewStreamReader(bytes.NewReader(writeStream(t, msgs)))
+	r.MaxMsgSize = 100
+	got, frameErrs := readStream(t, r)
+	if len(frameErrs) != 1 {
+		t.Fatalf("expected 1 frame error, got %v", frameErrs)
+	}
+	if !reflect.DeepEqual([][]byte{msgs[0], msgs[2]}, got) {
+		t.Fatalf("expected the small messages, got %q", got)
+	}
+}
+
+func TestStreamLargeSize(t *testing.T) {
+	// a truncated frame claiming a size just under the max should not be allocated up front
+	data := append([]byte{}, frameMagic...)
+	data = binary.BigEndian.AppendUint32(data, DefaultMaxMsgSize-1)
+	data = append(data, 0, 0, 0, 0, 'f', 'o', 'o')
+	r := NewStreamReader(bytes.NewReader(data))
+	_, frameErrs := readStream(t, r)
+	if len(frameErrs) != 1 || !errors.Is(frameErrs[0], ErrTooSmall) {
+		t.Fatalf("expected a single truncated frame error, got %v", frameErrs)
+	}
+	if len(r.buf) >= DefaultMaxMsgSize {
+		t.Fatalf("expected the buffer to not be grown to the claimed size, got %d", len(r.buf))
+	}
+}
+
+func TestStreamReplay(t *testing.T) {
+	metrics := getMetricData(10)
+	data, err := CreateMsg(metrics, 1234567890, FormatMetricDataArrayMsgp.WithChecksum())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	r := NewStreamReader(bytes.NewReader(writeStream(t, [][]byte{data})))
+	m, err := r.ReadMsg()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var c collector
+	err = Decode(m, 6, &c)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(metrics, c.metrics) {
+		t.Fatal("metrics mismatch after replay")
+	}
+}
+
+// FuzzStreamReader checks that StreamReader gets through arbitrary input without panicking,
+// and only returns messages that match their checksum.
+func FuzzStreamReader(f *testing.F) {
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf)
+	for _, m := range [][]byte{[]byte("foo"), nil, bytes.Repeat([]byte("bar"), 100)} {
+		w.WriteMsg(m)
+	}
+	f.Add(buf.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewStreamReader(iotest.HalfReader(bytes.NewReader(data)))
+		var read int64
+		for {
+			m, err := r.ReadMsg()
+			if err == io.EOF {
+				break
+			}
+			if ferr, ok := err.(*FrameError); ok {
+				if ferr.Offset != read || ferr.Skipped <= 0 {
+					t.Fatalf("frame error at offset %d skipping %d bytes, expected offset %d", ferr.Offset, ferr.Skipped, read)
+				}
+				read += ferr.Skipped
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+			hdr := data[read : read+frameHeaderSize]
+			if binary.BigEndian.Uint32(hdr[6:]) != crc32.Checksum(m, crc32cTable) {
+				t.Fatalf("message at offset %d does not match its checksum", read)
+			}
+			read += frameHeaderSize + int64(len(m))
+		}
+		if read != int64(len(data)) {
+			t.Fatalf("expected to consume %d bytes, got %d", len(data), read)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+var ErrInvalidTombstone = errors.New("invalid tombstone")
+
+// Tombstone requests the deletion of series.
+type Tombstone struct {
+	// Time is the unix timestamp at which the deletion was requested.
+	// consumers should not delete data that was ingested after it.
+	Time int64
+	// Keys are the series to delete. An AMKey without archive denotes the series
+	// including all its rollup archives, otherwise only the given archive is denoted.
+	Keys []schema.AMKey
+	// Orgs are the orgs of which all series should be deleted
+	Orgs []uint32
+}
+
+// the body of a FormatTombstone message is laid out as follows (little endian):
+// 8B time
+// 4B number of keys
+// 22B per key (16B key, 4B org, 2B archive)
+// 4B number of orgs
+// 4B per org
+const tombstoneKeySize = 22
+
+// Deletes returns whether the tombstone requests deletion of the given series or archive
+func (t *Tombstone) Deletes(amk schema.AMKey) bool {
+	for _, org := range t.Orgs {
+		if org == amk.MKey.Org {
+			return true
+		}
+	}
+	for _, k := range t.Keys {
+		if k.MKey == amk.MKey && (k.Archive == 0 || k.Archive == amk.Archive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshal appends the encoded tombstone to b
+func (t *Tombstone) Marshal(b []byte) []byte {
+	l := len(b)
+	size := 8 + 4 + len(t.Keys)*tombstoneKeySize + 4 + len(t.Orgs)*4
+	if cap(b)-l < size {
+		o := make([]byte, l, l+size)
+		copy(o, b)
+		b = o
+	}
+	b = b[:l+size]
+	binary.LittleEndian.PutUint64(b[l:], uint64(t.Time))
+	binary.LittleEndian.PutUint32(b[l+8:], uint32(len(t.Keys)))
+	pos := l + 12
+	for _, k := range t.Keys {
+		copy(b[pos:], k.MKey.Key[:])
+		binary.LittleEndian.PutUint32(b[pos+16:], k.MKey.Org)
+		binary.LittleEndian.PutUint16(b[pos+20:], uint16(k.Archive))
+		pos += tombstoneKeySize
+	}
+	binary.LittleEndian.PutUint32(b[pos:], uint32(len(t.Orgs)))
+	pos += 4
+	for _, org := range t.Orgs {
+		binary.LittleEndian.PutUint32(b[pos:], org)
+		pos += 4
+	}
+	return b
+}
+
+// Unmarshal decodes the tombstone in b, re-using t.Keys and t.Orgs if possible
+func (t *Tombstone) Unmarshal(b []byte) error {
+	if len(b) < 12 {
+		return ErrInvalidTombstone
+	}
+	t.Time = int64(binary.LittleEndian.Uint64(b))
+	numKeys := binary.LittleEndian.Uint32(b[8:])
+	b = b[12:]
+	if uint64(len(b)) < uint64(numKeys)*tombstoneKeySize+4 {
+		return ErrInvalidTombstone
+	}
+	t.Keys = t.Keys[:0]
+	for i := uint32(0); i < numKeys; i++ {
+		var k schema.AMKey
+		copy(k.MKey.Key[:], b[:16])
+		k.MKey.Org = binary.LittleEndian.Uint32(b[16:])
+		k.Archive = schema.Archive(binary.LittleEndian.Uint16(b[20:]))
+		t.Keys = append(t.Keys, k)
+		b = b[tombstoneKeySize:]
+	}
+	numOrgs := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) != uint64(numOrgs)*4 {
+		return ErrInvalidTombstone
+	}
+	t.Orgs = t.Orgs[:0]
+	for i := uint32(0); i < numOrgs; i++ {
+		t.Orgs = append(t.Orgs, binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	}
+	return nil
+}
+
+// TombstoneMsg holds a FormatTombstone message
+type TombstoneMsg struct {
+	Id          int64
+	Tombstone   Tombstone
+	Produced    time.Time
+	Format      Format
+	Compression Compression
+	Headers     Headers
+	Msg         []byte
+}
+
+// parses format and id (cheap), but doesn't decode the tombstone just yet.
+// for messages using the checksummed envelope, it also verifies the checksum of the body
+// and returns an Error caused by a ChecksumError on mismatch.
+func (m *TombstoneMsg) InitFromMsg(msg []byte) error {
+	if len(msg) < envelopeV0HeaderSize {
+		return decodeError(0, "", -1, ErrTooSmall)
+	}
+	m.Msg = msg
+
+	m.Format = Format(msg[0]).Base()
+	m.Compression = Format(msg[0]).Compression()
+	if m.Format != FormatTombstone {
+		return decodeError(Format(msg[0]), "format", 0, ErrUnsupportedFormat)
+	}
+
+	var err error
+	m.Id, m.Headers, err = initEnvelope(msg)
+	m.Produced = time.Unix(0, m.Id)
+	return err
+}
+
+// DecodeTombstone decodes the message into m.Tombstone
+func (m *TombstoneMsg) DecodeTombstone() error {
+	body, buf, err := openBody(m.Msg)
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		defer putBuffer(buf)
+	}
+	err = m.Tombstone.Unmarshal(body)
+	if err != nil {
+		return decodeError(Format(m.Msg[0]), "body", -1, err)
+	}
+	m.Msg = nil // no more need for the original input
+	return nil
+}
+
+// CreateTombstoneMsg is like CreateMsg, but for a Tombstone.
+// version must be FormatTombstone, optionally with compression and/or the checksummed envelope.
+func CreateTombstoneMsg(t Tombstone, id int64, version Format) ([]byte, error) {
+	if version.Base() != FormatTombstone {
+		return nil, encodeError(version, "format", ErrUnsupportedFormat)
+	}
+	return writeMsg(version, id, nil, func(b []byte) ([]byte, error) {
+		return t.Marshal(b), nil
+	})
+}
@@ -0,0 +1,146 @@
+package msg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func getTombstone() Tombstone {
+	points := getPoints(3, 123)
+	return Tombstone{
+		Time: 1512345678,
+		Keys: []schema.AMKey{
+			{MKey: points[0].MKey},
+			{MKey: points[1].MKey, Archive: schema.NewArchive(schema.Sum, 600)},
+		},
+		Orgs: []uint32{7, 8},
+	}
+}
+
+func TestCreateDecodeTombstoneMsg(t *testing.T) {
+	exp := getTombstone()
+	cases := []Tombstone{
+		exp,
+		{Time: 1512345678, Orgs: []uint32{7}},
+		{Time: 1512345678, Keys: exp.Keys},
+	}
+	for i, ts := range cases {
+		for _, version := range []Format{FormatTombstone, FormatTombstone.Compressed(CompressionGzip).WithChecksum()} {
+			data, err := CreateTombstoneMsg(ts, 1234567890, version)
+			if err != nil {
+				t.Fatalf("case %d/%d: %s", i, version, err.Error())
+			}
+			var tm TombstoneMsg
+			err = tm.InitFromMsg(data)
+			if err != nil {
+				t.Fatalf("case %d/%d: %s", i, version, err.Error())
+			}
+			if tm.Id != 1234567890 || tm.Format != FormatTombstone {
+				t.Fatalf("case %d/%d: got id %d, format %s", i, version, tm.Id, tm.Format)
+			}
+			err = tm.DecodeTombstone()
+			if err != nil {
+				t.Fatalf("case %d/%d: %s", i, version, err.Error())
+			}
+			if tm.Tombstone.Time != ts.Time || len(tm.Tombstone.Keys) != len(ts.Keys) || len(tm.Tombstone.Orgs) != len(ts.Orgs) {
+				t.Fatalf("case %d/%d: expected tombstone %v, got %v", i, version, ts, tm.Tombstone)
+			}
+			for j := range ts.Keys {
+				if ts.Keys[j] != tm.Tombstone.Keys[j] {
+					t.Fatalf("case %d/%d: expected key %v, got %v", i, version, ts.Keys[j], tm.Tombstone.Keys[j])
+				}
+			}
+			for j := range ts.Orgs {
+				if ts.Orgs[j] != tm.Tombstone.Orgs[j] {
+					t.Fatalf("case %d/%d: expected org %d, got %d", i, version, ts.Orgs[j], tm.Tombstone.Orgs[j])
+				}
+			}
+		}
+	}
+	if _, err := CreateTombstoneMsg(exp, 1, FormatMetricDataArrayMsgp); err == nil {
+		t.Fatal("expected error for unsupported format, got nil")
+	}
+}
+
+func TestTombstoneDeletes(t *testing.T) {
+	ts := getTombstone()
+	points := getPoints(3, 123)
+	cases := []struct {
+		amk schema.AMKey
+		exp bool
+	}{
+		{schema.AMKey{MKey: points[0].MKey}, true},
+		{schema.AMKey{MKey: points[0].MKey, Archive: schema.NewArchive(schema.Sum, 600)}, true},
+		{schema.AMKey{MKey: points[1].MKey}, false},
+		{schema.AMKey{MKey: points[1].MKey, Archive: schema.NewArchive(schema.Sum, 600)}, true},
+		{schema.AMKey{MKey: points[1].MKey, Archive: schema.NewArchive(schema.Max, 600)}, false},
+		{schema.AMKey{MKey: points[2].MKey}, false},
+		{schema.AMKey{MKey: schema.MKey{Key: points[2].MKey.Key, Org: 7}}, true},
+		{schema.AMKey{MKey: schema.MKey{Key: points[2].MKey.Key, Org: 8}, Archive: schema.NewArchive(schema.Max, 600)}, true},
+	}
+	for i, c := range cases {
+		if ts.Deletes(c.amk) != c.exp {
+			t.Fatalf("case %d: expected Deletes(%s) to be %t", i, c.amk, c.exp)
+		}
+	}
+}
+
+func TestTombstoneUnmarshalInvalid(t *testing.T) {
+	ts := getTombstone()
+	data := ts.Marshal(nil)
+	for _, l := range []int{0, 11, 12, 12 + tombstoneKeySize, len(data) - 1} {
+		var out Tombstone
+		if err := out.Unmarshal(data[:l]); err == nil {
+			t.Fatalf("expected error unmarshaling %d of %d bytes, got nil", l, len(data))
+		}
+	}
+	var out Tombstone
+	if err := out.Unmarshal(append(data, 0)); err == nil {
+		t.Fatal("expected error unmarshaling with trailing data, got nil")
+	}
+}
+
+func TestDecodeTombstone(t *testing.T) {
+	ts := getTombstone()
+	data, err := CreateTombstoneMsg(ts, 1234567890, FormatTombstone)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var got []Tombstone
+	h := HandlerFuncs{
+		Tombstone: func(tm *TombstoneMsg) error {
+			got = append(got, tm.Tombstone)
+			return nil
+		},
+	}
+	err = Decode(data, 6, h)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(got) != 1 || !reflect.DeepEqual(ts, got[0]) {
+		t.Fatalf("expected tombstone %v, got %v", ts, got)
+	}
+
+	// collector does not implement TombstoneHandler
+	if err = Decode(data, 6, &collector{}); err == nil {
+		t.Fatal("expected error decoding tombstone with a Handler that can't handle it, got nil")
+	}
+}
+
+// FuzzTombstoneUnmarshal checks that Unmarshal rejects arbitrary input without panicking,
+// and that whatever it accepts re-encodes to the same bytes.
+func FuzzTombstoneUnmarshal(f *testing.F) {
+	ts := getTombstone()
+	f.Add(ts.Marshal(nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var out Tombstone
+		if err := out.Unmarshal(data); err != nil {
+			return
+		}
+		if buf := out.Marshal(nil); string(buf) != string(data) {
+			t.Fatalf("expected %v after re-encoding, got %v", data, buf)
+		}
+	})
+}
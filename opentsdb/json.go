@@ -0,0 +1,144 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/raintank/schema"
+)
+
+var (
+	ErrInvalidBody      = errors.New("expected a data point object or an array of them")
+	ErrInvalidDatapoint = errors.New("invalid data point")
+)
+
+// DatapointError is returned for a data point of an /api/put body that can't be converted
+type DatapointError struct {
+	Index  int    // the index of the data point in the body, starting at 0
+	Metric string // the metric of the data point, if known
+	Field  string // the part of the data point that is invalid: "datapoint", "metric", "timestamp", "value" or "tags"
+	// Err is the cause: ErrInvalidDatapoint, ErrEmptyName, ErrInvalidName, ErrInvalidTag, ErrInvalidValue or ErrInvalidTimestamp,
+	// or an error of strconv
+	Err error
+}
+
+func (e *DatapointError) Error() string {
+	return fmt.Sprintf("opentsdb: cannot convert %s of data point %d %q: %s", e.Field, e.Index, e.Metric, e.Err)
+}
+
+func (e *DatapointError) Unwrap() error {
+	return e.Err
+}
+
+// datapoint is a data point of an /api/put body.
+// the timestamp and value may be numbers or strings, so they are parsed separately.
+type datapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.RawMessage   `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// ParseJSON converts the body of an /api/put request, a single data point object or an array of them:
+//
+//	[{"metric": "sys.cpu.nice", "timestamp": 1346846400, "value": 18, "tags": {"host": "web01"}}]
+//
+// into MetricData, with their Id set. Data points are converted like put lines, see ParseLine;
+// their timestamp and value may also be strings holding a number.
+// An error is returned only if data is not such a body. Otherwise, the metrics of all valid data points
+// are returned, along with an error for every invalid one.
+func (p *Parser) ParseJSON(data []byte) ([]*schema.MetricData, []*DatapointError, error) {
+	var raw []json.RawMessage
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' && json.Valid(data) {
+		raw = []json.RawMessage{data}
+	} else if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidBody, err)
+	} else if raw == nil {
+		return nil, nil, ErrInvalidBody
+	}
+
+	var metrics []*schema.MetricData
+	var errs []*DatapointError
+	for i, r := range raw {
+		md, err := p.convert(r)
+		if err != nil {
+			err.Index = i
+			errs = append(errs, err)
+			continue
+		}
+		metrics = append(metrics, md)
+	}
+	return metrics, errs, nil
+}
+
+// convert converts a single data point of an /api/put body
+func (p *Parser) convert(data json.RawMessage) (*schema.MetricData, *DatapointError) {
+	var dp datapoint
+	if err := json.Unmarshal(data, &dp); err != nil {
+		return nil, &DatapointError{Field: "datapoint", Err: fmt.Errorf("%w: %s", ErrInvalidDatapoint, err)}
+	}
+	fail := func(field string, err error) *DatapointError {
+		return &DatapointError{Metric: dp.Metric, Field: field, Err: err}
+	}
+	if err := checkName(dp.Metric); err != nil {
+		return nil, fail("metric", err)
+	}
+
+	s, err := numeric(dp.Timestamp)
+	if err != nil {
+		return nil, fail("timestamp", fmt.Errorf("%w: %s", ErrInvalidTimestamp, err))
+	}
+	ts, err := parseTimestamp(s)
+	if err != nil {
+		return nil, fail("timestamp", err)
+	}
+	s, err = numeric(dp.Value)
+	if err != nil {
+		return nil, fail("value", fmt.Errorf("%w: %s", ErrInvalidValue, err))
+	}
+	value, err := parseValue(s)
+	if err != nil {
+		return nil, fail("value", err)
+	}
+
+	keys := make([]string, 0, len(dp.Tags))
+	for k := range dp.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tag := k + "=" + dp.Tags[k]
+		if !schema.ValidateTagKey(k) {
+			return nil, fail("tags", fmt.Errorf("%w %q", ErrInvalidTag, tag))
+		}
+		if err := checkTag(tag, tags); err != nil {
+			return nil, fail("tags", err)
+		}
+		tags = append(tags, tag)
+	}
+	return p.metric(dp.Metric, ts, value, tags), nil
+}
+
+// numeric returns the text of a JSON number, or the contents of a JSON string
+func numeric(data json.RawMessage) (string, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return "", errors.New("missing")
+	}
+	if data[0] != '"' {
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return "", errors.New("not a number or string")
+		}
+		return n.String(), nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
@@ -0,0 +1,134 @@
+package opentsdb
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestParseJSON(t *testing.T) {
+	cases := []struct {
+		data string
+		exp  []*schema.MetricData
+	}{
+		{
+			`{"metric": "sys.cpu.nice", "timestamp": 1346846400, "value": 18, "tags": {"host": "web01", "dc": "lga"}}`,
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "sys.cpu.nice", Interval: 10, Value: 18, Time: 1346846400, Mtype: "gauge", Tags: []string{"dc=lga", "host=web01"}},
+			},
+		},
+		{
+			` [
+				{"metric": "sys.cpu.nice", "timestamp": 1346846400000, "value": 18.5, "tags": {"host": "web01"}},
+				{"metric": "sys.cpu.nice", "timestamp": "1346846410", "value": "-2", "tags": {"host": "web02"}},
+				{"metric": "a", "timestamp": 1346846400.250, "value": 1e3}
+			] `,
+			[]*schema.MetricData{
+				{OrgId: 1, Name: "sys.cpu.nice", Interval: 10, Value: 18.5, Time: 1346846400, Mtype: "gauge", Tags: []string{"host=web01"}},
+				{OrgId: 1, Name: "sys.cpu.nice", Interval: 10, Value: -2, Time: 1346846410, Mtype: "gauge", Tags: []string{"host=web02"}},
+				{OrgId: 1, Name: "a", Interval: 10, Value: 1000, Time: 1346846400, Mtype: "gauge"},
+			},
+		},
+		{`[]`, nil},
+	}
+	for _, c := range cases {
+		for _, md := range c.exp {
+			md.SetId()
+		}
+		got, errs, err := NewParser(1, 10).ParseJSON([]byte(c.data))
+		if err != nil || errs != nil {
+			t.Fatalf("%s: unexpected errors %v and %v", c.data, errs, err)
+		}
+		if !reflect.DeepEqual(c.exp, got) {
+			t.Fatalf("%s: expected %v, got %v", c.data, c.exp, got)
+		}
+	}
+}
+
+func TestParseJSONInvalidDatapoint(t *testing.T) {
+	data := `[
+		{"metric": "a", "timestamp": 1, "value": 1},
+		[],
+		{"metric": "b", "timestamp": 1, "value": 1, "tags": {"host": 1}},
+		{"timestamp": 1, "value": 1},
+		{"metric": "a;b=c", "timestamp": 1, "value": 1},
+		{"metric": "a=b", "timestamp": 1, "value": 1},
+		{"metric": "a b", "timestamp": 1, "value": 1},
+		{"metric": "c", "value": 1},
+		{"metric": "c", "timestamp": true, "value": 1},
+		{"metric": "c", "timestamp": -1, "value": 1},
+		{"metric": "c", "timestamp": "x", "value": 1},
+		{"metric": "c", "timestamp": 1, "value": null},
+		{"metric": "c", "timestamp": 1, "value": "NaN"},
+		{"metric": "c", "timestamp": 1, "value": ""},
+		{"metric": "c", "timestamp": 1, "value": 1, "tags": {"host": ""}},
+		{"metric": "c", "timestamp": 1, "value": 1, "tags": {"a=b": "c"}},
+		{"metric": "c", "timestamp": 1, "value": 1, "tags": {"name": "d"}},
+		{"metric": "d", "timestamp": 2, "value": 2, "tags": {"host": "x"}}
+	]`
+	exp := []struct {
+		metric string
+		field  string
+		err    error
+	}{
+		{"", "datapoint", ErrInvalidDatapoint},
+		{"", "datapoint", ErrInvalidDatapoint},
+		{"", "metric", ErrEmptyName},
+		{"a;b=c", "metric", ErrInvalidName},
+		{"a=b", "metric", ErrInvalidName},
+		{"a b", "metric", ErrInvalidName},
+		{"c", "timestamp", ErrInvalidTimestamp},
+		{"c", "timestamp", ErrInvalidTimestamp},
+		{"c", "timestamp", ErrInvalidTimestamp},
+		{"c", "timestamp", strconv.ErrSyntax},
+		{"c", "value", ErrInvalidValue},
+		{"c", "value", ErrInvalidValue},
+		{"c", "value", strconv.ErrSyntax},
+		{"c", "tags", ErrInvalidTag},
+		{"c", "tags", ErrInvalidTag},
+		{"c", "tags", ErrInvalidTag},
+	}
+	got, errs, err := NewParser(1, 10).ParseJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(errs) != len(exp) {
+		t.Fatalf("expected %d errors, got %d: %v", len(exp), len(errs), errs)
+	}
+	for i, e := range exp {
+		if errs[i].Index != i+1 || errs[i].Metric != e.metric || errs[i].Field != e.field || !errors.Is(errs[i], e.err) {
+			t.Fatalf("expected %s of data point %d %q caused by %q, got %s", e.field, i+1, e.metric, e.err, errs[i].Error())
+		}
+	}
+	metrics := []*schema.MetricData{
+		{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 1, Mtype: "gauge"},
+		{OrgId: 1, Name: "d", Interval: 10, Value: 2, Time: 2, Mtype: "gauge", Tags: []string{"host=x"}},
+	}
+	for _, md := range metrics {
+		md.SetId()
+	}
+	if !reflect.DeepEqual(metrics, got) {
+		t.Fatalf("expected %v, got %v", metrics, got)
+	}
+}
+
+func TestParseJSONInvalid(t *testing.T) {
+	cases := []string{
+		``,
+		`null`,
+		`1`,
+		`"a"`,
+		`{"metric": "a", "timestamp": 1, "value": 1`,
+		`[{"metric": "a", "timestamp": 1, "value": 1}`,
+		`{"metric": "a", "timestamp": 1, "value": 1} {}`,
+	}
+	for _, c := range cases {
+		got, errs, err := NewParser(1, 10).ParseJSON([]byte(c))
+		if !errors.Is(err, ErrInvalidBody) || got != nil || errs != nil {
+			t.Fatalf("%q: expected ErrInvalidBody, got %v, %v and %v", c, got, errs, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package opentsdb converts the data points that OpenTSDB collectors send into schema.MetricData,
+// both as lines of the telnet protocol:
+//
+//	put metric timestamp value [tagk=tagv...]
+//
+// and as bodies of the HTTP /api/put endpoint, see Parser.ParseJSON.
+// Timestamps are unix timestamps in seconds or, if they don't fit in 32 bits, in milliseconds,
+// and are normalized to seconds.
+package opentsdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/internal/lines"
+)
+
+var (
+	ErrMissingFields      = errors.New("expected \"put metric timestamp value [tagk=tagv...]\"")
+	ErrUnsupportedCommand = errors.New("unsupported command")
+	ErrEmptyName          = errors.New("metric is empty")
+	ErrInvalidName        = errors.New("invalid metric")
+	ErrInvalidTag         = errors.New("invalid tag")
+	ErrInvalidValue       = errors.New("invalid value")
+	ErrInvalidTimestamp   = errors.New("invalid timestamp")
+)
+
+// ParseError describes a telnet protocol line that is not a valid put command
+type ParseError struct {
+	Line   int    // the line number, starting at 1, or 0 if not known
+	Input  string // the line being parsed
+	Field  string // the part of the line that is invalid: "command", "metric", "timestamp", "value" or "tags"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: one of the errors above, or an error of strconv
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("opentsdb: cannot parse %s of line %d %q at offset %d: %s", e.Field, e.Line, e.Input, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("opentsdb: cannot parse %s of %q at offset %d: %s", e.Field, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parser turns OpenTSDB data points into MetricData.
+// OpenTSDB has no notion of orgs, intervals, mtypes or units, so those are taken from the Parser.
+type Parser struct {
+	OrgId    int
+	Interval int
+	Mtype    string
+	Unit     string
+}
+
+// NewParser returns a Parser for metrics of the given org and interval, of mtype gauge
+func NewParser(orgId, interval int) *Parser {
+	return &Parser{
+		OrgId:    orgId,
+		Interval: interval,
+		Mtype:    "gauge",
+	}
+}
+
+// ParseLine parses a single put line, with or without the trailing newline, and returns a MetricData with its Id set.
+// The metric may only consist of the characters OpenTSDB allows: letters, digits, '-', '_', '.' and '/'.
+// Tags must be valid according to schema.ValidateTag, can't be a name tag (see schema.IsNameTag),
+// and can't have a key that occurs more than once. Unlike OpenTSDB, data points without tags are accepted.
+func (p *Parser) ParseLine(line []byte) (*schema.MetricData, error) {
+	s := string(line)
+	fail := func(field string, offset int, err error) error {
+		return &ParseError{
+			Input:  s,
+			Field:  field,
+			Offset: offset,
+			Err:    err,
+		}
+	}
+
+	var words []string
+	var offsets []int
+	for i := 0; i < len(s); {
+		if isSpace(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && !isSpace(s[j]) {
+			j++
+		}
+		words = append(words, s[i:j])
+		offsets = append(offsets, i)
+		i = j
+	}
+	if len(words) == 0 {
+		return nil, fail("command", 0, ErrMissingFields)
+	}
+	if words[0] != "put" {
+		return nil, fail("command", offsets[0], fmt.Errorf("%w %q", ErrUnsupportedCommand, words[0]))
+	}
+	if len(words) < 4 {
+		return nil, fail("command", 0, ErrMissingFields)
+	}
+
+	if err := checkName(words[1]); err != nil {
+		return nil, fail("metric", offsets[1], err)
+	}
+	ts, err := parseTimestamp(words[2])
+	if err != nil {
+		return nil, fail("timestamp", offsets[2], err)
+	}
+	value, err := parseValue(words[3])
+	if err != nil {
+		return nil, fail("value", offsets[3], err)
+	}
+	tags := make([]string, 0, len(words)-4)
+	for i, tag := range words[4:] {
+		if err := checkTag(tag, tags); err != nil {
+			return nil, fail("tags", offsets[i+4], err)
+		}
+		tags = append(tags, tag)
+	}
+	return p.metric(words[1], ts, value, tags), nil
+}
+
+// metric returns the MetricData for a data point, with its tags sorted and its Id set
+func (p *Parser) metric(name string, ts int64, value float64, tags []string) *schema.MetricData {
+	md := &schema.MetricData{
+		OrgId:    p.OrgId,
+		Name:     name,
+		Interval: p.Interval,
+		Value:    value,
+		Unit:     p.Unit,
+		Time:     ts,
+		Mtype:    p.Mtype,
+	}
+	if len(tags) > 0 {
+		md.Tags = tags
+	}
+	md.SetId()
+	return md
+}
+
+// checkName returns an error if name is empty or has characters that OpenTSDB doesn't allow,
+// which also keeps out the ';' and '=' that would corrupt the name with tags
+func checkName(name string) error {
+	if name == "" {
+		return ErrEmptyName
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_./", r) {
+			return fmt.Errorf("%w %q", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// checkTag returns an error if tag is invalid, or has the same key as any of the previous tags
+func checkTag(tag string, previous []string) error {
+	if !schema.ValidateTag(tag) {
+		return fmt.Errorf("%w %q", ErrInvalidTag, tag)
+	}
+	if schema.IsNameTag(tag) {
+		return fmt.Errorf("%w %q: reserved key", ErrInvalidTag, tag)
+	}
+	key := tag[:strings.IndexByte(tag, '=')+1]
+	for _, t := range previous {
+		if strings.HasPrefix(t, key) {
+			return fmt.Errorf("%w %q: duplicate key", ErrInvalidTag, tag)
+		}
+	}
+	return nil
+}
+
+// parseTimestamp parses a positive unix timestamp, in seconds if it fits in 32 bits and in milliseconds otherwise,
+// as OpenTSDB does, or in seconds with a fractional part of up to 3 digits. the result is in seconds, truncated.
+func parseTimestamp(s string) (int64, error) {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		frac := s[i+1:]
+		if len(frac) == 0 || len(frac) > 3 || strings.Trim(frac, "0123456789") != "" {
+			return 0, fmt.Errorf("%w %q", ErrInvalidTimestamp, s)
+		}
+		ts, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if ts <= 0 || ts > math.MaxUint32 {
+			return 0, fmt.Errorf("%w %q", ErrInvalidTimestamp, s)
+		}
+		return ts, nil
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if ts <= 0 {
+		return 0, fmt.Errorf("%w %q", ErrInvalidTimestamp, s)
+	}
+	if ts > math.MaxUint32 {
+		ts /= 1000
+	}
+	return ts, nil
+}
+
+// parseValue parses an integer or floating point value, which must be finite
+func parseValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, ErrInvalidValue
+	}
+	return v, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Reader reads MetricData from telnet protocol lines
+type Reader struct {
+	p *Parser
+	s *lines.Scanner
+}
+
+// NewReader returns a Reader that parses the lines read from r using p
+func (p *Parser) NewReader(r io.Reader) *Reader {
+	return &Reader{
+		p: p,
+		s: lines.NewScanner(r),
+	}
+}
+
+// Read returns the data point of the next put line, skipping blank lines. Lines of other commands, such as
+// version or stats, result in a *ParseError with ErrUnsupportedCommand. After a *ParseError, reading continues
+// with the next line. io.EOF marks the end of r.
+func (r *Reader) Read() (*schema.MetricData, error) {
+	line, num, err := r.s.Next()
+	if err != nil {
+		return nil, err
+	}
+	md, err := r.p.ParseLine(line)
+	if err != nil {
+		err.(*ParseError).Line = num
+	}
+	return md, err
+}
@@ -0,0 +1,142 @@
+package opentsdb
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		line string
+		exp  *schema.MetricData
+	}{
+		{"put sys.cpu.user 1356998400 42.5 host=webserver01 cpu=0\n", &schema.MetricData{OrgId: 1, Name: "sys.cpu.user", Interval: 10, Value: 42.5, Time: 1356998400, Mtype: "gauge", Tags: []string{"cpu=0", "host=webserver01"}}},
+		{"put sys.cpu.user 1356998400500 42 host=webserver01", &schema.MetricData{OrgId: 1, Name: "sys.cpu.user", Interval: 10, Value: 42, Time: 1356998400, Mtype: "gauge", Tags: []string{"host=webserver01"}}},
+		{"put sys.cpu.user 1356998400.5 -1e3 host=webserver01\r\n", &schema.MetricData{OrgId: 1, Name: "sys.cpu.user", Interval: 10, Value: -1000, Time: 1356998400, Mtype: "gauge", Tags: []string{"host=webserver01"}}},
+		{"  put  a\t4294967295  1  ", &schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 4294967295, Mtype: "gauge"}},
+		{"put a 4294967296 1", &schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 4294967, Mtype: "gauge"}},
+		{"put a 1 16 b=c=d", &schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 16, Time: 1, Mtype: "gauge", Tags: []string{"b=c=d"}}},
+		{"put Sys/cpu-user_é.0 1 1", &schema.MetricData{OrgId: 1, Name: "Sys/cpu-user_é.0", Interval: 10, Value: 1, Time: 1, Mtype: "gauge"}},
+	}
+	for _, c := range cases {
+		c.exp.SetId()
+		got, err := NewParser(1, 10).ParseLine([]byte(c.line))
+		if err != nil {
+			t.Fatalf("%q: %s", c.line, err.Error())
+		}
+		if !reflect.DeepEqual(c.exp, got) {
+			t.Fatalf("%q: expected %+v, got %+v", c.line, *c.exp, *got)
+		}
+	}
+}
+
+func TestParseLineInvalid(t *testing.T) {
+	cases := []struct {
+		line   string
+		field  string
+		offset int
+		err    error
+	}{
+		{"", "command", 0, ErrMissingFields},
+		{"put a 1", "command", 0, ErrMissingFields},
+		{"version", "command", 0, ErrUnsupportedCommand},
+		{" PUT a 1 1", "command", 1, ErrUnsupportedCommand},
+		{"put a;b=c 1 1", "metric", 4, ErrInvalidName},
+		{"put a=b 1 1", "metric", 4, ErrInvalidName},
+		{"put a~b 1 1", "metric", 4, ErrInvalidName},
+		{"put a\xff 1 1", "metric", 4, ErrInvalidName},
+		{"put a 0 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a -1 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a 1356998400.1234 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a 1356998400. 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a 1356998400.-1 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a 4294967296.1 1", "timestamp", 6, ErrInvalidTimestamp},
+		{"put a .5 1", "timestamp", 6, strconv.ErrSyntax},
+		{"put a 1e9 1", "timestamp", 6, strconv.ErrSyntax},
+		{"put a 99999999999999999999 1", "timestamp", 6, strconv.ErrRange},
+		{"put a 1 x", "value", 8, strconv.ErrSyntax},
+		{"put a 1 NaN", "value", 8, ErrInvalidValue},
+		{"put a 1 -Inf", "value", 8, ErrInvalidValue},
+		{"put a 1 1 host", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 host=", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 =web01", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 host=~web01", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 host=web;01", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 name=b", "tags", 10, ErrInvalidTag},
+		{"put a 1 1 host=a cpu=0 host=b", "tags", 23, ErrInvalidTag},
+	}
+	for _, c := range cases {
+		_, err := NewParser(1, 10).ParseLine([]byte(c.line))
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%q: expected ParseError, got %v", c.line, err)
+		}
+		if pe.Field != c.field || pe.Offset != c.offset || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at offset %d caused by %q, got %s", c.line, c.field, c.offset, c.err, err.Error())
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	in := "put a 1500000000 1 host=x\n\n  \nversion\nput b 1500000000000 2\nput c 1 x\n"
+	r := NewParser(1, 10).NewReader(strings.NewReader(in))
+
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 1500000000, Mtype: "gauge", Tags: []string{"host=x"}},
+		{OrgId: 1, Name: "b", Interval: 10, Value: 2, Time: 1500000000, Mtype: "gauge"},
+	}
+	for _, md := range exp {
+		md.SetId()
+	}
+	md, err := r.Read()
+	if err != nil || !reflect.DeepEqual(exp[0], md) {
+		t.Fatalf("unexpected result %v and %v", md, err)
+	}
+	_, err = r.Read()
+	if pe, ok := err.(*ParseError); !ok || pe.Line != 4 || !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("expected ErrUnsupportedCommand on line 4, got %v", err)
+	}
+	md, err = r.Read()
+	if err != nil || !reflect.DeepEqual(exp[1], md) {
+		t.Fatalf("unexpected result %v and %v", md, err)
+	}
+	_, err = r.Read()
+	if pe, ok := err.(*ParseError); !ok || pe.Line != 6 || pe.Field != "value" {
+		t.Fatalf("expected an invalid value on line 6, got %v", err)
+	}
+	if _, err = r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// FuzzParseLine checks that ParseLine rejects arbitrary input without panicking,
+// and that whatever it accepts results in a valid metric.
+func FuzzParseLine(f *testing.F) {
+	f.Add([]byte("put sys.cpu.user 1356998400 42.5 host=webserver01 cpu=0"))
+	f.Add([]byte("put a 1356998400.5 1"))
+	p := NewParser(1, 10)
+	f.Fuzz(func(t *testing.T, line []byte) {
+		md, err := p.ParseLine(line)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("unexpected error %T: %s", err, err.Error())
+			}
+			return
+		}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("invalid metric %+v: %s", *md, err.Error())
+		}
+		if md.Time <= 0 {
+			t.Fatalf("invalid time %d", md.Time)
+		}
+		if strings.ContainsAny(md.Name, ";= ") {
+			t.Fatalf("invalid name %q", md.Name)
+		}
+	})
+}
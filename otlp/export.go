@@ -0,0 +1,87 @@
+package otlp
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+// Export returns an ExportMetricsServiceRequest holding the metrics, as a single resource and scope without attributes.
+// Metrics with the same name, mtype and unit become data points of a single OTLP metric, in order of first appearance,
+// with the tags as attributes, except for any "name" tag:
+//
+//   - counters become cumulative, monotonic sums.
+//   - counts become delta sums.
+//   - metrics of any other mtype become gauges.
+//
+// Metrics with a time that can't be represented in nanoseconds, such as negative times, are left out.
+// Converting the result back results in the same metrics, except that rates and timestamps become gauges.
+func Export(metrics []*schema.MetricData) *ExportMetricsServiceRequest {
+	var out []Metric
+	index := make(map[string]int)
+	for _, m := range metrics {
+		if m.Time < 0 || uint64(m.Time) > math.MaxUint64/uint64(time.Second) {
+			continue
+		}
+		dp := NumberDataPoint{
+			Attributes:   attributes(m.Tags),
+			TimeUnixNano: Uint64(uint64(m.Time) * uint64(time.Second)),
+			AsDouble:     new(Double),
+		}
+		*dp.AsDouble = Double(m.Value)
+
+		key := m.Name + "\x00" + m.Mtype + "\x00" + m.Unit
+		i, ok := index[key]
+		if !ok {
+			i = len(out)
+			index[key] = i
+			metric := Metric{
+				Name: m.Name,
+				Unit: m.Unit,
+			}
+			switch m.Mtype {
+			case "counter":
+				metric.Sum = &Sum{AggregationTemporality: TemporalityCumulative, IsMonotonic: true}
+			case "count":
+				metric.Sum = &Sum{AggregationTemporality: TemporalityDelta}
+			default:
+				metric.Gauge = &Gauge{}
+			}
+			out = append(out, metric)
+		}
+		if s := out[i].Sum; s != nil {
+			s.DataPoints = append(s.DataPoints, dp)
+		} else {
+			out[i].Gauge.DataPoints = append(out[i].Gauge.DataPoints, dp)
+		}
+	}
+	return &ExportMetricsServiceRequest{
+		ResourceMetrics: []ResourceMetrics{{
+			ScopeMetrics: []ScopeMetrics{{
+				Metrics: out,
+			}},
+		}},
+	}
+}
+
+// EncodeJSON returns the metrics as an ExportMetricsServiceRequest in the OTLP JSON encoding, see Export
+func EncodeJSON(metrics []*schema.MetricData) ([]byte, error) {
+	return json.Marshal(Export(metrics))
+}
+
+// attributes returns the string attributes for the tags, leaving out any "name" tag
+func attributes(tags []string) []KeyValue {
+	var out []KeyValue
+	for _, t := range tags {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 || t[:i] == "name" {
+			continue
+		}
+		value := t[i+1:]
+		out = append(out, KeyValue{Key: t[:i], Value: AnyValue{StringValue: &value}})
+	}
+	return out
+}
@@ -0,0 +1,51 @@
+package otlp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestEncodeJSON(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{OrgId: 1, Name: "a", Interval: 10, Value: 1, Unit: "By", Time: 1500000000, Mtype: "counter", Tags: []string{"host=x", "name=ignored"}},
+		{OrgId: 1, Name: "b", Interval: 10, Value: 0.5, Time: 1500000000, Mtype: "count"},
+		{OrgId: 1, Name: "a", Interval: 10, Value: 2, Unit: "By", Time: 1500000010, Mtype: "counter", Tags: []string{"host=y"}},
+		{OrgId: 1, Name: "c", Interval: 10, Value: 3, Time: 1500000000, Mtype: "rate"},
+		{OrgId: 1, Name: "d", Interval: 10, Value: 4, Time: -1, Mtype: "gauge"},
+	}
+	for _, md := range metrics {
+		md.SetId()
+	}
+	got, err := EncodeJSON(metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := `{"resourceMetrics":[{"resource":{},"scopeMetrics":[{"scope":{},"metrics":[` +
+		`{"name":"a","unit":"By","sum":{"dataPoints":[` +
+		`{"attributes":[{"key":"host","value":{"stringValue":"x"}}],"timeUnixNano":"1500000000000000000","asDouble":1},` +
+		`{"attributes":[{"key":"host","value":{"stringValue":"y"}}],"timeUnixNano":"1500000010000000000","asDouble":2}` +
+		`],"aggregationTemporality":2,"isMonotonic":true}},` +
+		`{"name":"b","sum":{"dataPoints":[{"timeUnixNano":"1500000000000000000","asDouble":0.5}],"aggregationTemporality":1}},` +
+		`{"name":"c","gauge":{"dataPoints":[{"timeUnixNano":"1500000000000000000","asDouble":3}]}}` +
+		`]}]}]}`
+	if string(got) != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	metrics := parseFixture(t)
+	data, err := EncodeJSON(metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	got, err := getParser().ParseJSON(data)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(metrics, got) {
+		t.Fatalf("expected %v after round trip, got %v", metrics, got)
+	}
+}
@@ -0,0 +1,304 @@
+// Package otlp converts between schema.MetricData and OpenTelemetry metrics in the OTLP JSON encoding,
+// as sent by OTLP/HTTP exporters.
+//
+// Every data point maps onto a MetricData, with the attributes of the data point, its scope and its resource as tags.
+// Data points of histograms map onto several MetricData, one per bucket and statistic.
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+var (
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrInvalidTemporality = errors.New("invalid aggregation temporality")
+	ErrInvalidHistogram   = errors.New("invalid histogram")
+	ErrMissingValue       = errors.New("data point without value")
+)
+
+// tags for the instrumentation scope of a metric
+const (
+	ScopeNameTag    = "otel.scope.name"
+	ScopeVersionTag = "otel.scope.version"
+)
+
+// Mtype returns the mtype for the data points of a sum with the given temporality and monotonicity.
+// Delta sums are counts, cumulative sums are counters if monotonic, and gauges otherwise.
+func Mtype(temporality Temporality, monotonic bool) (string, error) {
+	switch temporality {
+	case TemporalityDelta:
+		return "count", nil
+	case TemporalityCumulative:
+		if monotonic {
+			return "counter", nil
+		}
+		return "gauge", nil
+	}
+	return "", fmt.Errorf("%w %d", ErrInvalidTemporality, temporality)
+}
+
+// Parser turns OTLP metrics into MetricData.
+// The tenant of an export is up to the transport and data points have no fixed interval, so OrgId and Interval fill those in.
+type Parser struct {
+	OrgId    int
+	Interval int
+
+	// Now returns the time for data points without timestamp. time.Now is used if nil.
+	Now func() time.Time
+}
+
+// NewParser returns a Parser for metrics of the given org and interval
+func NewParser(orgId, interval int) *Parser {
+	return &Parser{
+		OrgId:    orgId,
+		Interval: interval,
+	}
+}
+
+// ParseJSON decodes an ExportMetricsServiceRequest in the OTLP JSON encoding and converts it, see Convert
+func (p *Parser) ParseJSON(data []byte) ([]*schema.MetricData, error) {
+	var req ExportMetricsServiceRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+	return p.Convert(&req)
+}
+
+// Convert returns a MetricData with its Id set for every data point in req:
+//
+//   - gauges map onto MetricData of mtype gauge.
+//   - sums map onto MetricData of the mtype returned by Mtype.
+//   - histograms map onto name.bucket with an "le" tag for the cumulative count of every bucket, name.count,
+//     and name.sum, name.min and name.max if present. the counts and sum are counts for delta histograms
+//     and counters for cumulative histograms, min and max are gauges.
+//
+// Tags are made from the attributes of the data point, the scope and the resource, where the former take precedence,
+// and the scope name and version (as ScopeNameTag and ScopeVersionTag). Attribute keys and values are sanitized
+// using schema.SanitizeTagKey and schema.SanitizeTagValue, and attributes with an empty key or value are left out.
+// A "name" attribute becomes an "exported_name" tag (see schema.SanitizeNameTagKey).
+// The unit is the unit of the metric, except for counts of histograms, which have no unit.
+// Data points flagged with FlagNoRecordedValue and data points whose value is NaN or infinite are skipped.
+func (p *Parser) Convert(req *ExportMetricsServiceRequest) ([]*schema.MetricData, error) {
+	now := p.now()
+	var out []*schema.MetricData
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			attrs := make(map[string]string)
+			addAttributes(attrs, rm.Resource.Attributes)
+			addAttributes(attrs, sm.Scope.Attributes)
+			addAttribute(attrs, ScopeNameTag, sm.Scope.Name)
+			addAttribute(attrs, ScopeVersionTag, sm.Scope.Version)
+			c := converter{
+				p:     p,
+				now:   now,
+				attrs: attrs,
+			}
+			for _, m := range sm.Metrics {
+				if err := c.convert(m); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, c.out...)
+		}
+	}
+	return out, nil
+}
+
+func (p *Parser) now() int64 {
+	if p.Now != nil {
+		return p.Now().Unix()
+	}
+	return time.Now().Unix()
+}
+
+// converter converts the metrics of a scope
+type converter struct {
+	p     *Parser
+	now   int64
+	attrs map[string]string // the attributes of the scope and resource
+	out   []*schema.MetricData
+}
+
+func (c *converter) convert(m Metric) error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: metric without name", ErrInvalidRequest)
+	}
+	switch {
+	case m.Gauge != nil:
+		for _, dp := range m.Gauge.DataPoints {
+			if err := c.number(m, "gauge", dp); err != nil {
+				return err
+			}
+		}
+	case m.Sum != nil:
+		mtype, err := Mtype(m.Sum.AggregationTemporality, m.Sum.IsMonotonic)
+		if err != nil {
+			return fmt.Errorf("%w of metric %q", err, m.Name)
+		}
+		for _, dp := range m.Sum.DataPoints {
+			if err := c.number(m, mtype, dp); err != nil {
+				return err
+			}
+		}
+	case m.Histogram != nil:
+		mtype, err := Mtype(m.Histogram.AggregationTemporality, true)
+		if err != nil {
+			return fmt.Errorf("%w of metric %q", err, m.Name)
+		}
+		for _, dp := range m.Histogram.DataPoints {
+			if err := c.histogram(m, mtype, dp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *converter) number(m Metric, mtype string, dp NumberDataPoint) error {
+	if dp.Flags&FlagNoRecordedValue != 0 {
+		return nil
+	}
+	var value float64
+	switch {
+	case dp.AsDouble != nil:
+		value = float64(*dp.AsDouble)
+	case dp.AsInt != nil:
+		value = float64(*dp.AsInt)
+	default:
+		return fmt.Errorf("%w in metric %q", ErrMissingValue, m.Name)
+	}
+	tags := c.tags(dp.Attributes)
+	c.add(m.Name, m.Unit, mtype, tags, value, dp.TimeUnixNano)
+	return nil
+}
+
+func (c *converter) histogram(m Metric, mtype string, dp HistogramDataPoint) error {
+	if dp.Flags&FlagNoRecordedValue != 0 {
+		return nil
+	}
+	if len(dp.BucketCounts) != 0 && len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+		return fmt.Errorf("%w %q: %d bucket counts for %d bounds", ErrInvalidHistogram, m.Name, len(dp.BucketCounts), len(dp.ExplicitBounds))
+	}
+	tags := c.tags(dp.Attributes)
+	var cumulative uint64
+	for i, count := range dp.BucketCounts {
+		cumulative += uint64(count)
+		le := "+Inf"
+		if i < len(dp.ExplicitBounds) {
+			le = strconv.FormatFloat(float64(dp.ExplicitBounds[i]), 'g', -1, 64)
+		}
+		c.add(m.Name+".bucket", "", mtype, withTag(tags, "le", le), float64(cumulative), dp.TimeUnixNano)
+	}
+	c.add(m.Name+".count", "", mtype, tags, float64(dp.Count), dp.TimeUnixNano)
+	if dp.Sum != nil {
+		c.add(m.Name+".sum", m.Unit, mtype, tags, float64(*dp.Sum), dp.TimeUnixNano)
+	}
+	if dp.Min != nil {
+		c.add(m.Name+".min", m.Unit, "gauge", tags, float64(*dp.Min), dp.TimeUnixNano)
+	}
+	if dp.Max != nil {
+		c.add(m.Name+".max", m.Unit, "gauge", tags, float64(*dp.Max), dp.TimeUnixNano)
+	}
+	return nil
+}
+
+// tags returns the sorted tags for a data point with the given attributes
+func (c *converter) tags(attributes []KeyValue) []string {
+	attrs := c.attrs
+	if len(attributes) > 0 {
+		attrs = make(map[string]string, len(c.attrs)+len(attributes))
+		for k, v := range c.attrs {
+			attrs[k] = v
+		}
+		addAttributes(attrs, attributes)
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// add adds a MetricData for a value at the given time in nanoseconds, unless the value is NaN or infinite
+func (c *converter) add(name, unit, mtype string, tags []string, value float64, ts Uint64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	t := c.now
+	if ts != 0 {
+		t = int64(uint64(ts) / uint64(time.Second))
+	}
+	md := &schema.MetricData{
+		OrgId:    c.p.OrgId,
+		Name:     name,
+		Interval: c.p.Interval,
+		Value:    value,
+		Unit:     unit,
+		Time:     t,
+		Mtype:    mtype,
+		Tags:     append([]string(nil), tags...),
+	}
+	md.SetId()
+	c.out = append(c.out, md)
+}
+
+// withTag returns a sorted copy of the tags with the tag key=value added, replacing any tag with the same key
+func withTag(tags []string, key, value string) []string {
+	out := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		if !strings.HasPrefix(t, key+"=") {
+			out = append(out, t)
+		}
+	}
+	out = append(out, key+"="+value)
+	sort.Strings(out)
+	return out
+}
+
+func addAttributes(attrs map[string]string, kvs []KeyValue) {
+	for _, kv := range kvs {
+		addAttribute(attrs, kv.Key, kv.Value.String())
+	}
+}
+
+// addAttribute sets a sanitized attribute, unless its key or value is empty
+func addAttribute(attrs map[string]string, key, value string) {
+	key = schema.SanitizeNameTagKey(schema.SanitizeTagKey(key))
+	value = schema.SanitizeTagValue(value)
+	if key == "" || value == "" {
+		return
+	}
+	attrs[key] = value
+}
+
+// Definitions returns a MetricDefinition for every distinct metric, in order of first appearance,
+// with LastUpdate set to the latest time of the metric
+func Definitions(metrics []*schema.MetricData) []*schema.MetricDefinition {
+	var out []*schema.MetricDefinition
+	byId := make(map[string]*schema.MetricDefinition)
+	for _, m := range metrics {
+		if def, ok := byId[m.Id]; ok {
+			if m.Time > def.LastUpdate {
+				def.LastUpdate = m.Time
+			}
+			continue
+		}
+		def := schema.MetricDefinitionFromMetricData(m)
+		byId[m.Id] = def
+		out = append(out, def)
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package otlp
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+var scopeTags = []string{
+	"host.name=overridden-by-scope",
+	"my.scope.attribute=some scope attribute",
+	"otel.scope.name=my.library",
+	"otel.scope.version=1.0.0",
+	"process.pid=4242",
+	"service.name=checkout",
+}
+
+func getParser() *Parser {
+	p := NewParser(1, 10)
+	p.Now = func() time.Time { return time.Unix(1600000000, 0) }
+	return p
+}
+
+func parseFixture(t testing.TB) []*schema.MetricData {
+	data, err := os.ReadFile("testdata/metrics.json")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	metrics, err := getParser().ParseJSON(data)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return metrics
+}
+
+func TestParseJSON(t *testing.T) {
+	got := parseFixture(t)
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "my.counter", Interval: 10, Value: 5, Unit: "1", Time: 1544712660, Mtype: "count", Tags: append([]string{"my.counter.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.gauge", Interval: 10, Value: 10, Unit: "1", Time: 1544712660, Mtype: "gauge", Tags: append([]string{"enabled=true", `list=["a",1]`, "my.gauge.attr=tilde_semicolon", "ratio=0.5"}, scopeTags...)},
+		{OrgId: 1, Name: "queue.size", Interval: 10, Value: -3, Unit: "{item}", Time: 1544712660, Mtype: "gauge", Tags: scopeTags},
+		{OrgId: 1, Name: "requests", Interval: 10, Value: 1200, Time: 1544712660, Mtype: "counter", Tags: scopeTags},
+		{OrgId: 1, Name: "my.histogram.bucket", Interval: 10, Value: 1, Time: 1544712660, Mtype: "count", Tags: append([]string{"le=1", "my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.bucket", Interval: 10, Value: 4, Time: 1544712660, Mtype: "count", Tags: append([]string{"le=10", "my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.bucket", Interval: 10, Value: 5, Time: 1544712660, Mtype: "count", Tags: append([]string{"le=+Inf", "my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.count", Interval: 10, Value: 5, Time: 1544712660, Mtype: "count", Tags: append([]string{"my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.sum", Interval: 10, Value: 42.5, Unit: "ms", Time: 1544712660, Mtype: "count", Tags: append([]string{"my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.min", Interval: 10, Value: 0.5, Unit: "ms", Time: 1544712660, Mtype: "gauge", Tags: append([]string{"my.histogram.attr=some value"}, scopeTags...)},
+		{OrgId: 1, Name: "my.histogram.max", Interval: 10, Value: 12, Unit: "ms", Time: 1544712660, Mtype: "gauge", Tags: append([]string{"my.histogram.attr=some value"}, scopeTags...)},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d metrics, got %d: %v", len(exp), len(got), got)
+	}
+	for i := range exp {
+		exp[i].SetId()
+		if !reflect.DeepEqual(exp[i], got[i]) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *exp[i], *got[i])
+		}
+		if err := got[i].Validate(); err != nil {
+			t.Fatalf("metric %d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestParseJSONNow(t *testing.T) {
+	got, err := getParser().ParseJSON([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"a","gauge":{"dataPoints":[{"asInt":"1"}]}}]}]}]}`))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := &schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 1600000000, Mtype: "gauge"}
+	exp.SetId()
+	if len(got) != 1 || !reflect.DeepEqual(exp, got[0]) {
+		t.Fatalf("expected %+v, got %v", *exp, got)
+	}
+}
+
+func TestParseJSONNameAttribute(t *testing.T) {
+	data := `{"resourceMetrics":[{"resource":{"attributes":[{"key":"name","value":{"stringValue":"c1"}}]},` +
+		`"scopeMetrics":[{"metrics":[{"name":"container.cpu","gauge":{"dataPoints":[{"timeUnixNano":"1500000000000000000","asInt":"1"}]}}]}]}]}`
+	got, err := getParser().ParseJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := &schema.MetricData{OrgId: 1, Name: "container.cpu", Interval: 10, Value: 1, Time: 1500000000, Mtype: "gauge", Tags: []string{"exported_name=c1"}}
+	exp.SetId()
+	if len(got) != 1 || !reflect.DeepEqual(exp, got[0]) {
+		t.Fatalf("expected %+v, got %v", *exp, got)
+	}
+
+	// the exported_name tag is exported as an attribute like any other, a name tag is left out
+	got[0].Tags = append(got[0].Tags, "name=x")
+	again, err := getParser().ParseJSON(mustEncode(t, got))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(again) != 1 || !reflect.DeepEqual(exp, again[0]) {
+		t.Fatalf("expected %+v after round trip, got %v", *exp, again)
+	}
+}
+
+func TestParseJSONInvalid(t *testing.T) {
+	wrap := func(metric string) string {
+		return `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[` + metric + `]}]}]}`
+	}
+	cases := []struct {
+		data string
+		err  error
+	}{
+		{`{"resourceMetrics":`, ErrInvalidRequest},
+		{`{"resourceMetrics":{}}`, ErrInvalidRequest},
+		{wrap(`{"gauge":{"dataPoints":[{"asInt":"1"}]}}`), ErrInvalidRequest},
+		{wrap(`{"name":"a","gauge":{"dataPoints":[{"asInt":"x"}]}}`), ErrInvalidRequest},
+		{wrap(`{"name":"a","gauge":{"dataPoints":[{"asDouble":"x"}]}}`), ErrInvalidRequest},
+		{wrap(`{"name":"a","gauge":{"dataPoints":[{"timeUnixNano":"-1","asInt":1}]}}`), ErrInvalidRequest},
+		{wrap(`{"name":"a","sum":{"aggregationTemporality":"DELTA","dataPoints":[]}}`), ErrInvalidRequest},
+		{wrap(`{"name":"a","gauge":{"dataPoints":[{"timeUnixNano":"1"}]}}`), ErrMissingValue},
+		{wrap(`{"name":"a","sum":{"dataPoints":[{"asInt":"1"}]}}`), ErrInvalidTemporality},
+		{wrap(`{"name":"a","histogram":{"aggregationTemporality":3,"dataPoints":[]}}`), ErrInvalidTemporality},
+		{wrap(`{"name":"a","histogram":{"aggregationTemporality":2,"dataPoints":[{"count":"1","bucketCounts":["1"],"explicitBounds":[1]}]}}`), ErrInvalidHistogram},
+	}
+	for _, c := range cases {
+		if _, err := getParser().ParseJSON([]byte(c.data)); !errors.Is(err, c.err) {
+			t.Fatalf("%s: expected %q, got %v", c.data, c.err, err)
+		}
+	}
+}
+
+func TestMtype(t *testing.T) {
+	cases := []struct {
+		temporality Temporality
+		monotonic   bool
+		exp         string
+	}{
+		{TemporalityDelta, true, "count"},
+		{TemporalityDelta, false, "count"},
+		{TemporalityCumulative, true, "counter"},
+		{TemporalityCumulative, false, "gauge"},
+	}
+	for _, c := range cases {
+		got, err := Mtype(c.temporality, c.monotonic)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if got != c.exp {
+			t.Fatalf("temporality %d, monotonic %t: expected %s, got %s", c.temporality, c.monotonic, c.exp, got)
+		}
+	}
+	if _, err := Mtype(TemporalityUnspecified, true); !errors.Is(err, ErrInvalidTemporality) {
+		t.Fatalf("expected ErrInvalidTemporality, got %v", err)
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 10, Mtype: "gauge"},
+		{OrgId: 1, Name: "b", Interval: 10, Value: 1, Time: 20, Mtype: "gauge"},
+		{OrgId: 1, Name: "a", Interval: 10, Value: 2, Time: 30, Mtype: "gauge"},
+		{OrgId: 1, Name: "a", Interval: 10, Value: 3, Time: 5, Mtype: "gauge"},
+	}
+	for _, md := range metrics {
+		md.SetId()
+	}
+	a, b := metrics[0], metrics[1]
+	defs := Definitions(metrics)
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 definitions, got %d", len(defs))
+	}
+	if defs[0].Id.String() != a.Id || defs[0].LastUpdate != 30 || defs[1].Id.String() != b.Id || defs[1].LastUpdate != 20 {
+		t.Fatalf("unexpected definitions %+v and %+v", *defs[0], *defs[1])
+	}
+}
+
+// FuzzParseJSON checks that ParseJSON rejects arbitrary input without panicking,
+// and that whatever it accepts results in valid metrics that survive a round trip.
+func FuzzParseJSON(f *testing.F) {
+	f.Add([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"a","gauge":{"dataPoints":[{"asInt":"1"}]}}]}]}]}`))
+	f.Add([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"h","histogram":{"aggregationTemporality":2,` +
+		`"dataPoints":[{"count":"1","bucketCounts":["1","0"],"explicitBounds":[1],"attributes":[{"key":"k","value":{"doubleValue":"NaN"}}]}]}}]}]}]}`))
+	p := getParser()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := p.ParseJSON(data)
+		if err != nil {
+			return
+		}
+		for _, md := range metrics {
+			if err := md.Validate(); err != nil {
+				t.Fatalf("invalid metric %+v: %s", *md, err.Error())
+			}
+		}
+		again, err := p.ParseJSON(mustEncode(t, metrics))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if len(again) != len(metrics) {
+			t.Fatalf("expected %d metrics after round trip, got %d", len(metrics), len(again))
+		}
+	})
+}
+
+func mustEncode(t *testing.T, metrics []*schema.MetricData) []byte {
+	data, err := EncodeJSON(metrics)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return data
+}
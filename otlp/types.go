@@ -0,0 +1,291 @@
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// the types below follow the JSON encoding of the OTLP metrics protobuf messages
+// (see opentelemetry/proto/collector/metrics/v1 and opentelemetry/proto/metrics/v1),
+// limited to the fields that are used. unknown fields are ignored when decoding.
+
+// ExportMetricsServiceRequest is the payload sent by OTLP/HTTP exporters to /v1/metrics
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+	SchemaUrl    string         `json:"schemaUrl,omitempty"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes,omitempty"`
+}
+
+type ScopeMetrics struct {
+	Scope     Scope    `json:"scope"`
+	Metrics   []Metric `json:"metrics"`
+	SchemaUrl string   `json:"schemaUrl,omitempty"`
+}
+
+// Scope is the instrumentation scope, i.e. the library that produced the metrics
+type Scope struct {
+	Name       string     `json:"name,omitempty"`
+	Version    string     `json:"version,omitempty"`
+	Attributes []KeyValue `json:"attributes,omitempty"`
+}
+
+// Metric holds the data points of a metric. Exactly one of Gauge, Sum and Histogram should be set.
+// Metrics of other types, such as exponential histograms and summaries, are not supported and are ignored.
+type Metric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *Gauge     `json:"gauge,omitempty"`
+	Sum         *Sum       `json:"sum,omitempty"`
+	Histogram   *Histogram `json:"histogram,omitempty"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality Temporality       `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic,omitempty"`
+}
+
+type Histogram struct {
+	DataPoints             []HistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality Temporality          `json:"aggregationTemporality"`
+}
+
+// FlagNoRecordedValue marks a data point as having no value, e.g. because its series went away
+const FlagNoRecordedValue = 1
+
+// NumberDataPoint is a data point of a gauge or sum. Exactly one of AsDouble and AsInt should be set.
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	AsDouble          *Double    `json:"asDouble,omitempty"`
+	AsInt             *Int64     `json:"asInt,omitempty"`
+	Flags             uint32     `json:"flags,omitempty"`
+}
+
+// HistogramDataPoint is a data point of a histogram with explicit bounds.
+// BucketCounts holds the count of every bucket, so it has one more entry than ExplicitBounds:
+// the count of values above the highest bound.
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	Count             Uint64     `json:"count"`
+	Sum               *Double    `json:"sum,omitempty"`
+	BucketCounts      []Uint64   `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []Double   `json:"explicitBounds,omitempty"`
+	Min               *Double    `json:"min,omitempty"`
+	Max               *Double    `json:"max,omitempty"`
+	Flags             uint32     `json:"flags,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue is an attribute value. At most one of its fields is set.
+type AnyValue struct {
+	StringValue *string       `json:"stringValue,omitempty"`
+	BoolValue   *bool         `json:"boolValue,omitempty"`
+	IntValue    *Int64        `json:"intValue,omitempty"`
+	DoubleValue *Double       `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `json:"kvlistValue,omitempty"`
+	BytesValue  []byte        `json:"bytesValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []AnyValue `json:"values"`
+}
+
+type KeyValueList struct {
+	Values []KeyValue `json:"values"`
+}
+
+// String returns the value as a string. Arrays and key-value lists are JSON encoded.
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+	case v.ArrayValue != nil, v.KvlistValue != nil, v.BytesValue != nil:
+		b, _ := json.Marshal(v.plain())
+		return string(b)
+	}
+	return ""
+}
+
+// plain returns the value as a plain go value, for JSON encoding
+func (v AnyValue) plain() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		if f := float64(*v.DoubleValue); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+		return v.String()
+	case v.ArrayValue != nil:
+		out := make([]interface{}, len(v.ArrayValue.Values))
+		for i, e := range v.ArrayValue.Values {
+			out[i] = e.plain()
+		}
+		return out
+	case v.KvlistValue != nil:
+		out := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			out[kv.Key] = kv.Value.plain()
+		}
+		return out
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
+
+// Temporality is the aggregation temporality of sums and histograms
+type Temporality int
+
+const (
+	TemporalityUnspecified Temporality = 0
+	TemporalityDelta       Temporality = 1
+	TemporalityCumulative  Temporality = 2
+)
+
+var temporalityNames = map[string]Temporality{
+	"AGGREGATION_TEMPORALITY_UNSPECIFIED": TemporalityUnspecified,
+	"AGGREGATION_TEMPORALITY_DELTA":       TemporalityDelta,
+	"AGGREGATION_TEMPORALITY_CUMULATIVE":  TemporalityCumulative,
+}
+
+// UnmarshalJSON accepts both the number and the name of the enum value, as protobuf JSON decoders do
+func (t *Temporality) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		v, ok := temporalityNames[name]
+		if !ok {
+			return fmt.Errorf("%w %q", ErrInvalidTemporality, name)
+		}
+		*t = v
+		return nil
+	}
+	var v int32
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*t = Temporality(v)
+	return nil
+}
+
+// Uint64 is a uint64 that is encoded as a JSON string, as protobuf JSON encoders do.
+// when decoding, numbers are accepted as well.
+type Uint64 uint64
+
+func (u Uint64) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, strconv.FormatUint(uint64(u), 10)), nil
+}
+
+func (u *Uint64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := strconv.ParseUint(unquote(b), 10, 64)
+	if err != nil {
+		return err
+	}
+	*u = Uint64(v)
+	return nil
+}
+
+// Int64 is an int64 that is encoded as a JSON string, as protobuf JSON encoders do.
+// when decoding, numbers are accepted as well.
+type Int64 int64
+
+func (i Int64) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, strconv.FormatInt(int64(i), 10)), nil
+}
+
+func (i *Int64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := strconv.ParseInt(unquote(b), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = Int64(v)
+	return nil
+}
+
+// Double is a float64 whose special values are encoded as the JSON strings "NaN", "Infinity" and "-Infinity",
+// as protobuf JSON encoders do. when decoding, numbers in strings are accepted as well.
+type Double float64
+
+func (d Double) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, 64), nil
+}
+
+func (d *Double) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var f float64
+	switch s := unquote(b); s {
+	case "NaN":
+		f = math.NaN()
+	case "Infinity":
+		f = math.Inf(1)
+	case "-Infinity":
+		f = math.Inf(-1)
+	default:
+		var err error
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("invalid double %s", b)
+		}
+	}
+	*d = Double(f)
+	return nil
+}
+
+// unquote strips the quotes from a JSON string without escapes, as used for numbers
+func unquote(b []byte) string {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return string(b[1 : len(b)-1])
+	}
+	return string(b)
+}
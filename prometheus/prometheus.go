@@ -0,0 +1,248 @@
+// Package prometheus converts between schema.MetricData and Prometheus metrics,
+// both in the text exposition format and as remote-write requests.
+//
+// Every Prometheus series maps onto MetricData of the same name, with the labels as tags.
+// Samples of histograms and summaries map onto the series Prometheus exposes for them
+// (name_bucket, name_sum, name_count and name with a quantile label), so that they survive a round trip.
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+var (
+	ErrInvalidName         = errors.New("invalid metric name")
+	ErrInvalidLabel        = errors.New("invalid label")
+	ErrInvalidValue        = errors.New("invalid value")
+	ErrInvalidTimestamp    = errors.New("invalid timestamp")
+	ErrInvalidWriteRequest = errors.New("invalid write request")
+)
+
+// metric types, as used in TYPE lines
+const (
+	TypeCounter        = "counter"
+	TypeGauge          = "gauge"
+	TypeHistogram      = "histogram"
+	TypeGaugeHistogram = "gaugehistogram"
+	TypeSummary        = "summary"
+	TypeInfo           = "info"
+	TypeStateset       = "stateset"
+	TypeUntyped        = "untyped"
+	TypeUnknown        = "unknown"
+)
+
+// Mtype returns the mtype of the series of the given name, of a family of the given name and type.
+// Cumulative series, i.e. counters and the buckets, counts and sums of histograms and summaries, are counters.
+// everything else is a gauge.
+func Mtype(typ, family, name string) string {
+	switch typ {
+	case TypeCounter:
+		return "counter"
+	case TypeHistogram:
+		switch name {
+		case family + "_bucket", family + "_count", family + "_sum":
+			return "counter"
+		}
+	case TypeSummary:
+		switch name {
+		case family + "_count", family + "_sum":
+			return "counter"
+		}
+	}
+	return "gauge"
+}
+
+// Type returns the type of the family for a metric of the given mtype
+func Type(mtype string) string {
+	switch mtype {
+	case "counter", "count":
+		return TypeCounter
+	}
+	return TypeGauge
+}
+
+// suffixes of series that belong to a family of another name
+var familySuffixes = []string{"_bucket", "_count", "_sum", "_total", "_created", "_gcount", "_gsum", "_info"}
+
+// family describes a metric family, as declared by TYPE and UNIT lines or remote-write metadata
+type family struct {
+	typ  string
+	unit string
+}
+
+// families holds the known families by name
+type families map[string]family
+
+// lookup returns the family that the series of the given name belongs to, and its name
+func (fs families) lookup(name string) (family, string) {
+	if f, ok := fs[name]; ok {
+		return f, name
+	}
+	for _, suffix := range familySuffixes {
+		if base := strings.TrimSuffix(name, suffix); base != name {
+			if f, ok := fs[base]; ok {
+				return f, base
+			}
+		}
+	}
+	return family{typ: TypeUnknown}, name
+}
+
+// Parser turns Prometheus metrics into MetricData.
+// Prometheus scrapes have no org, and their interval is up to the scraper, so both are set by the Parser.
+type Parser struct {
+	OrgId    int
+	Interval int
+
+	// Now returns the time for samples without timestamp. time.Now is used if nil.
+	Now func() time.Time
+}
+
+// NewParser returns a Parser for metrics of the given org and interval
+func NewParser(orgId, interval int) *Parser {
+	return &Parser{
+		OrgId:    orgId,
+		Interval: interval,
+	}
+}
+
+// newMetric returns a MetricData with its Id set for a sample, whose timestamp is in milliseconds.
+// labels must be "key=value" tags. name is used as is.
+func (p *Parser) newMetric(fs families, name string, tags []string, value float64, ts int64) *schema.MetricData {
+	f, familyName := fs.lookup(name)
+	md := &schema.MetricData{
+		OrgId:    p.OrgId,
+		Name:     name,
+		Interval: p.Interval,
+		Value:    value,
+		Unit:     f.unit,
+		Time:     time.UnixMilli(ts).Unix(),
+		Mtype:    Mtype(f.typ, familyName, name),
+		Tags:     tags,
+	}
+	md.SetId()
+	return md
+}
+
+func (p *Parser) now() int64 {
+	if p.Now != nil {
+		return p.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// tag returns the tag for a label, or "" if the label should not be carried as a tag,
+// because its value is empty, which Prometheus considers the same as not having the label.
+// A "name" label is renamed using schema.SanitizeNameTagKey.
+func tag(name, value string) (string, error) {
+	if !validLabelName(name) {
+		return "", fmt.Errorf("%w name %q", ErrInvalidLabel, name)
+	}
+	value = schema.SanitizeTagValue(value)
+	if value == "" {
+		return "", nil
+	}
+	return schema.SanitizeNameTagKey(name) + "=" + value, nil
+}
+
+// duplicateKey returns a key that occurs more than once in the sorted tags, or "" if there is none.
+// tags with the same key are adjacent, as they share the "key=" prefix.
+func duplicateKey(tags []string) string {
+	for i := 1; i < len(tags); i++ {
+		key := tags[i][:strings.IndexByte(tags[i], '=')+1]
+		if strings.HasPrefix(tags[i-1], key) {
+			return key[:len(key)-1]
+		}
+	}
+	return ""
+}
+
+// validValue returns whether v can be stored: NaN (which includes staleness markers) and infinities can't.
+func validValue(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func validMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0, true) {
+			return false
+		}
+	}
+	return true
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0, false) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameChar(c byte, first, colon bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || colon && c == ':' || !first && c >= '0' && c <= '9'
+}
+
+// SanitizeName returns name with all characters that are not allowed in Prometheus metric names replaced
+// by underscores, e.g. "a.b.c" becomes "a_b_c"
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName is like SanitizeName, for label names
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, colon bool) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if !isNameChar(c, false, colon) {
+			b[i] = '_'
+		}
+	}
+	if !isNameChar(b[0], true, colon) {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// label is a label of an exported series
+type label struct {
+	name  string
+	value string
+}
+
+// labels returns the labels for a MetricData, sorted by name, leaving out any "name" tag,
+// as well as tags that are not in key=value format
+func labels(tags []string) []label {
+	out := make([]label, 0, len(tags))
+	for _, t := range tags {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 || t[:i] == "name" {
+			continue
+		}
+		out = append(out, label{SanitizeLabelName(t[:i]), t[i+1:]})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+	return out
+}
@@ -0,0 +1,421 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema"
+)
+
+// a remote-write request is a snappy compressed protobuf message (see prompb/remote.proto and prompb/types.proto):
+//
+//	message WriteRequest   { repeated TimeSeries timeseries = 1; repeated MetricMetadata metadata = 3; }
+//	message TimeSeries     { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label          { string name = 1; string value = 2; }
+//	message Sample         { double value = 1; int64 timestamp = 2; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; string unit = 5; }
+//
+// fields not listed, such as exemplars and native histograms, are skipped.
+
+// maxSnappyRatio is the largest factor by which snappy data can decompress:
+// every byte decodes to at most 22 bytes (a 3 byte copy of 64 bytes)
+const maxSnappyRatio = 22
+
+// maxWriteRequestSize is the maximum size of a decompressed write request
+const maxWriteRequestSize = 64 << 20
+
+// metadataTypes are the types of the MetricMetadata.MetricType enum, by value
+var metadataTypes = []string{TypeUnknown, TypeCounter, TypeGauge, TypeHistogram, TypeGaugeHistogram, TypeSummary, TypeInfo, TypeStateset}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type timeSeries struct {
+	name    string
+	tags    []string
+	samples []sample
+}
+
+type sample struct {
+	value float64
+	ts    int64
+}
+
+// ParseWriteRequest decodes the body of a remote-write request, and returns a MetricData with its Id set
+// for every sample. The __name__ label becomes the name, all other labels become tags,
+// where a "name" label becomes an "exported_name" tag (see schema.SanitizeNameTagKey).
+// The mtype and unit of each metric follow from the metadata of its family, see Mtype.
+// Samples that can't be stored, because their value is NaN (e.g. staleness markers) or infinite, are skipped.
+func (p *Parser) ParseWriteRequest(body []byte) ([]*schema.MetricData, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWriteRequest, err)
+	}
+	// don't let a corrupt length make us allocate more than the data can decode to
+	if uint64(n) > maxSnappyRatio*uint64(len(body)) {
+		return nil, fmt.Errorf("%w: snappy decoded length %d for %d bytes", ErrInvalidWriteRequest, n, len(body))
+	}
+	if n > maxWriteRequestSize {
+		return nil, fmt.Errorf("%w: snappy decoded length %d exceeds max of %d", ErrInvalidWriteRequest, n, maxWriteRequestSize)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWriteRequest, err)
+	}
+
+	fs := make(families)
+	var series []timeSeries
+	r := protoReader{b: data}
+	for r.next() {
+		switch r.field {
+		case 1:
+			b := r.bytes()
+			if r.err != nil {
+				break
+			}
+			ts, err := parseTimeSeries(b)
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, ts)
+		case 3:
+			if b := r.bytes(); r.err == nil {
+				parseMetadata(fs, b)
+			}
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var out []*schema.MetricData
+	for _, ts := range series {
+		for _, s := range ts.samples {
+			if !validValue(s.value) {
+				continue
+			}
+			var tags []string
+			if len(ts.tags) > 0 {
+				tags = append([]string(nil), ts.tags...)
+			}
+			out = append(out, p.newMetric(fs, ts.name, tags, s.value, s.ts))
+		}
+	}
+	return out, nil
+}
+
+func parseTimeSeries(b []byte) (timeSeries, error) {
+	var ts timeSeries
+	r := protoReader{b: b}
+	for r.next() {
+		switch r.field {
+		case 1:
+			b := r.bytes()
+			if r.err != nil {
+				break
+			}
+			name, value, err := parseLabel(b)
+			if err != nil {
+				return ts, err
+			}
+			if name == "__name__" {
+				if !validMetricName(value) {
+					return ts, fmt.Errorf("%w %q", ErrInvalidName, value)
+				}
+				ts.name = value
+				continue
+			}
+			t, err := tag(name, value)
+			if err != nil {
+				return ts, err
+			}
+			if t != "" {
+				ts.tags = append(ts.tags, t)
+			}
+		case 2:
+			b := r.bytes()
+			if r.err != nil {
+				break
+			}
+			s, err := parseSample(b)
+			if err != nil {
+				return ts, err
+			}
+			ts.samples = append(ts.samples, s)
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return ts, r.err
+	}
+	if ts.name == "" {
+		return ts, fmt.Errorf("%w: series without __name__ label", ErrInvalidName)
+	}
+	sort.Strings(ts.tags)
+	if key := duplicateKey(ts.tags); key != "" {
+		return ts, fmt.Errorf("%w: duplicate label %q", ErrInvalidLabel, key)
+	}
+	return ts, nil
+}
+
+func parseLabel(b []byte) (name, value string, err error) {
+	r := protoReader{b: b}
+	for r.next() {
+		switch r.field {
+		case 1:
+			name = string(r.bytes())
+		case 2:
+			value = string(r.bytes())
+		default:
+			r.skip()
+		}
+	}
+	return name, value, r.err
+}
+
+func parseSample(b []byte) (sample, error) {
+	var s sample
+	r := protoReader{b: b}
+	for r.next() {
+		switch r.field {
+		case 1:
+			s.value = math.Float64frombits(r.fixed64())
+		case 2:
+			s.ts = int64(r.varint())
+		default:
+			r.skip()
+		}
+	}
+	return s, r.err
+}
+
+// parseMetadata adds the family described by the MetricMetadata in b to fs. invalid metadata is ignored.
+func parseMetadata(fs families, b []byte) {
+	var name string
+	f := family{typ: TypeUnknown}
+	r := protoReader{b: b}
+	for r.next() {
+		switch r.field {
+		case 1:
+			if t := r.varint(); t < uint64(len(metadataTypes)) {
+				f.typ = metadataTypes[t]
+			}
+		case 2:
+			name = string(r.bytes())
+		case 5:
+			f.unit = string(r.bytes())
+		default:
+			r.skip()
+		}
+	}
+	if r.err == nil && name != "" {
+		fs[name] = f
+	}
+}
+
+// protoReader reads the fields of a protobuf message
+type protoReader struct {
+	b     []byte
+	field uint64
+	wire  uint64
+	err   error
+}
+
+// next reads the key of the next field, and returns false at the end of the message or on error
+func (r *protoReader) next() bool {
+	if r.err != nil || len(r.b) == 0 {
+		return false
+	}
+	key := r.varint()
+	r.field, r.wire = key>>3, key&7
+	return r.err == nil
+}
+
+func (r *protoReader) fail(what string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: invalid %s in field %d", ErrInvalidWriteRequest, what, r.field)
+	}
+}
+
+func (r *protoReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail("varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *protoReader) fixed64() uint64 {
+	if r.wire != wireFixed64 || len(r.b) < 8 {
+		r.fail("fixed64")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *protoReader) bytes() []byte {
+	if r.wire != wireBytes {
+		r.fail("length delimited value")
+		return nil
+	}
+	l := r.varint()
+	if r.err != nil || l > uint64(len(r.b)) {
+		r.fail("length")
+		return nil
+	}
+	v := r.b[:l]
+	r.b = r.b[l:]
+	return v
+}
+
+// skip skips the value of the current field
+func (r *protoReader) skip() {
+	switch r.wire {
+	case wireVarint:
+		r.varint()
+	case wireFixed64:
+		r.fixed64()
+	case wireBytes:
+		r.bytes()
+	case wireFixed32:
+		if len(r.b) < 4 {
+			r.fail("fixed32")
+			return
+		}
+		r.b = r.b[4:]
+	default:
+		r.fail("wire type")
+	}
+}
+
+// EncodeWriteRequest returns the body of a remote-write request holding the metrics.
+// Metrics with the same name and tags are sent as samples of one series, ordered by time.
+// Names and label names are sanitized using SanitizeName and SanitizeLabelName, and any "name" tag is left out.
+// Metadata is included for every family, with its type following from the mtype of its first metric (see Type).
+func EncodeWriteRequest(metrics []*schema.MetricData) []byte {
+	type series struct {
+		name    string
+		labels  []label
+		metrics []*schema.MetricData
+	}
+	var order []string
+	bySeries := make(map[string]*series)
+	var familyNames []string
+	byFamily := make(map[string]*schema.MetricData)
+	for _, m := range metrics {
+		name := SanitizeName(m.Name)
+		ls := labels(m.Tags)
+		var key strings.Builder
+		key.WriteString(name)
+		for _, l := range ls {
+			key.WriteByte(0)
+			key.WriteString(l.name)
+			key.WriteByte(0)
+			key.WriteString(l.value)
+		}
+		s, ok := bySeries[key.String()]
+		if !ok {
+			s = &series{name: name, labels: ls}
+			bySeries[key.String()] = s
+			order = append(order, key.String())
+		}
+		s.metrics = append(s.metrics, m)
+		if _, ok := byFamily[name]; !ok {
+			byFamily[name] = m
+			familyNames = append(familyNames, name)
+		}
+	}
+
+	var b, buf []byte
+	for _, key := range order {
+		s := bySeries[key]
+		sort.SliceStable(s.metrics, func(i, j int) bool {
+			return s.metrics[i].Time < s.metrics[j].Time
+		})
+		buf = buf[:0]
+		// labels must be sorted by name, including __name__
+		ls := append([]label{{"__name__", s.name}}, s.labels...)
+		sort.SliceStable(ls, func(i, j int) bool {
+			return ls[i].name < ls[j].name
+		})
+		for _, l := range ls {
+			buf = appendLabel(buf, l)
+		}
+		for _, m := range s.metrics {
+			buf = appendSample(buf, m.Value, m.Time*1000)
+		}
+		b = appendBytes(b, 1, buf)
+	}
+	for _, name := range familyNames {
+		m := byFamily[name]
+		buf = buf[:0]
+		typ := Type(m.Mtype)
+		for i, t := range metadataTypes {
+			if t == typ {
+				buf = appendVarint(buf, 1, uint64(i))
+			}
+		}
+		buf = appendBytes(buf, 2, []byte(name))
+		if m.Unit != "" {
+			buf = appendBytes(buf, 5, []byte(m.Unit))
+		}
+		b = appendBytes(b, 3, buf)
+	}
+	return snappy.Encode(nil, b)
+}
+
+func appendKey(b []byte, field, wire uint64) []byte {
+	return binary.AppendUvarint(b, field<<3|wire)
+}
+
+func appendVarint(b []byte, field, v uint64) []byte {
+	b = appendKey(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytes(b []byte, field uint64, v []byte) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendLabel(b []byte, l label) []byte {
+	b = appendKey(b, 1, wireBytes)
+	size := 2 + uvarintLen(uint64(len(l.name))) + len(l.name) + uvarintLen(uint64(len(l.value))) + len(l.value)
+	b = binary.AppendUvarint(b, uint64(size))
+	b = appendBytes(b, 1, []byte(l.name))
+	return appendBytes(b, 2, []byte(l.value))
+}
+
+func appendSample(b []byte, value float64, ts int64) []byte {
+	b = appendKey(b, 2, wireBytes)
+	b = binary.AppendUvarint(b, uint64(1+8+1+uvarintLen(uint64(ts))))
+	b = appendKey(b, 1, wireFixed64)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(value))
+	return appendVarint(b, 2, uint64(ts))
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
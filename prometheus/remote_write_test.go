@@ -0,0 +1,133 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema"
+)
+
+func TestParseWriteRequest(t *testing.T) {
+	body, err := os.ReadFile("testdata/write_request.snappy")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	got, err := getParser().ParseWriteRequest(body)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "http_requests_total", Interval: 15, Value: 1, Time: 1500000000, Mtype: "counter", Tags: []string{"code=200", "job=api"}},
+		{OrgId: 1, Name: "http_requests_total", Interval: 15, Value: 5, Time: 1500000010, Mtype: "counter", Tags: []string{"code=200", "job=api"}},
+		{OrgId: 1, Name: "temperature", Interval: 15, Value: 21.5, Unit: "celsius", Time: 1500000000, Mtype: "gauge", Tags: []string{"room=a_b"}},
+		{OrgId: 1, Name: "rpc_duration_seconds_bucket", Interval: 15, Value: 3, Time: 1500000000, Mtype: "counter", Tags: []string{"le=0.1"}},
+		{OrgId: 1, Name: "rpc_duration_seconds_sum", Interval: 15, Value: 1.5, Time: 1500000000, Mtype: "counter"},
+		{OrgId: 1, Name: "rpc_duration_seconds_count", Interval: 15, Value: 4, Time: 1500000000, Mtype: "counter"},
+		{OrgId: 1, Name: "up", Interval: 15, Value: 1, Time: -2, Mtype: "gauge"},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d metrics, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		exp[i].SetId()
+		if !reflect.DeepEqual(exp[i], got[i]) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *exp[i], *got[i])
+		}
+	}
+}
+
+func TestParseWriteRequestInvalid(t *testing.T) {
+	cases := map[string][]byte{
+		"not snappy":          []byte("\xff\xff\xff\xff"),
+		"bogus length":        {0xff, 0xff, 0xff, 0x7f, 0x00},
+		"length over max":     append(binary.AppendUvarint(nil, maxWriteRequestSize+1), make([]byte, (maxWriteRequestSize+1)/maxSnappyRatio)...),
+		"truncated series":    snappy.Encode(nil, []byte{0x0a, 0x05, 0x0a}),
+		"truncated varint":    snappy.Encode(nil, []byte{0x80}),
+		"invalid wire type":   snappy.Encode(nil, []byte{0x0f}),
+		"fixed64 sample ts":   snappy.Encode(nil, []byte{0x0a, 0x0b, 0x12, 0x09, 0x11, 0, 0, 0, 0, 0, 0, 0, 0}),
+		"varint sample value": snappy.Encode(nil, []byte{0x0a, 0x04, 0x12, 0x02, 0x08, 0x01}),
+	}
+	for name, body := range cases {
+		if _, err := getParser().ParseWriteRequest(body); !errors.Is(err, ErrInvalidWriteRequest) {
+			t.Fatalf("%s: expected ErrInvalidWriteRequest, got %v", name, err)
+		}
+	}
+
+	// a series with a sample but no __name__ label
+	body := snappy.Encode(nil, appendBytes(nil, 1, appendSample(nil, 1, 1000)))
+	if _, err := getParser().ParseWriteRequest(body); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName for series without name, got %v", err)
+	}
+	body = snappy.Encode(nil, appendBytes(nil, 1, appendLabel(nil, label{"__name__", "a.b"})))
+	if _, err := getParser().ParseWriteRequest(body); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName for invalid name, got %v", err)
+	}
+	body = snappy.Encode(nil, appendBytes(nil, 1, appendLabel(appendLabel(nil, label{"__name__", "a"}), label{"b.c", "d"})))
+	if _, err := getParser().ParseWriteRequest(body); !errors.Is(err, ErrInvalidLabel) {
+		t.Fatalf("expected ErrInvalidLabel for invalid label name, got %v", err)
+	}
+	series := appendLabel(appendLabel(appendLabel(nil, label{"__name__", "a"}), label{"name", "b"}), label{"exported_name", "c"})
+	body = snappy.Encode(nil, appendBytes(nil, 1, series))
+	if _, err := getParser().ParseWriteRequest(body); !errors.Is(err, ErrInvalidLabel) {
+		t.Fatalf("expected ErrInvalidLabel for a name label clashing with exported_name, got %v", err)
+	}
+}
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{OrgId: 1, Name: "some.cpu", Interval: 15, Value: 0.5, Unit: "percent", Time: 1500000010, Mtype: "gauge", Tags: []string{"host=a", "name=ignored"}},
+		{OrgId: 1, Name: "requests_total", Interval: 15, Value: 10, Time: 1500000000, Mtype: "counter", Tags: []string{"code=200"}},
+		{OrgId: 1, Name: "some.cpu", Interval: 15, Value: 0.25, Time: 1500000000, Mtype: "gauge", Tags: []string{"host=a"}},
+		{OrgId: 1, Name: "requests_total", Interval: 15, Value: 3, Time: -1500000000, Mtype: "counter", Tags: []string{"code=500"}},
+		{OrgId: 1, Name: "latency_bucket", Interval: 15, Value: 3, Time: 1500000000, Mtype: "counter", Tags: []string{"le=+Inf"}},
+	}
+	got, err := getParser().ParseWriteRequest(EncodeWriteRequest(metrics))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// samples of a series are sent together, ordered by time
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "some_cpu", Interval: 15, Value: 0.25, Unit: "percent", Time: 1500000000, Mtype: "gauge", Tags: []string{"host=a"}},
+		{OrgId: 1, Name: "some_cpu", Interval: 15, Value: 0.5, Unit: "percent", Time: 1500000010, Mtype: "gauge", Tags: []string{"host=a"}},
+		metrics[1],
+		metrics[3],
+		metrics[4],
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d metrics, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		exp[i].SetId()
+		if !reflect.DeepEqual(exp[i], got[i]) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *exp[i], *got[i])
+		}
+	}
+}
+
+// FuzzParseWriteRequest checks that ParseWriteRequest rejects arbitrary input without panicking,
+// and that whatever it accepts survives a round trip.
+func FuzzParseWriteRequest(f *testing.F) {
+	body, err := os.ReadFile("testdata/write_request.snappy")
+	if err != nil {
+		f.Fatalf("%s", err.Error())
+	}
+	f.Add(body)
+	p := getParser()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := p.ParseWriteRequest(data)
+		if err != nil {
+			return
+		}
+		again, err := p.ParseWriteRequest(EncodeWriteRequest(metrics))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if len(again) != len(metrics) {
+			t.Fatalf("expected %d metrics after round trip, got %d", len(metrics), len(again))
+		}
+	})
+}
@@ -0,0 +1,344 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/schema"
+)
+
+// ParseError is returned for a line of the text exposition format that can't be parsed
+type ParseError struct {
+	Line   int    // the line number, starting at 1
+	Input  string // the line being parsed
+	Field  string // the part of the line that is invalid: "name", "labels", "value" or "timestamp"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: one of ErrInvalidName, ErrInvalidLabel, ErrInvalidValue or ErrInvalidTimestamp,
+	// or an error of strconv
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("prometheus: cannot parse %s of line %d %q at offset %d: %s", e.Field, e.Line, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseText parses metrics in the text exposition format, as served on /metrics endpoints,
+// and returns a MetricData with its Id set for every sample.
+// The mtype and unit of each metric follow from the TYPE and UNIT lines of its family, see Mtype.
+// Labels become tags, where a "name" label becomes an "exported_name" tag (see schema.SanitizeNameTagKey).
+// Samples without timestamp get the same time: that of the call.
+// Samples that can't be stored, because their value is NaN or infinite, are skipped.
+// Parsing stops at the first line that can't be parsed, for which a *ParseError is returned.
+func (p *Parser) ParseText(r io.Reader) ([]*schema.MetricData, error) {
+	fs := make(families)
+	now := p.now()
+	s := bufio.NewScanner(r)
+	var out []*schema.MetricData
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := s.Text()
+		md, err := p.parseLine(fs, line, now)
+		if err != nil {
+			perr := err.(*ParseError)
+			perr.Line = lineNo
+			return out, perr
+		}
+		if md != nil {
+			out = append(out, md)
+		}
+	}
+	return out, s.Err()
+}
+
+// parseLine parses a single line, and returns the MetricData of the sample on it, if any.
+// comments describing families are added to fs.
+func (p *Parser) parseLine(fs families, line string, now int64) (*schema.MetricData, error) {
+	l := lexer{s: line}
+	l.skipSpace()
+	if l.done() {
+		return nil, nil
+	}
+	if l.peek() == '#' {
+		parseComment(fs, line[l.pos+1:])
+		return nil, nil
+	}
+
+	offset := l.pos
+	name := l.name(true)
+	if name == "" {
+		return nil, l.fail("name", offset, ErrInvalidName)
+	}
+
+	var tags []string
+	if !l.done() && l.peek() == '{' {
+		l.pos++
+		var err error
+		tags, err = l.labels()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.skipSpace() == 0 && !l.done() {
+		return nil, l.fail("name", offset, ErrInvalidName)
+	}
+	offset = l.pos
+	value, err := strconv.ParseFloat(l.token(), 64)
+	if err != nil {
+		return nil, l.fail("value", offset, err)
+	}
+
+	ts := now
+	l.skipSpace()
+	if !l.done() {
+		offset = l.pos
+		ts, err = strconv.ParseInt(l.token(), 10, 64)
+		if err != nil {
+			return nil, l.fail("timestamp", offset, err)
+		}
+		l.skipSpace()
+		if !l.done() {
+			return nil, l.fail("timestamp", l.pos, fmt.Errorf("%w: trailing data", ErrInvalidTimestamp))
+		}
+	}
+
+	if !validValue(value) {
+		return nil, nil
+	}
+	return p.newMetric(fs, name, tags, value, ts), nil
+}
+
+// parseComment handles the TYPE and UNIT comments, and ignores any other
+func parseComment(fs families, comment string) {
+	fields := strings.Fields(comment)
+	if len(fields) < 3 {
+		return
+	}
+	f := fs[fields[1]]
+	switch fields[0] {
+	case "TYPE":
+		f.typ = strings.ToLower(fields[2])
+	case "UNIT":
+		f.unit = fields[2]
+	default:
+		return
+	}
+	fs[fields[1]] = f
+}
+
+// lexer tokenizes a line
+type lexer struct {
+	s   string
+	pos int
+}
+
+func (l *lexer) fail(field string, offset int, err error) error {
+	return &ParseError{
+		Input:  l.s,
+		Field:  field,
+		Offset: offset,
+		Err:    err,
+	}
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.s)
+}
+
+func (l *lexer) peek() byte {
+	return l.s[l.pos]
+}
+
+// skipSpace skips spaces and tabs and returns how many it skipped
+func (l *lexer) skipSpace() int {
+	start := l.pos
+	for !l.done() && (l.peek() == ' ' || l.peek() == '\t') {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+// name reads a metric name, or a label name if colon is false
+func (l *lexer) name(colon bool) string {
+	start := l.pos
+	for !l.done() && isNameChar(l.peek(), l.pos == start, colon) {
+		l.pos++
+	}
+	return l.s[start:l.pos]
+}
+
+// token reads up to the next space or tab
+func (l *lexer) token() string {
+	start := l.pos
+	for !l.done() && l.peek() != ' ' && l.peek() != '\t' {
+		l.pos++
+	}
+	return l.s[start:l.pos]
+}
+
+// labels reads the labels up to and including the closing brace, and returns them as sorted tags
+func (l *lexer) labels() ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for {
+		l.skipSpace()
+		if !l.done() && l.peek() == '}' {
+			l.pos++
+			break
+		}
+		offset := l.pos
+		name := l.name(false)
+		if name == "" {
+			return nil, l.fail("labels", offset, fmt.Errorf("%w: expected label name", ErrInvalidLabel))
+		}
+		// a "name" label becomes an exported_name tag, which must not clash with an exported_name label
+		key := schema.SanitizeNameTagKey(name)
+		if seen[key] {
+			return nil, l.fail("labels", offset, fmt.Errorf("%w: duplicate label %q", ErrInvalidLabel, key))
+		}
+		seen[key] = true
+		l.skipSpace()
+		if l.done() || l.peek() != '=' {
+			return nil, l.fail("labels", offset, fmt.Errorf("%w: expected '='", ErrInvalidLabel))
+		}
+		l.pos++
+		l.skipSpace()
+		value, ok := l.quoted()
+		if !ok {
+			return nil, l.fail("labels", offset, fmt.Errorf("%w: expected quoted value", ErrInvalidLabel))
+		}
+		t, err := tag(name, value)
+		if err != nil {
+			return nil, l.fail("labels", offset, err)
+		}
+		if t != "" {
+			tags = append(tags, t)
+		}
+		l.skipSpace()
+		if !l.done() && l.peek() == ',' {
+			l.pos++
+			continue
+		}
+		if l.done() || l.peek() != '}' {
+			return nil, l.fail("labels", l.pos, fmt.Errorf("%w: expected ',' or '}'", ErrInvalidLabel))
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// quoted reads a double quoted label value, and returns it unescaped
+func (l *lexer) quoted() (string, bool) {
+	if l.done() || l.peek() != '"' {
+		return "", false
+	}
+	l.pos++
+	var b strings.Builder
+	for ; !l.done(); l.pos++ {
+		c := l.peek()
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(), true
+		case '\\':
+			l.pos++
+			if l.done() {
+				return "", false
+			}
+			switch l.peek() {
+			case 'n':
+				b.WriteByte('\n')
+			case '\\', '"':
+				b.WriteByte(l.peek())
+			default:
+				return "", false
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+// AppendText appends the metrics to b in the text exposition format.
+// Metrics are grouped into families by name, in order of first appearance,
+// with the TYPE of each family following from the mtype of its first metric (see Type).
+// Names and label names are sanitized using SanitizeName and SanitizeLabelName,
+// any "name" tag is left out, and timestamps are written in milliseconds.
+func AppendText(b []byte, metrics []*schema.MetricData) []byte {
+	var names []string
+	byName := make(map[string][]*schema.MetricData)
+	for _, m := range metrics {
+		name := SanitizeName(m.Name)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], m)
+	}
+	for _, name := range names {
+		family := byName[name]
+		b = append(b, "# TYPE "...)
+		b = append(b, name...)
+		b = append(b, ' ')
+		b = append(b, Type(family[0].Mtype)...)
+		b = append(b, '\n')
+		if unit := family[0].Unit; unit != "" && !strings.ContainsAny(unit, " \t\n") {
+			b = append(b, "# UNIT "...)
+			b = append(b, name...)
+			b = append(b, ' ')
+			b = append(b, unit...)
+			b = append(b, '\n')
+		}
+		for _, m := range family {
+			b = append(b, name...)
+			if ls := labels(m.Tags); len(ls) > 0 {
+				for i, l := range ls {
+					if i == 0 {
+						b = append(b, '{')
+					} else {
+						b = append(b, ',')
+					}
+					b = append(b, l.name...)
+					b = append(b, '=')
+					b = appendQuoted(b, l.value)
+				}
+				b = append(b, '}')
+			}
+			b = append(b, ' ')
+			b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, m.Time*1000, 10)
+			b = append(b, '\n')
+		}
+	}
+	return b
+}
+
+// WriteText writes the metrics to w in the text exposition format, see AppendText
+func WriteText(w io.Writer, metrics []*schema.MetricData) error {
+	_, err := w.Write(AppendText(nil, metrics))
+	return err
+}
+
+// appendQuoted appends s as a double quoted label value
+func appendQuoted(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', '"':
+			b = append(b, '\\', s[i])
+		case '\n':
+			b = append(b, '\\', 'n')
+		default:
+			b = append(b, s[i])
+		}
+	}
+	return append(b, '"')
+}
@@ -0,0 +1,274 @@
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema"
+)
+
+const exposition = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400",}    3 1395066363000
+
+# Escaping in label values:
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+
+metric_without_timestamp_and_labels 12.47
+# TYPE tilde gauge
+# UNIT tilde celsius
+tilde{ a = "~b;c" , empty="" } -1 -1500
+
+# A weird metric from before the epoch:
+something_weird{problem="division by zero"} +Inf -3982045
+
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.05"} 24054
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_sum 53423
+http_request_duration_seconds_count 144320
+
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+`
+
+func getParser() *Parser {
+	p := NewParser(1, 15)
+	p.Now = func() time.Time { return time.Unix(1600000000, 123000000) }
+	return p
+}
+
+func TestParseText(t *testing.T) {
+	got, err := getParser().ParseText(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "http_requests_total", Interval: 15, Value: 1027, Time: 1395066363, Mtype: "counter", Tags: []string{"code=200", "method=post"}},
+		{OrgId: 1, Name: "http_requests_total", Interval: 15, Value: 3, Time: 1395066363, Mtype: "counter", Tags: []string{"code=400", "method=post"}},
+		{OrgId: 1, Name: "msdos_file_access_time_seconds", Interval: 15, Value: 1.458255915e9, Time: 1600000000, Mtype: "gauge", Tags: []string{"error=Cannot find file:\n\"FILE.TXT\"", `path=C:\DIR\FILE.TXT`}},
+		{OrgId: 1, Name: "metric_without_timestamp_and_labels", Interval: 15, Value: 12.47, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "tilde", Interval: 15, Value: -1, Unit: "celsius", Time: -2, Mtype: "gauge", Tags: []string{"a=b_c"}},
+		{OrgId: 1, Name: "http_request_duration_seconds_bucket", Interval: 15, Value: 24054, Time: 1600000000, Mtype: "counter", Tags: []string{"le=0.05"}},
+		{OrgId: 1, Name: "http_request_duration_seconds_bucket", Interval: 15, Value: 144320, Time: 1600000000, Mtype: "counter", Tags: []string{"le=+Inf"}},
+		{OrgId: 1, Name: "http_request_duration_seconds_sum", Interval: 15, Value: 53423, Time: 1600000000, Mtype: "counter"},
+		{OrgId: 1, Name: "http_request_duration_seconds_count", Interval: 15, Value: 144320, Time: 1600000000, Mtype: "counter"},
+		{OrgId: 1, Name: "rpc_duration_seconds", Interval: 15, Value: 4773, Time: 1600000000, Mtype: "gauge", Tags: []string{"quantile=0.5"}},
+		{OrgId: 1, Name: "rpc_duration_seconds_sum", Interval: 15, Value: 1.7560473e+07, Time: 1600000000, Mtype: "counter"},
+		{OrgId: 1, Name: "rpc_duration_seconds_count", Interval: 15, Value: 2693, Time: 1600000000, Mtype: "counter"},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d metrics, got %d", len(exp), len(got))
+	}
+	for i := range exp {
+		exp[i].SetId()
+		if !reflect.DeepEqual(exp[i], got[i]) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *exp[i], *got[i])
+		}
+	}
+}
+
+func TestParseTextInvalid(t *testing.T) {
+	cases := []struct {
+		line   string
+		field  string
+		offset int
+		err    error
+	}{
+		{"{a=\"b\"} 1", "name", 0, ErrInvalidName},
+		{"  1abc 1", "name", 2, ErrInvalidName},
+		{"a-b 1", "name", 0, ErrInvalidName},
+		{"a{b} 1", "labels", 2, ErrInvalidLabel},
+		{"a{b=c} 1", "labels", 2, ErrInvalidLabel},
+		{"a{b=\"c} 1", "labels", 2, ErrInvalidLabel},
+		{"a{b=\"\\c\"} 1", "labels", 2, ErrInvalidLabel},
+		{"a{b=\"c\" d=\"e\"} 1", "labels", 8, ErrInvalidLabel},
+		{"a{b=\"c\",b=\"d\"} 1", "labels", 8, ErrInvalidLabel},
+		{"a{1=\"c\"} 1", "labels", 2, ErrInvalidLabel},
+		{"a{exported_name=\"b\",name=\"c\"} 1", "labels", 20, ErrInvalidLabel},
+		{"a{b=\"c\"", "labels", 7, ErrInvalidLabel},
+		{"a", "value", 1, strconv.ErrSyntax},
+		{"a x", "value", 2, strconv.ErrSyntax},
+		{"a 1 x", "timestamp", 4, strconv.ErrSyntax},
+		{"a 1 1.5", "timestamp", 4, strconv.ErrSyntax},
+		{"a 1 2 3", "timestamp", 6, ErrInvalidTimestamp},
+	}
+	for _, c := range cases {
+		_, err := getParser().ParseText(strings.NewReader("ok 1\n" + c.line + "\nok 2\n"))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected ParseError, got %v", c.line, err)
+		}
+		if perr.Line != 2 || perr.Field != c.field || perr.Offset != c.offset || perr.Input != c.line || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at line 2 offset %d caused by %q, got %s at line %d offset %d: %s", c.line, c.field, c.offset, c.err, perr.Field, perr.Line, perr.Offset, err.Error())
+		}
+	}
+}
+
+func TestNameLabel(t *testing.T) {
+	p := getParser()
+	got, err := p.ParseText(strings.NewReader(`container_cpu{name="c1",job="a"} 1 1500000000000` + "\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := &schema.MetricData{OrgId: 1, Name: "container_cpu", Interval: 15, Value: 1, Time: 1500000000, Mtype: "gauge", Tags: []string{"exported_name=c1", "job=a"}}
+	exp.SetId()
+	if len(got) != 1 || !reflect.DeepEqual(exp, got[0]) {
+		t.Fatalf("expected %+v, got %v", *exp, got)
+	}
+
+	// the exported_name tag is exported as is, and a name tag is left out
+	got[0].Tags = append(got[0].Tags, "name=x")
+	text := string(AppendText(nil, got))
+	if text != "# TYPE container_cpu gauge\ncontainer_cpu{exported_name=\"c1\",job=\"a\"} 1 1500000000000\n" {
+		t.Fatalf("unexpected text %q", text)
+	}
+	again, err := p.ParseWriteRequest(EncodeWriteRequest(got))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(again) != 1 || !reflect.DeepEqual(exp, again[0]) {
+		t.Fatalf("expected %+v, got %v", *exp, again)
+	}
+
+	// remote-write requests get the same treatment
+	series := appendLabel(nil, label{"__name__", "container_cpu"})
+	series = appendLabel(appendLabel(series, label{"name", "c1"}), label{"job", "a"})
+	series = appendSample(series, 1, 1500000000000)
+	again, err = p.ParseWriteRequest(snappy.Encode(nil, appendBytes(nil, 1, series)))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(again) != 1 || !reflect.DeepEqual(exp, again[0]) {
+		t.Fatalf("expected %+v, got %v", *exp, again)
+	}
+}
+
+func TestMtype(t *testing.T) {
+	cases := []struct {
+		typ, family, name, exp string
+	}{
+		{TypeCounter, "a", "a", "counter"},
+		{TypeCounter, "a", "a_total", "counter"},
+		{TypeGauge, "a", "a", "gauge"},
+		{TypeUntyped, "a", "a", "gauge"},
+		{TypeHistogram, "a", "a_bucket", "counter"},
+		{TypeHistogram, "a", "a_sum", "counter"},
+		{TypeHistogram, "a", "a_count", "counter"},
+		{TypeHistogram, "a", "a_created", "gauge"},
+		{TypeGaugeHistogram, "a", "a_bucket", "gauge"},
+		{TypeSummary, "a", "a", "gauge"},
+		{TypeSummary, "a", "a_sum", "counter"},
+		{TypeSummary, "a", "a_count", "counter"},
+	}
+	for _, c := range cases {
+		if got := Mtype(c.typ, c.family, c.name); got != c.exp {
+			t.Fatalf("%s %s of family %s: expected %s, got %s", c.typ, c.name, c.family, c.exp, got)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	cases := map[string]string{
+		"a.b-c:d":   "a_b_c:d",
+		"1a":        "_1a",
+		"":          "_",
+		"valid_one": "valid_one",
+	}
+	for in, exp := range cases {
+		if got := SanitizeName(in); got != exp {
+			t.Fatalf("%q: expected %q, got %q", in, exp, got)
+		}
+	}
+	if got := SanitizeLabelName("a:b"); got != "a_b" {
+		t.Fatalf("expected colons to be replaced in label names, got %q", got)
+	}
+}
+
+func TestAppendText(t *testing.T) {
+	metrics := []*schema.MetricData{
+		{OrgId: 1, Name: "some.cpu", Interval: 15, Value: 0.5, Unit: "percent", Time: 1500000000, Mtype: "gauge", Tags: []string{"host=a\"b\\c\nd", "name=ignored"}},
+		{OrgId: 1, Name: "requests", Interval: 15, Value: 10, Time: 1500000000, Mtype: "counter"},
+		{OrgId: 1, Name: "some.cpu", Interval: 15, Value: 1e21, Time: 1500000010, Mtype: "gauge", Tags: []string{"host=e", "1=f"}},
+	}
+	exp := `# TYPE some_cpu gauge
+# UNIT some_cpu percent
+some_cpu{host="a\"b\\c\nd"} 0.5 1500000000000
+some_cpu{_1="f",host="e"} 1e+21 1500000010000
+# TYPE requests counter
+requests 10 1500000000000
+`
+	var buf bytes.Buffer
+	if err := WriteText(&buf, metrics); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if buf.String() != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, buf.String())
+	}
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	p := getParser()
+	metrics, err := p.ParseText(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	got, err := p.ParseText(bytes.NewReader(AppendText(nil, metrics)))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(metrics, got) {
+		t.Fatalf("expected %v after round trip, got %v", metrics, got)
+	}
+}
+
+// FuzzParseText checks that ParseText rejects arbitrary input without panicking,
+// and that whatever it accepts survives a round trip.
+func FuzzParseText(f *testing.F) {
+	f.Add([]byte(exposition))
+	p := getParser()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics, err := p.ParseText(bytes.NewReader(data))
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok && !errors.Is(err, bufio.ErrTooLong) {
+				t.Fatalf("expected a *ParseError, got %T: %s", err, err.Error())
+			}
+			return
+		}
+		again, err := p.ParseText(bytes.NewReader(AppendText(nil, metrics)))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		// AppendText groups the metrics by name
+		byName := make(map[string][]*schema.MetricData)
+		var names []string
+		for _, md := range metrics {
+			if _, ok := byName[md.Name]; !ok {
+				names = append(names, md.Name)
+			}
+			byName[md.Name] = append(byName[md.Name], md)
+		}
+		metrics = metrics[:0]
+		for _, name := range names {
+			metrics = append(metrics, byName[name]...)
+		}
+		if len(again) != len(metrics) {
+			t.Fatalf("expected %d metrics after round trip, got %d", len(metrics), len(again))
+		}
+		for i := range metrics {
+			if metrics[i].Name != again[i].Name || metrics[i].Value != again[i].Value || !reflect.DeepEqual(metrics[i].Tags, again[i].Tags) {
+				t.Fatalf("metric %d: expected %+v after round trip, got %+v", i, *metrics[i], *again[i])
+			}
+		}
+	})
+}
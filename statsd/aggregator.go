@@ -0,0 +1,252 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+// Aggregator aggregates samples per flush interval, and turns them into MetricData:
+//
+//   - counters become a "rate" metric of the same name, with the sample rate corrected count per second.
+//   - gauges become a metric of the same name, of mtype "gauge" unless set otherwise by the sample.
+//     their values are kept across flushes so relative updates can be applied, but only gauges
+//     that were updated during the interval are emitted. Unless DeleteGauges is set, every gauge is kept
+//     forever, so memory use grows with the number of distinct gauges ever added.
+//   - timers, histograms and distributions become the metrics name.count (of mtype "count", corrected for
+//     the sample rate), name.rate (the count per second, of mtype "rate"), and gauges name.min, name.max,
+//     name.mean, name.sum and a name.pN for each of the configured percentiles.
+//   - sets become a gauge of the same name, with the number of unique members.
+//
+// It is safe for concurrent use. An Aggregator can be created with NewAggregator or as a literal.
+type Aggregator struct {
+	OrgId    int
+	Interval int // the flush interval in seconds, which must be > 0
+
+	// Percentiles are the percentiles reported for timers, histograms and distributions,
+	// e.g. 99.9 results in name.p99_9
+	Percentiles []float64
+
+	// DeleteGauges makes Flush forget gauges that were not updated since the previous flush,
+	// like the statsd option of the same name. A relative update to a forgotten gauge starts from 0.
+	DeleteGauges bool
+
+	mu       sync.Mutex
+	counters map[string]*counter
+	gauges   map[string]*gauge
+	timers   map[string]*timer
+	sets     map[string]*set
+}
+
+type series struct {
+	name string
+	tags []string
+	unit string
+}
+
+type counter struct {
+	series
+	count float64
+}
+
+type gauge struct {
+	series
+	mtype   string
+	value   float64
+	updated bool
+}
+
+type timer struct {
+	series
+	count  float64
+	values []float64
+}
+
+type set struct {
+	series
+	members map[string]struct{}
+}
+
+// NewAggregator returns an Aggregator for metrics of the given org and flush interval in seconds,
+// that reports the 90th percentile of timers
+func NewAggregator(orgId, interval int) *Aggregator {
+	return &Aggregator{
+		OrgId:       orgId,
+		Interval:    interval,
+		Percentiles: []float64{90},
+	}
+}
+
+// Add adds a sample to the current interval. A SampleRate of 0 is treated as 1.
+func (a *Aggregator) Add(s Sample) {
+	key := seriesKey(s.Name, s.Tags)
+	sr := series{name: s.Name, tags: s.Tags, unit: s.Unit}
+	rate := s.SampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// the maps are created on demand, so that Aggregator literals work, and Flush can simply drop them
+	switch s.Type {
+	case TypeCounter:
+		if a.counters == nil {
+			a.counters = make(map[string]*counter)
+		}
+		c, ok := a.counters[key]
+		if !ok {
+			c = &counter{}
+			a.counters[key] = c
+		}
+		c.series = sr
+		c.count += s.Value / rate
+	case TypeGauge:
+		if a.gauges == nil {
+			a.gauges = make(map[string]*gauge)
+		}
+		g, ok := a.gauges[key]
+		if !ok {
+			g = &gauge{}
+			a.gauges[key] = g
+		}
+		g.series = sr
+		g.mtype = s.Mtype
+		if g.mtype == "" {
+			g.mtype = "gauge"
+		}
+		if s.Relative {
+			g.value += s.Value
+		} else {
+			g.value = s.Value
+		}
+		g.updated = true
+	case TypeTimer, TypeHistogram, TypeDistribution:
+		if a.timers == nil {
+			a.timers = make(map[string]*timer)
+		}
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{}
+			a.timers[key] = t
+		}
+		t.series = sr
+		t.count += 1 / rate
+		t.values = append(t.values, s.Value)
+	case TypeSet:
+		if a.sets == nil {
+			a.sets = make(map[string]*set)
+		}
+		st, ok := a.sets[key]
+		if !ok {
+			st = &set{members: make(map[string]struct{})}
+			a.sets[key] = st
+		}
+		st.series = sr
+		st.members[s.Member] = struct{}{}
+	}
+}
+
+// Flush returns the MetricData for the current interval, with their Id set and the given time,
+// ordered by name and tags, and starts a new interval.
+// Metrics whose value overflows to an infinity are left out.
+func (a *Aggregator) Flush(now time.Time) []*schema.MetricData {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ts := now.Unix()
+	interval := float64(a.Interval)
+	var out []*schema.MetricData
+	emit := func(s series, suffix, mtype, unit string, value float64) {
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return
+		}
+		md := &schema.MetricData{
+			OrgId:    a.OrgId,
+			Name:     s.name + suffix,
+			Interval: a.Interval,
+			Value:    value,
+			Unit:     unit,
+			Time:     ts,
+			Mtype:    mtype,
+		}
+		if len(s.tags) > 0 {
+			md.Tags = append([]string(nil), s.tags...)
+		}
+		md.SetId()
+		out = append(out, md)
+	}
+
+	for _, c := range a.counters {
+		emit(c.series, "", "rate", c.unit, c.count/interval)
+	}
+	for key, g := range a.gauges {
+		if g.updated {
+			emit(g.series, "", g.mtype, g.unit, g.value)
+			g.updated = false
+		} else if a.DeleteGauges {
+			delete(a.gauges, key)
+		}
+	}
+	for _, t := range a.timers {
+		emit(t.series, ".count", "count", "", t.count)
+		emit(t.series, ".rate", "rate", "", t.count/interval)
+		sort.Float64s(t.values)
+		var sum float64
+		for _, v := range t.values {
+			sum += v
+		}
+		emit(t.series, ".min", "gauge", t.unit, t.values[0])
+		emit(t.series, ".max", "gauge", t.unit, t.values[len(t.values)-1])
+		emit(t.series, ".mean", "gauge", t.unit, sum/float64(len(t.values)))
+		emit(t.series, ".sum", "gauge", t.unit, sum)
+		for _, p := range a.Percentiles {
+			emit(t.series, ".p"+strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1), "gauge", t.unit, percentile(t.values, p))
+		}
+	}
+	for _, st := range a.sets {
+		emit(st.series, "", "gauge", st.unit, float64(len(st.members)))
+	}
+
+	a.counters = nil
+	a.timers = nil
+	a.sets = nil
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return lessTags(out[i].Tags, out[j].Tags)
+	})
+	return out
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values
+func percentile(values []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
+
+func seriesKey(name string, tags []string) string {
+	return name + "\x00" + strings.Join(tags, "\x00")
+}
+
+func lessTags(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
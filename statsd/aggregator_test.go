@@ -0,0 +1,147 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+const packet = `requests:1|c|#env:prod
+requests:2|c|@0.5|#env:prod
+requests:3|c
+temp:20|g|#unit:celsius
+temp:+2.5|g|#unit:celsius
+temp:-0.5|g|#unit:celsius
+last_run:1500000000|g|#mtype:timestamp
+latency:30|ms|@0.5
+latency:10|ms
+latency:20|ms
+users:a|s
+users:b|s
+users:a|s
+`
+
+func TestAggregator(t *testing.T) {
+	samples, err := ParsePacket([]byte(packet))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	a := NewAggregator(1, 10)
+	a.Percentiles = []float64{50, 99.9}
+	for _, s := range samples {
+		a.Add(s)
+	}
+	now := time.Unix(1600000000, 0)
+	got := a.Flush(now)
+	exp := []*schema.MetricData{
+		{OrgId: 1, Name: "last_run", Interval: 10, Value: 1500000000, Time: 1600000000, Mtype: "timestamp"},
+		{OrgId: 1, Name: "latency.count", Interval: 10, Value: 4, Time: 1600000000, Mtype: "count"},
+		{OrgId: 1, Name: "latency.max", Interval: 10, Value: 30, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "latency.mean", Interval: 10, Value: 20, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "latency.min", Interval: 10, Value: 10, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "latency.p50", Interval: 10, Value: 20, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "latency.p99_9", Interval: 10, Value: 30, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "latency.rate", Interval: 10, Value: 0.4, Time: 1600000000, Mtype: "rate"},
+		{OrgId: 1, Name: "latency.sum", Interval: 10, Value: 60, Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "requests", Interval: 10, Value: 0.3, Time: 1600000000, Mtype: "rate"},
+		{OrgId: 1, Name: "requests", Interval: 10, Value: 0.5, Time: 1600000000, Mtype: "rate", Tags: []string{"env=prod"}},
+		{OrgId: 1, Name: "temp", Interval: 10, Value: 22, Unit: "celsius", Time: 1600000000, Mtype: "gauge"},
+		{OrgId: 1, Name: "users", Interval: 10, Value: 2, Time: 1600000000, Mtype: "gauge"},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d metrics, got %d: %v", len(exp), len(got), got)
+	}
+	for i := range exp {
+		exp[i].SetId()
+		if !reflect.DeepEqual(exp[i], got[i]) {
+			t.Fatalf("metric %d: expected %+v, got %+v", i, *exp[i], *got[i])
+		}
+		if err := got[i].Validate(); err != nil {
+			t.Fatalf("metric %d: %s", i, err.Error())
+		}
+	}
+
+	// gauges keep their value, but are only emitted when updated
+	a.Add(Sample{Name: "temp", Type: TypeGauge, Value: -2, Relative: true, Unit: "celsius"})
+	got = a.Flush(now)
+	temp := &schema.MetricData{OrgId: 1, Name: "temp", Interval: 10, Value: 20, Unit: "celsius", Time: 1600000000, Mtype: "gauge"}
+	temp.SetId()
+	if len(got) != 1 || !reflect.DeepEqual(temp, got[0]) {
+		t.Fatalf("expected only the updated gauge, got %v", got)
+	}
+	if got = a.Flush(now); len(got) != 0 {
+		t.Fatalf("expected no metrics for an empty interval, got %v", got)
+	}
+}
+
+func TestAggregatorDeleteGauges(t *testing.T) {
+	// a literal, without the maps that Add creates on demand
+	a := &Aggregator{OrgId: 1, Interval: 10, DeleteGauges: true}
+	now := time.Unix(1600000000, 0)
+	a.Add(Sample{Name: "a", Type: TypeGauge, Value: 1})
+	a.Add(Sample{Name: "b", Type: TypeGauge, Value: 1})
+	a.Add(Sample{Name: "c", Type: TypeCounter, Value: 1})
+	if got := a.Flush(now); len(got) != 3 {
+		t.Fatalf("expected 3 metrics, got %v", got)
+	}
+
+	// b was updated since the previous flush and is kept, a is forgotten
+	a.Add(Sample{Name: "b", Type: TypeGauge, Value: 1, Relative: true})
+	a.Flush(now)
+	if len(a.gauges) != 1 || a.gauges[seriesKey("b", nil)] == nil {
+		t.Fatalf("expected only gauge b to be kept, got %v", a.gauges)
+	}
+	a.Add(Sample{Name: "a", Type: TypeGauge, Value: 1, Relative: true})
+	a.Add(Sample{Name: "b", Type: TypeGauge, Value: 1, Relative: true})
+	got := a.Flush(now)
+	if len(got) != 2 || got[0].Value != 1 || got[1].Value != 3 {
+		t.Fatalf("expected a relative update to start from 0 for a forgotten gauge only, got %v", got)
+	}
+}
+
+func TestAggregatorCreateMsg(t *testing.T) {
+	samples, err := ParsePacket([]byte(packet))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	a := NewAggregator(1, 10)
+	for _, s := range samples {
+		a.Add(s)
+	}
+	metrics := a.Flush(time.Unix(1600000000, 0))
+	data, err := msg.CreateMsg(metrics, 1, msg.FormatMetricDataArrayMsgp)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var m msg.MetricData
+	if err := m.InitFromMsg(data); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := m.DecodeMetricData(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(metrics, m.Metrics) {
+		t.Fatalf("expected %v, got %v", metrics, m.Metrics)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	cases := map[float64]float64{
+		0:   1,
+		10:  1,
+		50:  5,
+		90:  9,
+		95:  10,
+		100: 10,
+		200: 10,
+	}
+	for p, exp := range cases {
+		if got := percentile(values, p); got != exp {
+			t.Fatalf("p%f: expected %f, got %f", p, exp, got)
+		}
+	}
+}
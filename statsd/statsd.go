@@ -0,0 +1,209 @@
+// Package statsd turns statsd metrics into schema.MetricData.
+//
+// Lines of the form "name:value|type|@rate|#key:value,key2:value2" are parsed into Samples,
+// which an Aggregator aggregates per flush interval into MetricData, the way a statsd server does.
+// The sample rate and tags are optional, and tags use the DogStatsD syntax.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/schema"
+)
+
+var (
+	ErrMissingFields     = errors.New("expected \"name:value|type\"")
+	ErrEmptyName         = errors.New("name is empty")
+	ErrInvalidValue      = errors.New("invalid value")
+	ErrInvalidType       = errors.New("invalid type")
+	ErrInvalidSampleRate = errors.New("invalid sample rate")
+	ErrInvalidTag        = errors.New("invalid tag")
+	ErrInvalidMtype      = errors.New("invalid mtype")
+)
+
+// statsd metric types
+const (
+	TypeCounter      = "c"
+	TypeGauge        = "g"
+	TypeTimer        = "ms"
+	TypeHistogram    = "h"
+	TypeDistribution = "d"
+	TypeSet          = "s"
+)
+
+// ParseError describes a statsd line that ParseLine or ParsePacket rejected
+type ParseError struct {
+	Line   int    // the line number within the packet, starting at 1, or 0 if not known
+	Input  string // the line being parsed
+	Field  string // the part of the line that is invalid: "line", "name", "value", "type", "sample rate" or "tags"
+	Offset int    // the offset of that part in Input
+	// Err is the cause: one of the errors above, or an error of strconv
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("statsd: cannot parse %s of line %d %q at offset %d: %s", e.Field, e.Line, e.Input, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("statsd: cannot parse %s of %q at offset %d: %s", e.Field, e.Input, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Sample is a single statsd measurement
+type Sample struct {
+	Name string
+	Tags []string // sorted, in key=value format
+	Type string   // one of the Type constants
+
+	// Value is the value of counters, timers, histograms and distributions, and of gauges.
+	// for gauges with Relative set, it is the change to apply to the current value.
+	Value    float64
+	Relative bool
+	Member   string // the member to add, for sets
+
+	// SampleRate is the fraction of measurements that were sent, used to correct counts.
+	SampleRate float64
+
+	// Mtype and Unit are set by the reserved "mtype" and "unit" tags, and are empty otherwise.
+	// "mtype" can only be used for gauges, to mark their values as counter or timestamp.
+	Mtype string
+	Unit  string
+}
+
+// ParseLine parses a single line, with or without the trailing newline.
+// The name has superfluous dots removed (see schema.EatDots),
+// tag keys and values are sanitized using schema.SanitizeTagKey and schema.SanitizeTagValue,
+// a name tag (see schema.IsNameTag) is rejected, and fields of the DogStatsD protocol other than sample rate and tags are ignored.
+// As in statsd, a gauge value with an explicit sign is relative to the current value.
+func ParseLine(line []byte) (Sample, error) {
+	return parse(strings.TrimRight(string(line), "\r\n"))
+}
+
+// ParsePacket parses all lines of a packet, skipping empty lines.
+// It returns the samples of all valid lines, and the error of the first invalid one, if any.
+func ParsePacket(packet []byte) ([]Sample, error) {
+	var samples []Sample
+	var first error
+	for i, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s, err := parse(line)
+		if err != nil {
+			if first == nil {
+				err.(*ParseError).Line = i + 1
+				first = err
+			}
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, first
+}
+
+func parse(line string) (Sample, error) {
+	fail := func(field string, offset int, err error) error {
+		return &ParseError{
+			Input:  line,
+			Field:  field,
+			Offset: offset,
+			Err:    err,
+		}
+	}
+
+	s := Sample{SampleRate: 1}
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return s, fail("line", 0, ErrMissingFields)
+	}
+	s.Name = schema.EatDots(line[:colon])
+	if s.Name == "" {
+		return s, fail("name", 0, ErrEmptyName)
+	}
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return s, fail("line", colon+1, ErrMissingFields)
+	}
+
+	valueOffset := colon + 1
+	typeOffset := valueOffset + len(fields[0]) + 1
+	s.Type = fields[1]
+	switch s.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram, TypeDistribution:
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return s, fail("value", valueOffset, err)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return s, fail("value", valueOffset, ErrInvalidValue)
+		}
+		s.Value = v
+		s.Relative = s.Type == TypeGauge && (fields[0][0] == '+' || fields[0][0] == '-')
+	case TypeSet:
+		if fields[0] == "" {
+			return s, fail("value", valueOffset, ErrInvalidValue)
+		}
+		s.Member = fields[0]
+	default:
+		return s, fail("type", typeOffset, fmt.Errorf("%w %q", ErrInvalidType, s.Type))
+	}
+
+	offset := typeOffset + len(fields[1]) + 1
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil {
+				return s, fail("sample rate", offset, err)
+			}
+			if !(rate > 0 && rate <= 1) {
+				return s, fail("sample rate", offset, ErrInvalidSampleRate)
+			}
+			s.SampleRate = rate
+		case strings.HasPrefix(f, "#"):
+			if err := s.parseTags(f[1:]); err != nil {
+				return s, fail("tags", offset, err)
+			}
+		}
+		offset += len(f) + 1
+	}
+	sort.Strings(s.Tags)
+	return s, nil
+}
+
+// parseTags parses comma separated key:value tags
+func (s *Sample) parseTags(tags string) error {
+	for _, t := range strings.Split(tags, ",") {
+		i := strings.IndexByte(t, ':')
+		if i <= 0 {
+			return fmt.Errorf("%w %q: expected key:value", ErrInvalidTag, t)
+		}
+		key, value := t[:i], t[i+1:]
+		switch key {
+		case "mtype":
+			if s.Type != TypeGauge || (value != "gauge" && value != "counter" && value != "timestamp") {
+				return fmt.Errorf("%w %q for type %q", ErrInvalidMtype, value, s.Type)
+			}
+			s.Mtype = value
+			continue
+		case "unit":
+			s.Unit = value
+			continue
+		}
+		tag := schema.SanitizeTagKey(key) + "=" + schema.SanitizeTagValue(value)
+		if !schema.ValidateTag(tag) || schema.IsNameTag(tag) {
+			return fmt.Errorf("%w %q", ErrInvalidTag, t)
+		}
+		s.Tags = append(s.Tags, tag)
+	}
+	return nil
+}
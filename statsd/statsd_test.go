@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		line string
+		exp  Sample
+	}{
+		{"gorets:1|c", Sample{Name: "gorets", Type: TypeCounter, Value: 1, SampleRate: 1}},
+		{
+			"gorets:1|c|@0.1|#host:a.b,env:prod\n",
+			Sample{Name: "gorets", Tags: []string{"env=prod", "host=a.b"}, Type: TypeCounter, Value: 1, SampleRate: 0.1},
+		},
+		{"glork:320|ms|@0.5", Sample{Name: "glork", Type: TypeTimer, Value: 320, SampleRate: 0.5}},
+		{"gaugor:333|g\r\n", Sample{Name: "gaugor", Type: TypeGauge, Value: 333, SampleRate: 1}},
+		{"gaugor:-10|g", Sample{Name: "gaugor", Type: TypeGauge, Value: -10, Relative: true, SampleRate: 1}},
+		{"gaugor:+4|g", Sample{Name: "gaugor", Type: TypeGauge, Value: 4, Relative: true, SampleRate: 1}},
+		{
+			"last_run:1500000000|g|#mtype:timestamp,unit:s",
+			Sample{Name: "last_run", Type: TypeGauge, Value: 1500000000, SampleRate: 1, Mtype: "timestamp", Unit: "s"},
+		},
+		{"uniques:765|s", Sample{Name: "uniques", Type: TypeSet, Member: "765", SampleRate: 1}},
+		{
+			"a..b.:-1.5|d|c:abc|T1656581400|#x:~y;z",
+			Sample{Name: "a.b", Tags: []string{"x=y_z"}, Type: TypeDistribution, Value: -1.5, SampleRate: 1},
+		},
+		{"h:1e3|h|#we=ird:v", Sample{Name: "h", Tags: []string{"we_ird=v"}, Type: TypeHistogram, Value: 1000, SampleRate: 1}},
+	}
+	for _, c := range cases {
+		got, err := ParseLine([]byte(c.line))
+		if err != nil {
+			t.Fatalf("%q: %s", c.line, err.Error())
+		}
+		if !reflect.DeepEqual(c.exp, got) {
+			t.Fatalf("%q: expected %+v, got %+v", c.line, c.exp, got)
+		}
+	}
+}
+
+func TestParseLineInvalid(t *testing.T) {
+	cases := []struct {
+		line   string
+		field  string
+		offset int
+		err    error
+	}{
+		{"gorets", "line", 0, ErrMissingFields},
+		{":1|c", "name", 0, ErrEmptyName},
+		{"..:1|c", "name", 0, ErrEmptyName},
+		{"a:1", "line", 2, ErrMissingFields},
+		{"a:x|c", "value", 2, strconv.ErrSyntax},
+		{"a:NaN|c", "value", 2, ErrInvalidValue},
+		{"a:|s", "value", 2, ErrInvalidValue},
+		{"a:1|x", "type", 4, ErrInvalidType},
+		{"a:1|c|@x", "sample rate", 6, strconv.ErrSyntax},
+		{"a:1|c|@0", "sample rate", 6, ErrInvalidSampleRate},
+		{"a:1|c|@1.5", "sample rate", 6, ErrInvalidSampleRate},
+		{"a:1|c|#b", "tags", 6, ErrInvalidTag},
+		{"a:1|c|@0.5|#b:", "tags", 11, ErrInvalidTag},
+		{"a:1|c|#name:x", "tags", 6, ErrInvalidTag},
+		{"a:1|c|#mtype:counter", "tags", 6, ErrInvalidMtype},
+		{"a:1|g|#mtype:rate", "tags", 6, ErrInvalidMtype},
+	}
+	for _, c := range cases {
+		_, err := ParseLine([]byte(c.line))
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: expected ParseError, got %v", c.line, err)
+		}
+		if perr.Field != c.field || perr.Offset != c.offset || perr.Input != c.line || !errors.Is(err, c.err) {
+			t.Fatalf("%q: expected %s at offset %d caused by %q, got %s at offset %d: %s", c.line, c.field, c.offset, c.err, perr.Field, perr.Offset, err.Error())
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	samples, err := ParsePacket([]byte("a:1|c\n\nbogus\r\nb:2|g\nc:x|c\n"))
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 3 || perr.Input != "bogus" {
+		t.Fatalf("expected a ParseError for line 3, got %v", err)
+	}
+	if len(samples) != 2 || samples[0].Name != "a" || samples[1].Name != "b" {
+		t.Fatalf("expected samples a and b, got %+v", samples)
+	}
+}
+
+// FuzzParseLine checks that ParseLine rejects arbitrary input without panicking,
+// and that whatever it accepts results in valid MetricData.
+func FuzzParseLine(f *testing.F) {
+	f.Add([]byte("gorets:1|c|@0.1|#host:a.b,env:prod"))
+	f.Add([]byte("last_run:1500000000|g|#mtype:timestamp,unit:s"))
+	f.Add([]byte("a..b.:-1.5|d|c:abc|T1656581400|#x:~y;z"))
+	f.Add([]byte("uniques:765|s"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := ParseLine(data)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("expected a *ParseError, got %T: %s", err, err.Error())
+			}
+			return
+		}
+		if !(s.SampleRate > 0 && s.SampleRate <= 1) {
+			t.Fatalf("invalid sample rate %f", s.SampleRate)
+		}
+		a := NewAggregator(1, 10)
+		a.Add(s)
+		for _, md := range a.Flush(time.Unix(1500000000, 0)) {
+			if err := md.Validate(); err != nil {
+				t.Fatalf("%q resulted in invalid metric %+v: %s", data, *md, err.Error())
+			}
+			if md.Id != getId(md) {
+				t.Fatalf("%q resulted in metric with bad id %+v", data, *md)
+			}
+		}
+	})
+}
+
+func getId(md *schema.MetricData) string {
+	cp := *md
+	cp.Tags = append([]string(nil), md.Tags...)
+	cp.SetId()
+	return cp.Id
+}
@@ -0,0 +1,176 @@
+package schema
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tag is a parsed "key=value" tag
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// String returns the tag in its wire form, "key=value"
+func (t Tag) String() string {
+	return t.Key + "=" + t.Value
+}
+
+// Tags is a set of valid tags with unique keys, kept sorted in the same order as their wire form,
+// the sorted []string of "key=value" entries used by MetricData and MetricDefinition.
+// The zero value is an empty set. Tags can be copied: modifying a copy does not affect the original.
+type Tags struct {
+	// tags are in their wire form. for valid tags with unique keys, sorting them also sorts them by key,
+	// and all tags with the same key are adjacent.
+	tags []string
+}
+
+// ParseTags parses tags in their wire form. Every tag must have a key and value that are valid according to
+// ValidateTagKey and ValidateTagValue, and keys must be unique. A "name" tag is treated like any other tag.
+// Errors are of type *ParseError.
+func ParseTags(tags []string) (Tags, error) {
+	for _, t := range tags {
+		if _, ok := parseTag(t); !ok {
+			return Tags{}, &ParseError{Input: t, Field: "tags", Err: ErrInvalidTagFormat}
+		}
+	}
+	if len(tags) == 0 {
+		return Tags{}, nil
+	}
+	parsed := sortTags(append([]string(nil), tags...))
+	for i := 1; i < len(parsed.tags); i++ {
+		if strings.HasPrefix(parsed.tags[i], parsed.tags[i-1][:strings.IndexByte(parsed.tags[i-1], '=')+1]) {
+			return Tags{}, &ParseError{Input: parsed.tags[i], Field: "tags", Err: ErrDuplicateTag}
+		}
+	}
+	return parsed, nil
+}
+
+// sortTags sorts tags in place and returns them as Tags, without validating them.
+// it is for the methods of MetricData and MetricDefinition, which have to deal with any tags they are given.
+func sortTags(tags []string) Tags {
+	sort.Strings(tags)
+	return Tags{tags: tags}
+}
+
+// parseTag splits a tag in its wire form at the first '=', and returns whether its key and value are valid
+func parseTag(t string) (Tag, bool) {
+	equal := strings.IndexByte(t, '=')
+	if equal < 0 || !ValidateTagKey(t[:equal]) || !ValidateTagValue(t[equal+1:]) {
+		return Tag{}, false
+	}
+	return Tag{Key: t[:equal], Value: t[equal+1:]}, true
+}
+
+// search returns the index of the tag with the given key, or where it would be inserted, and whether it exists
+func (t Tags) search(key string) (int, bool) {
+	prefix := key + "="
+	i := sort.SearchStrings(t.tags, prefix)
+	return i, i < len(t.tags) && strings.HasPrefix(t.tags[i], prefix)
+}
+
+// Len returns the number of tags
+func (t Tags) Len() int {
+	return len(t.tags)
+}
+
+// Get returns the value of the tag with the given key, and whether it exists
+func (t Tags) Get(key string) (string, bool) {
+	i, ok := t.search(key)
+	if !ok {
+		return "", false
+	}
+	return t.tags[i][len(key)+1:], true
+}
+
+// Has returns whether a tag with the given key exists
+func (t Tags) Has(key string) bool {
+	_, ok := t.search(key)
+	return ok
+}
+
+// Set sets the value of the tag with the given key, adding it if it doesn't exist.
+// It returns ErrInvalidTagFormat if key or value are not valid according to ValidateTagKey and ValidateTagValue.
+func (t *Tags) Set(key, value string) error {
+	if !ValidateTagKey(key) || !ValidateTagValue(value) {
+		return ErrInvalidTagFormat
+	}
+	t.set(key, value)
+	return nil
+}
+
+// set is Set for a key and value that are known to be valid
+func (t *Tags) set(key, value string) {
+	i, ok := t.search(key)
+	tags := make([]string, 0, len(t.tags)+1)
+	tags = append(tags, t.tags[:i]...)
+	tags = append(tags, key+"="+value)
+	if ok {
+		i++
+	}
+	t.tags = append(tags, t.tags[i:]...)
+}
+
+// Delete removes the tag with the given key, and returns whether it existed
+func (t *Tags) Delete(key string) bool {
+	i, ok := t.search(key)
+	if !ok {
+		return false
+	}
+	if len(t.tags) == 1 {
+		t.tags = nil
+		return true
+	}
+	tags := make([]string, 0, len(t.tags)-1)
+	tags = append(tags, t.tags[:i]...)
+	t.tags = append(tags, t.tags[i+1:]...)
+	return true
+}
+
+// withoutNameTags returns t without any name tag (see IsNameTag). Like Delete, it does not modify t.
+func (t Tags) withoutNameTags() Tags {
+	for i, tag := range t.tags {
+		if !IsNameTag(tag) {
+			continue
+		}
+		tags := make([]string, 0, len(t.tags)-1)
+		tags = append(tags, t.tags[:i]...)
+		for _, tag := range t.tags[i+1:] {
+			if !IsNameTag(tag) {
+				tags = append(tags, tag)
+			}
+		}
+		return Tags{tags: tags}
+	}
+	return t
+}
+
+// appendTo appends every tag in its wire form, preceded by sep, to b
+func (t Tags) appendTo(b []byte, sep byte) []byte {
+	for _, tag := range t.tags {
+		b = append(b, sep)
+		b = append(b, tag...)
+	}
+	return b
+}
+
+// List returns a copy of the tags, in sorted order
+func (t Tags) List() []Tag {
+	if len(t.tags) == 0 {
+		return nil
+	}
+	out := make([]Tag, len(t.tags))
+	for i, tag := range t.tags {
+		equal := strings.IndexByte(tag, '=')
+		out[i] = Tag{Key: tag[:equal], Value: tag[equal+1:]}
+	}
+	return out
+}
+
+// Strings returns the tags in their wire form, sorted, or nil if there are none
+func (t Tags) Strings() []string {
+	if len(t.tags) == 0 {
+		return nil
+	}
+	return append([]string(nil), t.tags...)
+}
@@ -0,0 +1,174 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	in := []string{"a=b", "a.b=c", "a~=x", "name=foo", "b=c=d", "a-b=z"}
+	tags, err := ParseTags(in)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	exp := append([]string(nil), in...)
+	sort.Strings(exp)
+	if got := tags.Strings(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if tags.Len() != len(in) {
+		t.Fatalf("expected %d tags, got %d", len(in), tags.Len())
+	}
+	if v, ok := tags.Get("b"); !ok || v != "c=d" {
+		t.Fatalf("expected value \"c=d\" for b, got %q, %t", v, ok)
+	}
+
+	empty, err := ParseTags(nil)
+	if err != nil || empty.Len() != 0 || empty.Strings() != nil || !reflect.DeepEqual(empty, Tags{}) {
+		t.Fatalf("expected empty tags, got %v and %v", empty, err)
+	}
+
+	invalid := []struct {
+		tags  []string
+		input string
+		err   error
+	}{
+		{[]string{"a=b", "c"}, "c", ErrInvalidTagFormat},
+		{[]string{"=b"}, "=b", ErrInvalidTagFormat},
+		{[]string{"a="}, "a=", ErrInvalidTagFormat},
+		{[]string{"a;b=c"}, "a;b=c", ErrInvalidTagFormat},
+		{[]string{"a=~b"}, "a=~b", ErrInvalidTagFormat},
+		{[]string{"a=b", "c=d", "a=e"}, "a=e", ErrDuplicateTag},
+		{[]string{"a=b", "a=b"}, "a=b", ErrDuplicateTag},
+	}
+	for _, c := range invalid {
+		_, err := ParseTags(c.tags)
+		perr, ok := err.(*ParseError)
+		if !ok || perr.Field != "tags" || !errors.Is(err, c.err) {
+			t.Fatalf("%v: expected ParseError caused by %q, got %v", c.tags, c.err, err)
+		}
+		if c.err == ErrInvalidTagFormat && perr.Input != c.input {
+			t.Fatalf("%v: expected error for %q, got %v", c.tags, c.input, err)
+		}
+	}
+}
+
+func TestTagsSetDelete(t *testing.T) {
+	var tags Tags
+	for _, kv := range [][2]string{{"b", "1"}, {"a", "2"}, {"a.b", "3"}, {"c", "4"}, {"a", "5"}} {
+		if err := tags.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	exp := []string{"a.b=3", "a=5", "b=1", "c=4"}
+	if got := tags.Strings(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if !tags.Has("a.b") || tags.Has("a.") || tags.Has("d") {
+		t.Fatalf("unexpected Has results for %v", tags.Strings())
+	}
+	if _, ok := tags.Get("d"); ok {
+		t.Fatalf("expected no value for d")
+	}
+
+	for _, kv := range [][2]string{{"", "x"}, {"a=b", "x"}, {"a!", "x"}, {"a", ""}, {"a", "~x"}, {"a", "x;y"}} {
+		if err := tags.Set(kv[0], kv[1]); err != ErrInvalidTagFormat {
+			t.Fatalf("%q=%q: expected ErrInvalidTagFormat, got %v", kv[0], kv[1], err)
+		}
+	}
+
+	// modifying a copy must not affect the original
+	cp := tags
+	if !cp.Delete("a") || cp.Delete("a") || cp.Delete("d") {
+		t.Fatalf("unexpected Delete results")
+	}
+	if err := cp.Set("b", "6"); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if got := cp.Strings(); !reflect.DeepEqual([]string{"a.b=3", "b=6", "c=4"}, got) {
+		t.Fatalf("unexpected tags %v after Delete and Set", got)
+	}
+	if got := tags.Strings(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected original tags %v, got %v", exp, got)
+	}
+	list := tags.List()
+	list[0].Value = "x"
+	if v, _ := tags.Get("a.b"); v != "3" {
+		t.Fatalf("modifying the result of List modified the tags")
+	}
+}
+
+func TestSetTags(t *testing.T) {
+	tags, err := ParseTags([]string{"c=c", "a=a", "name=x", "a.b=b"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	md := MetricData{OrgId: 1, Name: "x", Interval: 10, Mtype: "gauge", Tags: []string{"a.b=b", "c=c", "a=a", "name=x"}}
+	md.SetId()
+	md2 := MetricData{OrgId: 1, Name: "x", Interval: 10, Mtype: "gauge"}
+	md2.SetTags(tags)
+	md2.SetId()
+	if !reflect.DeepEqual(md, md2) {
+		t.Fatalf("expected %+v, got %+v", md, md2)
+	}
+	parsed, err := md2.ParsedTags()
+	if err != nil || !reflect.DeepEqual(tags, parsed) {
+		t.Fatalf("expected %v, got %v and %v", tags, parsed, err)
+	}
+
+	def := MetricDefinition{OrgId: 1, Name: "x", Interval: 10, Mtype: "gauge", Tags: []string{"d=d"}}
+	if def.NameWithTags() != "x;d=d" {
+		t.Fatalf("unexpected name with tags %q", def.NameWithTags())
+	}
+	def.SetTags(tags)
+	def.SetId()
+	if def.NameWithTags() != "x;a.b=b;a=a;c=c" {
+		t.Fatalf("unexpected name with tags %q", def.NameWithTags())
+	}
+	def2 := MetricDefinition{OrgId: 1, Name: "x", Interval: 10, Mtype: "gauge", Tags: []string{"c=c", "a=a", "name=x", "a.b=b"}}
+	def2.SetId()
+	if def.Id != def2.Id {
+		t.Fatalf("expected the id of %+v, got %v", def2, def.Id)
+	}
+	parsed, err = def.ParsedTags()
+	if err != nil || !parsed.Has("a.b") || parsed.Has("name") {
+		t.Fatalf("unexpected tags %v and %v", parsed, err)
+	}
+}
+
+// FuzzTags checks that Tags keep the order of their wire form while being modified
+func FuzzTags(f *testing.F) {
+	f.Add("a=b;a.b=c;a~=d", "a", "x")
+	f.Add("b=c", "a.", "y")
+	f.Fuzz(func(t *testing.T, in, key, value string) {
+		tags, err := ParseTags(strings.Split(in, ";"))
+		if err != nil {
+			return
+		}
+		check := func() {
+			s := tags.Strings()
+			if !sort.StringsAreSorted(s) {
+				t.Fatalf("%q: tags %v are not sorted", in, s)
+			}
+			again, err := ParseTags(s)
+			if err != nil || !reflect.DeepEqual(again, tags) {
+				t.Fatalf("%q: tags %v parsed to %v and %v", in, s, again, err)
+			}
+		}
+		check()
+		if tags.Set(key, value) == nil {
+			if v, ok := tags.Get(key); !ok || v != value {
+				t.Fatalf("%q: expected %q=%q after Set, got %q, %t", in, key, value, v, ok)
+			}
+			check()
+			if !tags.Delete(key) || tags.Has(key) {
+				t.Fatalf("%q: failed to delete %q", in, key)
+			}
+			check()
+		}
+	})
+}